@@ -10,6 +10,7 @@ addHotkey('KP_PLUS', true, false, false, true, true, 'changeSpeed(1)')
 addHotkey('KP_MINUS', true, false, false, true, true, 'changeSpeed(-1)')
 addHotkey('l', true, false, false, true, true, 'toggleStatusDraw()')
 addHotkey('v', true, false, false, true, true, 'toggleVsync()')
+addHotkey('p', true, false, false, true, true, 'togglePaletteEditor()')
 addHotkey('1', true, false, false, true, true, 'toggleAI(1)')
 addHotkey('1', true, true, false, true, true, 'togglePlayer(1)')
 addHotkey('2', true, false, false, true, true, 'toggleAI(2)')
@@ -41,6 +42,8 @@ addHotkey('i', true, false, false, true, true, 'stand(1);stand(2);stand(3);stand
 addHotkey('PAUSE', false, false, false, true, false, 'togglePause();closeMenu()')
 addHotkey('PAUSE', true, false, false, true, false, 'step()')
 addHotkey('SCROLLLOCK', false, false, false, true, false, 'step()')
+addHotkey(config.ClipKey or 'F10', false, false, false, true, false, 'clipSave()')
+addHotkey(config.ClipKey or 'F10', false, false, true, true, false, 'clipMark()')
 
 local speedMul = 1
 local speedAdd = 0
@@ -1297,17 +1297,29 @@ end
 
 --play music
 main.lastBgm = ''
-function main.f_playBGM(interrupt, bgm, bgmLoop, bgmVolume, bgmLoopstart, bgmLoopend)
+function main.f_playBGM(interrupt, bgm, bgmLoop, bgmVolume, bgmLoopstart, bgmLoopend, bgmSoundfont)
 	if main.flags['-nomusic'] ~= nil then
 		return
 	end
 	local bgm = bgm or ''
 	if interrupt or bgm:gsub('^%./', '') ~= main.lastBgm then
-		playBGM(bgm, bgmLoop or 1, bgmVolume or 100, bgmLoopstart or 0, bgmLoopend or 0)
+		playBGM(bgm, bgmLoop or 1, bgmVolume or 100, bgmLoopstart or 0, bgmLoopend or 0, 0, nil, bgmSoundfont or '')
 		main.lastBgm = bgm:gsub('^%./', '')
 	end
 end
 
+--play music tracks one after another
+function main.f_playBGMList(interrupt, t, shuffle, bgmVolume, bgmSoundfont)
+	if main.flags['-nomusic'] ~= nil then
+		return
+	end
+	local bgm = table.concat(t, ',')
+	if interrupt or bgm ~= main.lastBgm then
+		playBGMList(t, shuffle, bgmVolume or 100, nil, bgmSoundfont or '')
+		main.lastBgm = bgm
+	end
+end
+
 main.pauseMenu = false
 require('external.script.global')
 
@@ -1923,7 +1935,7 @@ function main.f_addStage(file, hidden)
 	end
 	--music
 	for k, v in pairs(t_info.stagebgm) do
-		if k:match('^bgmusic') or k:match('^bgmvolume') or k:match('^bgmloop') then
+		if k:match('^bgmusic') or k:match('^bgmvolume') or k:match('^bgmloop') or k:match('^bgmsoundfont') or k:match('^bgmtempo') then
 			if t_info.stagebgm[k] ~= '' then
 				local prefix, dot, suffix, round = k:match('^([^%.]+)(%.?)([A-Za-z]*)([0-9]*)$')
 				local bgtype = 'music' .. suffix
@@ -1940,12 +1952,26 @@ function main.f_addStage(file, hidden)
 				if #t_ref == 0 then
 					table.insert(t_ref, {bgmusic = '', bgmvolume = 100, bgmloopstart = 0, bgmloopend = 0})
 				end
-				if k:match('^bgmusic') then
+				if k:match('^bgmusic') or k:match('^bgmsoundfont') then
 					t_ref[1][prefix] = searchFile(tostring(v), {file, "", "data/", "sound/"})
 				elseif tonumber(v) then
 					t_ref[1][prefix] = tonumber(v)
 				end
 			end
+		--bgmplaylist (comma separated tracks), bgmlayer.life, bgmlayer.final
+		elseif (k == 'bgmplaylist' or k:match('^bgmlayer%.')) and v ~= '' then
+			local t = {}
+			for track in tostring(v):gmatch('[^,]+') do
+				track = track:match('^%s*(.-)%s*$')
+				if track ~= '' then
+					table.insert(t, searchFile(track, {file, "", "data/", "sound/"}))
+				end
+			end
+			if k == 'bgmplaylist' then
+				main.t_selStages[stageNo].bgmplaylist = t
+			else
+				main.t_selStages[stageNo][k:gsub('%.', '_')] = t[1]
+			end
 		elseif v ~= '' then
 			main.t_selStages[stageNo][k:gsub('%.', '_')] = main.f_dataType(v)
 		end
@@ -3088,7 +3114,7 @@ function main.f_createMenu(tbl, bool_bgreset, bool_main, bool_f1, bool_del)
 		if bool_bgreset then
 			if motif.attract_mode.enabled == 0 then
 				main.f_bgReset(motif[main.background].bg)
-				main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+				main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 			end
 			main.f_fadeReset('fadein', motif[main.group])
 		end
@@ -3348,7 +3374,7 @@ function main.f_replay()
 	main.f_bgReset(motif.replaybgdef.bg)
 	main.f_fadeReset('fadein', motif.replay_info)
 	if motif.music.replay_bgm ~= '' then
-		main.f_playBGM(false, motif.music.replay_bgm, motif.music.replay_bgm_loop, motif.music.replay_bgm_volume, motif.music.replay_bgm_loopstart, motif.music.replay_bgm_loopend)
+		main.f_playBGM(false, motif.music.replay_bgm, motif.music.replay_bgm_loop, motif.music.replay_bgm_volume, motif.music.replay_bgm_loopstart, motif.music.replay_bgm_loopend, motif.music.replay_bgm_soundfont)
 	end
 	main.close = false
 	while true do
@@ -3357,7 +3383,7 @@ function main.f_replay()
 		if main.close and not main.fadeActive then
 			main.f_bgReset(motif[main.background].bg)
 			main.f_fadeReset('fadein', motif[main.group])
-			main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+			main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 			main.close = false
 			break
 		elseif esc() or main.f_input(main.t_players, {'m'}) or (t[item].itemname == 'back' and main.f_input(main.t_players, {'pal', 's'})) then
@@ -3503,7 +3529,7 @@ function main.f_hiscoreDisplay(itemname)
 		main.f_refresh()
 	end
 	main.f_fadeReset('fadein', motif[main.group])
-	main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+	main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 	return true
 end
 
@@ -3524,7 +3550,7 @@ function main.f_attractStart()
 	clearColor(motif.attractbgdef.bgclearcolor[1], motif.attractbgdef.bgclearcolor[2], motif.attractbgdef.bgclearcolor[3])
 	main.f_bgReset(motif.attractbgdef.bg)
 	main.f_fadeReset('fadein', motif.attract_mode)
-	main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+	main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 	while true do
 		counter = counter + 1
 		--draw layerno = 0 backgrounds
@@ -3732,7 +3758,7 @@ function main.f_demoStart()
 		main.f_bgReset(motif[main.background].bg)
 		--start title BGM only if it has been interrupted
 		if motif.demo_mode.fight_stopbgm == 1 or motif.demo_mode.fight_playbgm == 1 or (introWaitCycles == 0 and motif.files.intro_storyboard ~= '') then
-			main.f_playBGM(true, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+			main.f_playBGM(true, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 		end
 	end
 	main.f_fadeReset('fadein', motif.demo_mode)
@@ -4150,6 +4176,18 @@ main.f_loadingRefresh(main.txt_loading)
 main.txt_loading = nil
 --sleep(1)
 
+if main.flags['-render'] ~= nil then
+	enterReplay(main.flags['-render'], main.flags['-out'] or 'save/render')
+	synchronize()
+	math.randomseed(sszRandom())
+	main.f_cmdBufReset()
+	main.menu.submenu.server.loop()
+	replayStop()
+	exitNetPlay()
+	exitReplay()
+	os.exit()
+end
+
 if motif.attract_mode.enabled == 1 then
 	main.f_attractMode()
 else
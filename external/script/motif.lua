@@ -42,56 +42,67 @@ local motif =
 		title_bgm_loop = 1,
 		title_bgm_loopstart = 0,
 		title_bgm_loopend = 0,
+		title_bgm_soundfont = '', --Ikemen feature
 		select_bgm = '',
 		select_bgm_volume = 100,
 		select_bgm_loop = 1,
 		select_bgm_loopstart = 0,
 		select_bgm_loopend = 0,
+		select_bgm_soundfont = '', --Ikemen feature
 		vs_bgm = '',
 		vs_bgm_volume = 100,
 		vs_bgm_loop = 1,
 		vs_bgm_loopstart = 0,
 		vs_bgm_loopend = 0,
+		vs_bgm_soundfont = '', --Ikemen feature
 		victory_bgm = '',
 		victory_bgm_volume = 100,
 		victory_bgm_loop = 1,
 		victory_bgm_loopstart = 0,
 		victory_bgm_loopend = 0,
+		victory_bgm_soundfont = '', --Ikemen feature
 		option_bgm = '', --Ikemen feature
 		option_bgm_volume = 100, --Ikemen feature
 		option_bgm_loop = 1, --Ikemen feature
 		option_bgm_loopstart = 0, --Ikemen feature
 		option_bgm_loopend = 0, --Ikemen feature
+		option_bgm_soundfont = '', --Ikemen feature
 		replay_bgm = '', --Ikemen feature
 		replay_bgm_volume = 100, --Ikemen feature
 		replay_bgm_loop = 1, --Ikemen feature
 		replay_bgm_loopstart = 0, --Ikemen feature
 		replay_bgm_loopend = 0, --Ikemen feature
+		replay_bgm_soundfont = '', --Ikemen feature
 		continue_bgm = '', --Ikemen feature
 		continue_bgm_volume = 100, --Ikemen feature
 		continue_bgm_loop = 1, --Ikemen feature
 		continue_bgm_loopstart = 0, --Ikemen feature
 		continue_bgm_loopend = 0, --Ikemen feature
+		continue_bgm_soundfont = '', --Ikemen feature
 		continue_end_bgm = '', --Ikemen feature
 		continue_end_bgm_volume = 100, --Ikemen feature
 		continue_end_bgm_loop = 0, --Ikemen feature
 		continue_end_bgm_loopstart = 0, --Ikemen feature
 		continue_end_bgm_loopend = 0, --Ikemen feature
+		continue_end_bgm_soundfont = '', --Ikemen feature
 		results_bgm = '', --Ikemen feature
 		results_bgm_volume = 100, --Ikemen feature
 		results_bgm_loop = 1, --Ikemen feature
 		results_bgm_loopstart = 0, --Ikemen feature
 		results_bgm_loopend = 0, --Ikemen feature
+		results_bgm_soundfont = '', --Ikemen feature
 		results_lose_bgm = '', --Ikemen feature
 		results_lose_bgm_volume = 100, --Ikemen feature
 		results_lose_bgm_loop = 1, --Ikemen feature
 		results_lose_bgm_loopstart = 0, --Ikemen feature
 		results_lose_bgm_loopend = 0, --Ikemen feature
+		results_lose_bgm_soundfont = '', --Ikemen feature
 		hiscore_bgm = '', --Ikemen feature
 		hiscore_bgm_volume = 100, --Ikemen feature
 		hiscore_bgm_loop = 1, --Ikemen feature
 		hiscore_bgm_loopstart = 0, --Ikemen feature
 		hiscore_bgm_loopend = 0, --Ikemen feature
+		hiscore_bgm_soundfont = '', --Ikemen feature
 	},
 	title_info =
 	{
@@ -1260,6 +1271,21 @@ local motif =
 		--menu_itemname_mastervolume = 'Master Volume', --Ikemen feature
 		--menu_itemname_bgmvolume = 'BGM Volume', --Ikemen feature
 		--menu_itemname_sfxvolume = 'SFX Volume', --Ikemen feature
+		--menu_itemname_voicevolume = 'Voice Volume', --Ikemen feature
+		--menu_itemname_hitvolume = 'Hit SFX Volume', --Ikemen feature
+		--menu_itemname_systemvolume = 'System Volume', --Ikemen feature
+		--menu_itemname_ambiencevolume = 'Ambience Volume', --Ikemen feature
+		--menu_itemname_menubuses = 'Mute and Solo', --Ikemen feature
+		--menu_itemname_voicemute = 'Mute Voice', --Ikemen feature
+		--menu_itemname_voicesolo = 'Solo Voice', --Ikemen feature
+		--menu_itemname_hitmute = 'Mute Hit SFX', --Ikemen feature
+		--menu_itemname_hitsolo = 'Solo Hit SFX', --Ikemen feature
+		--menu_itemname_systemmute = 'Mute System', --Ikemen feature
+		--menu_itemname_systemsolo = 'Solo System', --Ikemen feature
+		--menu_itemname_ambiencemute = 'Mute Ambience', --Ikemen feature
+		--menu_itemname_ambiencesolo = 'Solo Ambience', --Ikemen feature
+		--menu_itemname_bgmmute = 'Mute BGM', --Ikemen feature
+		--menu_itemname_bgmsolo = 'Solo BGM', --Ikemen feature
 		--menu_itemname_audioducking = 'Audio Ducking', --Ikemen feature
 		--menu_itemname_stereoeffects = "Stereo Effects", --Ikemen feature
 		--menu_itemname_panningrange = "Panning Range", --Ikemen feature
@@ -2029,6 +2055,23 @@ function motif.setBaseOptionInfo()
 	motif.option_info.menu_itemname_menuaudio_mastervolume = "Master Volume"
 	motif.option_info.menu_itemname_menuaudio_bgmvolume = "BGM Volume"
 	motif.option_info.menu_itemname_menuaudio_sfxvolume = "SFX Volume"
+	motif.option_info.menu_itemname_menuaudio_voicevolume = "Voice Volume"
+	motif.option_info.menu_itemname_menuaudio_hitvolume = "Hit SFX Volume"
+	motif.option_info.menu_itemname_menuaudio_systemvolume = "System Volume"
+	motif.option_info.menu_itemname_menuaudio_ambiencevolume = "Ambience Volume"
+	motif.option_info.menu_itemname_menuaudio_menubuses = "Mute and Solo"
+	motif.option_info.menu_itemname_menuaudio_menubuses_voicemute = "Mute Voice"
+	motif.option_info.menu_itemname_menuaudio_menubuses_voicesolo = "Solo Voice"
+	motif.option_info.menu_itemname_menuaudio_menubuses_hitmute = "Mute Hit SFX"
+	motif.option_info.menu_itemname_menuaudio_menubuses_hitsolo = "Solo Hit SFX"
+	motif.option_info.menu_itemname_menuaudio_menubuses_systemmute = "Mute System"
+	motif.option_info.menu_itemname_menuaudio_menubuses_systemsolo = "Solo System"
+	motif.option_info.menu_itemname_menuaudio_menubuses_ambiencemute = "Mute Ambience"
+	motif.option_info.menu_itemname_menuaudio_menubuses_ambiencesolo = "Solo Ambience"
+	motif.option_info.menu_itemname_menuaudio_menubuses_bgmmute = "Mute BGM"
+	motif.option_info.menu_itemname_menuaudio_menubuses_bgmsolo = "Solo BGM"
+	motif.option_info.menu_itemname_menuaudio_menubuses_empty = ""
+	motif.option_info.menu_itemname_menuaudio_menubuses_back = "Back"
 	motif.option_info.menu_itemname_menuaudio_audioducking = "Audio Ducking"
 	motif.option_info.menu_itemname_menuaudio_stereoeffects = "Stereo Effects"
 	motif.option_info.menu_itemname_menuaudio_panningrange = "Panning Range"
@@ -2149,6 +2192,23 @@ function motif.setBaseOptionInfo()
 		"menuaudio_mastervolume",
 		"menuaudio_bgmvolume",
 		"menuaudio_sfxvolume",
+		"menuaudio_voicevolume",
+		"menuaudio_hitvolume",
+		"menuaudio_systemvolume",
+		"menuaudio_ambiencevolume",
+		"menuaudio_menubuses",
+		"menuaudio_menubuses_voicemute",
+		"menuaudio_menubuses_voicesolo",
+		"menuaudio_menubuses_hitmute",
+		"menuaudio_menubuses_hitsolo",
+		"menuaudio_menubuses_systemmute",
+		"menuaudio_menubuses_systemsolo",
+		"menuaudio_menubuses_ambiencemute",
+		"menuaudio_menubuses_ambiencesolo",
+		"menuaudio_menubuses_bgmmute",
+		"menuaudio_menubuses_bgmsolo",
+		"menuaudio_menubuses_empty",
+		"menuaudio_menubuses_back",
 		"menuaudio_audioducking",
 		"menuaudio_stereoeffects",
 		"menuaudio_panningrange",
@@ -2518,15 +2578,25 @@ for _, v in ipairs({
 	{group = 'files', param = 'glyphs', dirs = {motif.fileDir, '', 'data/'}},
 	{group = 'files', param = 'module', dirs = {motif.fileDir, '', 'data/'}},
 	{group = 'music', param = 'title_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'title_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'select_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'select_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'vs_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'vs_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'victory_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'victory_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'option_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'option_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'replay_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'replay_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'continue_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'continue_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'continue_end_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'continue_end_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'results_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'results_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'music', param = 'hiscore_bgm', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
+	{group = 'music', param = 'hiscore_bgm_soundfont', dirs = {motif.fileDir, '', 'data/', 'sound/'}},
 	{group = 'default_ending', param = 'storyboard', dirs = {motif.fileDir, '', 'data/'}},
 	{group = 'end_credits', param = 'storyboard', dirs = {motif.fileDir, '', 'data/'}},
 	{group = 'game_over_screen', param = 'storyboard', dirs = {motif.fileDir, '', 'data/'}},
@@ -53,6 +53,40 @@ function options.f_displayRatio(value)
 	return ret .. '%'
 end
 
+-- returns function controlling volume of audio bus (voice, sfx, system, ambience)
+local function f_busVolume(bus)
+	return function(t, item, cursorPosY, moveTxt)
+		local cfg = config.AudioBuses[bus]
+		if main.f_input(main.t_players, {'$F'}) and cfg.Volume < 100 then
+			cfg.Volume = cfg.Volume + 1
+		elseif main.f_input(main.t_players, {'$B'}) and cfg.Volume > 0 then
+			cfg.Volume = cfg.Volume - 1
+		else
+			return true
+		end
+		sndPlay(motif.files.snd_data, motif.option_info.cursor_move_snd[1], motif.option_info.cursor_move_snd[2])
+		t.items[item].vardisplay = cfg.Volume .. '%'
+		setAudioBus(bus, cfg.Volume, cfg.Mute, cfg.Solo)
+		options.modified = true
+		return true
+	end
+end
+
+-- returns function toggling Mute or Solo of audio bus
+local function f_busToggle(bus, field)
+	return function(t, item, cursorPosY, moveTxt)
+		if main.f_input(main.t_players, {'$F', '$B', 'pal', 's'}) then
+			local cfg = config.AudioBuses[bus]
+			sndPlay(motif.files.snd_data, motif.option_info.cursor_move_snd[1], motif.option_info.cursor_move_snd[2])
+			cfg[field] = not cfg[field]
+			t.items[item].vardisplay = options.f_boolDisplay(cfg[field])
+			setAudioBus(bus, cfg.Volume, cfg.Mute, cfg.Solo)
+			options.modified = true
+		end
+		return true
+	end
+end
+
 local function f_externalShaderName()
 	if #config.ExternalShaders > 0 and config.PostProcessingShader ~= 0 then
 		return config.ExternalShaders[1]:gsub('^.+/', '')
@@ -102,6 +136,10 @@ options.t_itemname = {
 			config.AIRamping = true
 			config.AIRandomColor = false
 			config.AISurvivalColor = true
+			for k, v in pairs(config.AudioBuses) do
+				config.AudioBuses[k] = {Volume = 100, Mute = false, Solo = false}
+				setAudioBus(k, 100, false, false)
+			end
 			config.AudioDucking = false
 			--config.AudioSampleRate = 44100
 			config.AutoGuard = false
@@ -938,6 +976,25 @@ options.t_itemname = {
 		end
 		return true
 	end,
+	--Voice Volume
+	['voicevolume'] = f_busVolume('voice'),
+	--Hit SFX Volume
+	['hitvolume'] = f_busVolume('sfx'),
+	--System Volume (announcer and menu sounds)
+	['systemvolume'] = f_busVolume('system'),
+	--Ambience Volume
+	['ambiencevolume'] = f_busVolume('ambience'),
+	--Mute and Solo (audio buses)
+	['voicemute'] = f_busToggle('voice', 'Mute'),
+	['voicesolo'] = f_busToggle('voice', 'Solo'),
+	['hitmute'] = f_busToggle('sfx', 'Mute'),
+	['hitsolo'] = f_busToggle('sfx', 'Solo'),
+	['systemmute'] = f_busToggle('system', 'Mute'),
+	['systemsolo'] = f_busToggle('system', 'Solo'),
+	['ambiencemute'] = f_busToggle('ambience', 'Mute'),
+	['ambiencesolo'] = f_busToggle('ambience', 'Solo'),
+	['bgmmute'] = f_busToggle('bgm', 'Mute'),
+	['bgmsolo'] = f_busToggle('bgm', 'Solo'),
 	--Audio Ducking
 	['audioducking'] = function(t, item, cursorPosY, moveTxt)
 		if main.f_input(main.t_players, {'$F', '$B', 'pal', 's'}) then
@@ -1207,7 +1264,7 @@ function options.f_createMenu(tbl, bool_main)
 			main.f_bgReset(motif.optionbgdef.bg)
 			main.f_fadeReset('fadein', motif.option_info)
 			if motif.music.option_bgm ~= '' then
-				main.f_playBGM(false, motif.music.option_bgm, motif.music.option_bgm_loop, motif.music.option_bgm_volume, motif.music.option_bgm_loopstart, motif.music.option_bgm_loopend)
+				main.f_playBGM(false, motif.music.option_bgm, motif.music.option_bgm_loop, motif.music.option_bgm_volume, motif.music.option_bgm_loopstart, motif.music.option_bgm_loopend, motif.music.option_bgm_soundfont)
 			end
 			main.close = false
 		end
@@ -1223,7 +1280,7 @@ function options.f_createMenu(tbl, bool_main)
 			if main.close and not main.fadeActive then
 				main.f_bgReset(motif[main.background].bg)
 				main.f_fadeReset('fadein', motif[main.group])
-				main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+				main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 				main.close = false
 				break
 			elseif esc() or main.f_input(main.t_players, {'m'}) then
@@ -1274,6 +1331,15 @@ options.t_vardisplay = {
 	['airamping'] = function()
 		return options.f_boolDisplay(config.AIRamping)
 	end,
+	['ambiencemute'] = function()
+		return options.f_boolDisplay(config.AudioBuses.ambience.Mute)
+	end,
+	['ambiencesolo'] = function()
+		return options.f_boolDisplay(config.AudioBuses.ambience.Solo)
+	end,
+	['ambiencevolume'] = function()
+		return config.AudioBuses.ambience.Volume .. '%'
+	end,
 	['audioducking'] = function()
 		return options.f_boolDisplay(config.AudioDucking, motif.option_info.menu_valuename_enabled, motif.option_info.menu_valuename_disabled)
 	end,
@@ -1283,6 +1349,12 @@ options.t_vardisplay = {
 	--['backgroundloading'] = function()
 	--	return options.f_boolDisplay(config.BackgroundLoading, motif.option_info.menu_valuename_enabled, motif.option_info.menu_valuename_disabled)
 	--end,
+	['bgmmute'] = function()
+		return options.f_boolDisplay(config.AudioBuses.bgm.Mute)
+	end,
+	['bgmsolo'] = function()
+		return options.f_boolDisplay(config.AudioBuses.bgm.Solo)
+	end,
 	['bgmvolume'] = function()
 		return config.VolumeBgm .. '%'
 	end,
@@ -1313,6 +1385,15 @@ options.t_vardisplay = {
 	['helpermax'] = function()
 		return config.MaxHelper
 	end,
+	['hitmute'] = function()
+		return options.f_boolDisplay(config.AudioBuses.sfx.Mute)
+	end,
+	['hitsolo'] = function()
+		return options.f_boolDisplay(config.AudioBuses.sfx.Solo)
+	end,
+	['hitvolume'] = function()
+		return config.AudioBuses.sfx.Volume .. '%'
+	end,
 	['lifemul'] = function()
 		return config.LifeMul .. '%'
 	end,
@@ -1427,6 +1508,15 @@ options.t_vardisplay = {
 	['stunbar'] = function()
 		return options.f_boolDisplay(config.BarStun)
 	end,
+	['systemmute'] = function()
+		return options.f_boolDisplay(config.AudioBuses.system.Mute)
+	end,
+	['systemsolo'] = function()
+		return options.f_boolDisplay(config.AudioBuses.system.Solo)
+	end,
+	['systemvolume'] = function()
+		return config.AudioBuses.system.Volume .. '%'
+	end,
 	['teamduplicates'] = function()
 		return options.f_boolDisplay(config.TeamDuplicates)
 	end,
@@ -1445,6 +1535,15 @@ options.t_vardisplay = {
 	['vretrace'] = function()
 		return options.f_definedDisplay(config.VRetrace, {[1] = motif.option_info.menu_valuename_enabled}, motif.option_info.menu_valuename_disabled)
 	end,
+	['voicemute'] = function()
+		return options.f_boolDisplay(config.AudioBuses.voice.Mute)
+	end,
+	['voicesolo'] = function()
+		return options.f_boolDisplay(config.AudioBuses.voice.Solo)
+	end,
+	['voicevolume'] = function()
+		return config.AudioBuses.voice.Volume .. '%'
+	end,
 }
 
 -- Returns setting value rendered alongside menu item name (calls appropriate
@@ -271,7 +271,7 @@ function randomtest.run()
 	end
 	main.f_bgReset(motif[main.background].bg)
 	main.f_fadeReset('fadein', motif[main.group])
-	main.f_playBGM(true, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+	main.f_playBGM(true, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 end
 
 return randomtest
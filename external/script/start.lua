@@ -539,6 +539,7 @@ function start.f_setMusic(num, data)
 	start.bgmround = 0
 	start.t_music = {}
 	local side = 2
+	local stageMusic = false
 	for _, v in ipairs({'music', 'musicfinal', 'musiclife', 'musicvictory', 'musicvictory'}) do
 		if start.t_music[v] == nil then
 			start.t_music[v] = {}
@@ -555,6 +556,7 @@ function start.f_setMusic(num, data)
 			-- music assigned as stage param
 			elseif main.t_selStages[num] ~= nil and main.t_selStages[num][v] ~= nil then
 				t_ref = main.t_selStages[num][v]
+				stageMusic = stageMusic or v == 'music'
 			end
 		end
 		-- append t_music table
@@ -567,7 +569,9 @@ function start.f_setMusic(num, data)
 						bgmusic = v2[track].bgmusic,
 						bgmvolume = v2[track].bgmvolume,
 						bgmloopstart = v2[track].bgmloopstart,
-						bgmloopend = v2[track].bgmloopend
+						bgmloopend = v2[track].bgmloopend,
+						bgmsoundfont = v2[track].bgmsoundfont,
+						bgmtempo = v2[track].bgmtempo
 					}
 				end
 			else
@@ -578,7 +582,9 @@ function start.f_setMusic(num, data)
 						bgmusic = t_ref[track].bgmusic,
 						bgmvolume = t_ref[track].bgmvolume,
 						bgmloopstart = t_ref[track].bgmloopstart,
-						bgmloopend = t_ref[track].bgmloopend
+						bgmloopend = t_ref[track].bgmloopend,
+						bgmsoundfont = t_ref[track].bgmsoundfont,
+						bgmtempo = t_ref[track].bgmtempo
 					}
 				-- musicfinal and musiclife tracks are stored without additional nesting
 				else
@@ -586,7 +592,9 @@ function start.f_setMusic(num, data)
 						bgmusic = t_ref[track].bgmusic,
 						bgmvolume = t_ref[track].bgmvolume,
 						bgmloopstart = t_ref[track].bgmloopstart,
-						bgmloopend = t_ref[track].bgmloopend
+						bgmloopend = t_ref[track].bgmloopend,
+						bgmsoundfont = t_ref[track].bgmsoundfont,
+						bgmtempo = t_ref[track].bgmtempo
 					}
 				end
 			end
@@ -603,6 +611,35 @@ function start.f_setMusic(num, data)
 			start.t_music[k] = v
 		end
 	end
+	-- bgmplaylist, bgmplaylist.mode, bgmlayer.life, bgmlayer.final (only along with stage music)
+	if stageMusic or next(start.t_music.music) == nil then
+		for _, k in ipairs({'bgmplaylist', 'bgmplaylist_mode', 'bgmlayer_life', 'bgmlayer_final'}) do
+			if main.t_selStages[num] ~= nil then
+				start.t_music[k] = main.t_selStages[num][k]
+			end
+		end
+	end
+	-- bgmchannelvolume (MIDI channel volumes in channel order), bgmchannelmute (MIDI channels)
+	start.t_music.bgmchannelvolume = {}
+	start.t_music.bgmchannelmute = {}
+	if (stageMusic or next(start.t_music.music) == nil) and main.t_selStages[num] ~= nil then
+		local ch = 0
+		for v in tostring(main.t_selStages[num].bgmchannelvolume or ''):gmatch('[^,]+') do
+			ch = ch + 1
+			start.t_music.bgmchannelvolume[ch] = tonumber(v)
+		end
+		for v in tostring(main.t_selStages[num].bgmchannelmute or ''):gmatch('%d+') do
+			start.t_music.bgmchannelmute[tonumber(v)] = true
+		end
+	end
+end
+
+-- applies the MIDI tempo of a stage track and the stage MIDI channel settings
+function start.f_setBGMMidi(t)
+	setBGMTempo(t ~= nil and t.bgmtempo or 100)
+	for ch = 1, 16 do
+		setBGMChannel(ch, start.t_music.bgmchannelvolume[ch] or 100, start.t_music.bgmchannelmute[ch] == true)
+	end
 end
 
 --remaps palette based on button press and character's keymap settings
@@ -654,6 +691,14 @@ function start.f_selectPal(ref, palno)
 	panicError("\n" .. start.f_getCharData(ref).name .. " palette was not selected\n")
 end
 
+-- returns name of user palette selected by holding D with palette button (nil if not available)
+function start.f_selectUserPal(ref, palno, cmd)
+	if not commandGetState(main.t_cmd[cmd], '/d') then
+		return nil
+	end
+	return getCharUserPalettes(ref)[palno]
+end
+
 --returns ratio level
 local t_ratioArray = {
 	{2, 1, 1},
@@ -1422,7 +1467,7 @@ function start.f_selectMode()
 			sndPlay(motif.files.snd_data, motif.select_info.cancel_snd[1], motif.select_info.cancel_snd[2])
 			main.f_bgReset(motif[main.background].bg)
 			main.f_fadeReset('fadein', motif[main.group])
-			main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+			main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 			return
 		end
 		--first match
@@ -1495,7 +1540,7 @@ function start.f_selectMode()
 			if start.exit then
 				main.f_bgReset(motif[main.background].bg)
 				main.f_fadeReset('fadein', motif[main.group])
-				main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend)
+				main.f_playBGM(false, motif.music.title_bgm, motif.music.title_bgm_loop, motif.music.title_bgm_volume, motif.music.title_bgm_loopstart, motif.music.title_bgm_loopend, motif.music.title_bgm_soundfont)
 				start.exit = false
 				return
 			end
@@ -1938,7 +1983,7 @@ function start.f_selectScreen()
 	end
 	main.f_bgReset(motif.selectbgdef.bg)
 	main.f_fadeReset('fadein', motif.select_info)
-	main.f_playBGM(false, motif.music.select_bgm, motif.music.select_bgm_loop, motif.music.select_bgm_volume, motif.music.select_bgm_loopstart, motif.music.select_bgm_loopend)
+	main.f_playBGM(false, motif.music.select_bgm, motif.music.select_bgm_loop, motif.music.select_bgm_volume, motif.music.select_bgm_loopstart, motif.music.select_bgm_loopend, motif.music.select_bgm_soundfont)
 	start.f_resetTempData(motif.select_info, '_face')
 	local stageActiveCount = 0
 	local stageActiveType = 'stage_active'
@@ -2641,6 +2686,7 @@ function start.f_selectMenu(side, cmd, player, member, selectState)
 					if start.p[side].t_selTemp[member].pal == nil or start.p[side].t_selTemp[member].pal == 0 then
 						start.p[side].t_selTemp[member].pal = 1
 					end
+					start.p[side].t_selTemp[member].userPal = start.f_selectUserPal(start.c[player].selRef, start.p[side].t_selTemp[member].pal, cmd)
 					-- if select anim differs from done anim and coop or pX.face.num allows to display more than 1 portrait or it's the last team member
 					local done_anim = motif.select_info['p' .. side .. '_member' .. member .. '_face_done_anim'] or motif.select_info['p' .. side .. '_face_done_anim']
 					if done_anim ~= -1 and start.p[side].t_selTemp[member].anim ~= done_anim and (main.coop or motif.select_info['p' .. side .. '_face_num'] > 1 or main.f_tableLength(start.p[side].t_selected) + 1 == start.p[side].numChars) then
@@ -2664,6 +2710,7 @@ function start.f_selectMenu(side, cmd, player, member, selectState)
 			start.p[side].t_selected[member] = {
 				ref = start.c[player].selRef,
 				pal = start.f_selectPal(start.c[player].selRef, start.p[side].t_selTemp[member].pal),
+				userPal = start.p[side].t_selTemp[member].userPal,
 				pn = start.f_getPlayerNo(side, member),
 				cursor = {start.c[player].selX, start.c[player].selY},
 				ratioLevel = start.f_getRatio(side),
@@ -2787,7 +2834,7 @@ function start.f_selectVersus(active, t_orderSelect)
 	txt_matchNo:update({text = text[1]})
 	main.f_bgReset(motif.versusbgdef.bg)
 	main.f_fadeReset('fadein', motif.vs_screen)
-	main.f_playBGM(false, motif.music.vs_bgm, motif.music.vs_bgm_loop, motif.music.vs_bgm_volume, motif.music.vs_bgm_loopstart, motif.music.vs_bgm_loopend)
+	main.f_playBGM(false, motif.music.vs_bgm, motif.music.vs_bgm_loop, motif.music.vs_bgm_volume, motif.music.vs_bgm_loopstart, motif.music.vs_bgm_loopend, motif.music.vs_bgm_soundfont)
 	start.f_resetTempData(motif.vs_screen, '')
 	start.f_playWave(getStageNo(), 'stage', motif.vs_screen.stage_snd[1], motif.vs_screen.stage_snd[2])
 	local counter = 0 - motif.vs_screen.fadein_time
@@ -2819,7 +2866,7 @@ function start.f_selectVersus(active, t_orderSelect)
 							-- confirm char selection (starts loading immediately if config.BackgroundLoading is true)
 							for _, member in ipairs(t_order[side]) do
 								if not start.p[side].t_selected[member].loading then
-									selectChar(side, start.p[side].t_selected[member].ref, start.p[side].t_selected[member].pal)
+									selectChar(side, start.p[side].t_selected[member].ref, start.p[side].t_selected[member].pal, start.p[side].t_selected[member].userPal)
 									start.p[side].t_selected[member].loading = true
 								end
 							end
@@ -2833,7 +2880,7 @@ function start.f_selectVersus(active, t_orderSelect)
 					elseif motif.vs_screen['p' .. side .. '_member' .. k .. '_key'] ~= nil and main.f_input({side}, main.f_extractKeys(motif.vs_screen['p' .. side .. '_member' .. k .. '_key'])) or (#start.p[side].t_selected == #t_order[side] + 1) then
 						table.insert(t_order[side], k)
 						-- confirm char selection (starts loading immediately if config.BackgroundLoading is true)
-						selectChar(side, v.ref, v.pal)
+						selectChar(side, v.ref, v.pal, v.userPal)
 						v.loading = true
 						-- if it's the last unordered team member
 						if #start.p[side].t_selected == #t_order[side] then
@@ -2970,7 +3017,7 @@ function start.f_selectLoading()
 	for side = 1, 2 do
 		for _, v in ipairs(start.p[side].t_selected) do
 			if not v.loading then
-				selectChar(side, v.ref, v.pal)
+				selectChar(side, v.ref, v.pal, v.userPal)
 				v.loading = true
 			end
 		end
@@ -3130,9 +3177,9 @@ function start.f_resultInit()
 	main.f_bgReset(motif[start.t_result.bgdef].bg)
 	main.f_fadeReset('fadein', t)
 	if start.t_result.winBgm and motif.music.results_bgm ~= '' then
-		main.f_playBGM(false, motif.music.results_bgm, motif.music.results_bgm_loop, motif.music.results_bgm_volume, motif.music.results_bgm_loopstart, motif.music.results_bgm_loopend)
+		main.f_playBGM(false, motif.music.results_bgm, motif.music.results_bgm_loop, motif.music.results_bgm_volume, motif.music.results_bgm_loopstart, motif.music.results_bgm_loopend, motif.music.results_bgm_soundfont)
 	elseif motif.music.results_lose_bgm ~= '' then
-		main.f_playBGM(false, motif.music.results_lose_bgm, motif.music.results_lose_bgm_loop, motif.music.results_lose_bgm_volume, motif.music.results_lose_bgm_loopstart, motif.music.results_lose_bgm_loopend)
+		main.f_playBGM(false, motif.music.results_lose_bgm, motif.music.results_lose_bgm_loop, motif.music.results_lose_bgm_volume, motif.music.results_lose_bgm_loopstart, motif.music.results_lose_bgm_loopend, motif.music.results_lose_bgm_soundfont)
 	end
 	start.t_result.active = true
 	return true
@@ -3319,7 +3366,7 @@ function start.f_victoryInit()
 	main.f_bgReset(motif.victorybgdef.bg)
 	main.f_fadeReset('fadein', motif.victory_screen)
 	if start.t_music.musicvictory[winnerteam()] == nil and motif.music.victory_bgm ~= '' then
-		main.f_playBGM(false, motif.music.victory_bgm, motif.music.victory_bgm_loop, motif.music.victory_bgm_volume, motif.music.victory_bgm_loopstart, motif.music.victory_bgm_loopend)
+		main.f_playBGM(false, motif.music.victory_bgm, motif.music.victory_bgm_loop, motif.music.victory_bgm_volume, motif.music.victory_bgm_loopstart, motif.music.victory_bgm_loopend, motif.music.victory_bgm_soundfont)
 	end
 	start.f_resetTempData(motif.victory_screen, '')
 	start.t_victory.winquote = getCharVictoryQuote(start.t_victory.winnerNo)
@@ -3447,7 +3494,7 @@ function start.f_continueInit()
 		toggleNoSound(true)
 	end
 	if motif.music.continue_bgm ~= '' then
-		main.f_playBGM(false, motif.music.continue_bgm, motif.music.continue_bgm_loop, motif.music.continue_bgm_volume, motif.music.continue_bgm_loopstart, motif.music.continue_bgm_loopend)
+		main.f_playBGM(false, motif.music.continue_bgm, motif.music.continue_bgm_loop, motif.music.continue_bgm_volume, motif.music.continue_bgm_loopstart, motif.music.continue_bgm_loopend, motif.music.continue_bgm_soundfont)
 	end
 	main.f_bgReset(motif.continuebgdef.bg)
 	main.f_fadeReset('fadein', motif.continue_screen)
@@ -3530,7 +3577,7 @@ function start.f_continue()
 				end
 			elseif start.t_continue.counter == motif.continue_screen.counter_end_skiptime then
 				if motif.music.continue_end_bgm ~= '' then
-					main.f_playBGM(false, motif.music.continue_end_bgm, motif.music.continue_end_bgm_loop, motif.music.continue_end_bgm_volume, motif.music.continue_end_bgm_loopstart, motif.music.continue_end_bgm_loopend)
+					main.f_playBGM(false, motif.music.continue_end_bgm, motif.music.continue_end_bgm_loop, motif.music.continue_end_bgm_volume, motif.music.continue_end_bgm_loopstart, motif.music.continue_end_bgm_loopend, motif.music.continue_end_bgm_soundfont)
 				end
 				sndPlay(motif.files.snd_data, motif.continue_screen.counter_end_snd[1], motif.continue_screen.counter_end_snd[2])
 				for i = 1, 2 do
@@ -3712,7 +3759,7 @@ function start.f_hiscoreInit(gameMode, playMusic, input)
 	main.f_cmdBufReset()
 	clearColor(motif.hiscorebgdef.bgclearcolor[1], motif.hiscorebgdef.bgclearcolor[2], motif.hiscorebgdef.bgclearcolor[3])
 	if playMusic and motif.music.hiscore_bgm ~= '' then
-		main.f_playBGM(false, motif.music.hiscore_bgm, motif.music.hiscore_bgm_loop, motif.music.hiscore_bgm_volume, motif.music.hiscore_bgm_loopstart, motif.music.hiscore_bgm_loopend)
+		main.f_playBGM(false, motif.music.hiscore_bgm, motif.music.hiscore_bgm_loop, motif.music.hiscore_bgm_volume, motif.music.hiscore_bgm_loopstart, motif.music.hiscore_bgm_loopend, motif.music.hiscore_bgm_soundfont)
 	end
 	main.f_bgReset(motif.hiscorebgdef.bg)
 	main.f_fadeReset('fadein', motif.hiscore_info)
@@ -4027,19 +4074,32 @@ function start.f_stageMusic()
 			end
 			-- final round music assigned
 			if roundNo > 1 and roundtype() == 3 and start.t_music.musicfinal.bgmusic ~= nil then
-				main.f_playBGM(false, start.t_music.musicfinal.bgmusic, 1, start.t_music.musicfinal.bgmvolume, start.t_music.musicfinal.bgmloopstart, start.t_music.musicfinal.bgmloopend)
+				main.f_playBGM(false, start.t_music.musicfinal.bgmusic, 1, start.t_music.musicfinal.bgmvolume, start.t_music.musicfinal.bgmloopstart, start.t_music.musicfinal.bgmloopend, start.t_music.musicfinal.bgmsoundfont)
+				start.f_setBGMMidi(start.t_music.musicfinal)
+			-- stage playlist, kept playing from one round to the next
+			elseif start.t_music.bgmplaylist ~= nil then
+				main.f_playBGMList(matchno() == 1 and start.bgmround == 1, start.t_music.bgmplaylist, tostring(start.t_music.bgmplaylist_mode):lower() == 'random', nil, start.t_music.music[1] ~= nil and start.t_music.music[1].bgmsoundfont or nil)
+				start.f_setBGMMidi(start.t_music.music[1])
 			-- music exists for this round
 			elseif start.t_music.music[roundNo] ~= nil then
 				-- interrupt same track playing only on round 1 of first match (skips continuous survival etc.)
-				main.f_playBGM(matchno() == 1 and roundNo == 1, start.t_music.music[roundNo].bgmusic, 1, start.t_music.music[roundNo].bgmvolume, start.t_music.music[roundNo].bgmloopstart, start.t_music.music[roundNo].bgmloopend)
+				main.f_playBGM(matchno() == 1 and roundNo == 1, start.t_music.music[roundNo].bgmusic, 1, start.t_music.music[roundNo].bgmvolume, start.t_music.music[roundNo].bgmloopstart, start.t_music.music[roundNo].bgmloopend, start.t_music.music[roundNo].bgmsoundfont)
+				start.f_setBGMMidi(start.t_music.music[roundNo])
 			-- stop versus screen track or life bgm even if stage music is not assigned
 			elseif start.bgmround == 1 or start.bgmstate == 1 then
 				main.f_playBGM(true)
 			end
+			-- bgmlayer.life is faded out, bgmlayer.final faded in on the final round
+			if start.t_music.bgmlayer_life ~= nil then
+				stopBGMLayer(start.t_music.bgmlayer_life)
+			end
+			if start.t_music.bgmlayer_final ~= nil and start.bgmround > 1 and roundtype() == 3 then
+				playBGMLayer(start.t_music.bgmlayer_final)
+			end
 		end
 		start.bgmstate = 0
-	-- bgmusic.life
-	elseif start.t_music.musiclife.bgmusic ~= nil and start.bgmstate == 0 and roundstate() == 2 then
+	-- bgmusic.life / bgmlayer.life
+	elseif (start.t_music.musiclife.bgmusic ~= nil or start.t_music.bgmlayer_life ~= nil) and start.bgmstate == 0 and roundstate() == 2 then
 		for i = 1, 2 do
 			player(i) --assign sys.debugWC to player i
 			-- continue only if p1/p2 life meets life ratio criteria
@@ -4055,7 +4115,12 @@ function start.f_stageMusic()
 				end
 				if ok then
 					if start.t_music.bgmtrigger_life == 1 or roundtype() >= 2 then
-						main.f_playBGM(true, start.t_music.musiclife.bgmusic, 1, start.t_music.musiclife.bgmvolume, start.t_music.musiclife.bgmloopstart, start.t_music.musiclife.bgmloopend)
+						if start.t_music.musiclife.bgmusic ~= nil then
+							main.f_playBGM(true, start.t_music.musiclife.bgmusic, 1, start.t_music.musiclife.bgmvolume, start.t_music.musiclife.bgmloopstart, start.t_music.musiclife.bgmloopend, start.t_music.musiclife.bgmsoundfont)
+							start.f_setBGMMidi(start.t_music.musiclife)
+						else
+							playBGMLayer(start.t_music.bgmlayer_life)
+						end
 						start.bgmstate = 1
 						break
 					end
@@ -4066,7 +4131,8 @@ function start.f_stageMusic()
 	elseif #start.t_music.musicvictory > 0 and start.bgmstate ~= -1 and roundstate() == 3 then
 		for i = 1, 2 do
 			if start.t_music.musicvictory[i] ~= nil and player(i) and win() and (roundtype() == 1 or roundtype() == 3) then --assign sys.debugWC to player i
-				main.f_playBGM(true, start.t_music.musicvictory[i].bgmusic, 1, start.t_music.musicvictory[i].bgmvolume, start.t_music.musicvictory[i].bgmloopstart, start.t_music.musicvictory[i].bgmloopend)
+				main.f_playBGM(true, start.t_music.musicvictory[i].bgmusic, 1, start.t_music.musicvictory[i].bgmvolume, start.t_music.musicvictory[i].bgmloopstart, start.t_music.musicvictory[i].bgmloopend, start.t_music.musicvictory[i].bgmsoundfont)
+				start.f_setBGMMidi(start.t_music.musicvictory[i])
 				start.bgmstate = -1
 				break
 			end
@@ -657,6 +657,16 @@ func (a *Animation) drawSub1(angle, facing float32) (h, v, agl float32) {
 	agl += a.angle * facing
 	return
 }
+
+// Returns the tiling in texels of the current sprite, whose spacing is in
+// sprite units.
+func (a *Animation) texelTile() Tiling {
+	t := a.tile
+	if ts := a.spr.texelScale(); ts != 1 {
+		t.sx, t.sy = int32(float32(t.sx)/ts), int32(float32(t.sy)/ts)
+	}
+	return t
+}
 func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 	rxadd float32, rot Rotation, rcx float32, pfx *PalFX, old bool, facing float32, isReflection bool, posLocalscl float32, projectionMode int32, fLength float32) {
 	if a.spr == nil || a.spr.Tex == nil {
@@ -671,6 +681,8 @@ func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 	ys *= ycs * v
 	x = xcs*x + xs*posLocalscl*(float32(a.frames[a.drawidx].X)+a.interpolate_offset_x)*a.start_scale[0]*(1/a.scale_x)
 	y = ycs*y + ys*posLocalscl*(float32(a.frames[a.drawidx].Y)+a.interpolate_offset_y)*a.start_scale[1]*(1/a.scale_y)
+	// Frame offsets are in sprite units, sprite dimensions in texels
+	ts, tile := a.spr.texelScale(), a.texelTile()
 	var rcy float32
 	if rot.IsZero() {
 		if xs < 0 {
@@ -688,7 +700,7 @@ func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 		if a.tile.x == 1 {
 			tmp := xs * float32(a.tile.sx)
 			if a.tile.sx <= 0 {
-				tmp += xs * float32(a.spr.Size[0])
+				tmp += xs * float32(a.spr.Size[0]) * ts
 			}
 			if tmp != 0 {
 				x -= float32(int(x/tmp)) * tmp
@@ -697,18 +709,18 @@ func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 		if a.tile.y == 1 {
 			tmp := ys * float32(a.tile.sy)
 			if a.tile.sy <= 0 {
-				tmp += ys * float32(a.spr.Size[1])
+				tmp += ys * float32(a.spr.Size[1]) * ts
 			}
 			if tmp != 0 {
 				y -= float32(int(y/tmp)) * tmp
 			}
 		}
 		rcx, rcy = rcx*sys.widthScale, 0
-		x = -x + AbsF(xs)*float32(a.spr.Offset[0])
-		y = -y + AbsF(ys)*float32(a.spr.Offset[1])
+		x = -x + AbsF(xs)*float32(a.spr.Offset[0])*ts
+		y = -y + AbsF(ys)*float32(a.spr.Offset[1])*ts
 	} else {
 		rcx, rcy = (x+rcx)*sys.widthScale, y*sys.heightScale
-		x, y = AbsF(xs)*float32(a.spr.Offset[0]), AbsF(ys)*float32(a.spr.Offset[1])
+		x, y = AbsF(xs)*float32(a.spr.Offset[0])*ts, AbsF(ys)*float32(a.spr.Offset[1])*ts
 		fLength *= ycs
 	}
 	trans := a.alpha()
@@ -719,8 +731,8 @@ func (a *Animation) Draw(window *[4]int32, x, y, xcs, ycs, xs, xbs, ys,
 	rp := RenderParams{
 		a.spr.Tex, paltex, a.spr.Size,
 		x * sys.widthScale,
-		y * sys.heightScale, a.tile, xs * sys.widthScale, xcs * xbs * h * sys.widthScale,
-		ys * sys.heightScale, 1, xcs * rxadd * sys.widthScale / sys.heightScale, rot,
+		y * sys.heightScale, tile, xs * ts * sys.widthScale, xcs * xbs * h * ts * sys.widthScale,
+		ys * ts * sys.heightScale, 1, xcs * rxadd * sys.widthScale / sys.heightScale, rot,
 		0, trans, int32(a.mask), pfx, window, rcx, rcy, projectionMode, fLength * sys.heightScale,
 		xs * posLocalscl * (float32(a.frames[a.drawidx].X) + a.interpolate_offset_x) * a.start_scale[0] * (1 / a.scale_x) * sys.widthScale,
 		ys * posLocalscl * (float32(a.frames[a.drawidx].Y) + a.interpolate_offset_y) * a.start_scale[1] * (1 / a.scale_y) * sys.heightScale,
@@ -737,12 +749,13 @@ func (a *Animation) ShadowDraw(window *[4]int32, x, y, xscl, yscl, vscl, rxadd f
 	x += xscl * posLocalscl * h * (float32(a.frames[a.drawidx].X) + a.interpolate_offset_x) * (1 / a.scale_x)
 	y += yscl * posLocalscl * vscl * v * (float32(a.frames[a.drawidx].Y) + a.interpolate_offset_y) * (1 / a.scale_x)
 
+	ts := a.spr.texelScale()
 	rp := RenderParams{
 		a.spr.Tex, nil, a.spr.Size,
-		AbsF(xscl*h) * float32(a.spr.Offset[0]) * sys.widthScale,
-		AbsF(yscl*v) * float32(a.spr.Offset[1]) * sys.heightScale, a.tile,
-		xscl * h * sys.widthScale, xscl * h * sys.widthScale,
-		yscl * v * sys.heightScale, vscl, rxadd, rot, color | 0xff000000, 0, int32(a.mask), nil, window,
+		AbsF(xscl*h) * float32(a.spr.Offset[0]) * ts * sys.widthScale,
+		AbsF(yscl*v) * float32(a.spr.Offset[1]) * ts * sys.heightScale, a.texelTile(),
+		xscl * h * ts * sys.widthScale, xscl * h * ts * sys.widthScale,
+		yscl * v * ts * sys.heightScale, vscl, rxadd, rot, color | 0xff000000, 0, int32(a.mask), nil, window,
 		(x + float32(sys.gameWidth)/2) * sys.widthScale, y * sys.heightScale,
 		projectionMode, fLength,
 		xscl * posLocalscl * h * (float32(a.frames[a.drawidx].X) + a.interpolate_offset_x) * (1 / a.scale_x),
@@ -879,6 +892,8 @@ func (dl *DrawList) add(sd *SprData, sc, salp int32, so, fo float32) {
 	}
 }
 func (dl DrawList) draw(x, y, scl float32) {
+	sprBatch.begin()
+	defer sprBatch.end()
 	for _, s := range dl {
 		s.anim.srcAlpha, s.anim.dstAlpha = int16(s.alpha[0]), int16(s.alpha[1])
 		ob := sys.brightness
@@ -946,6 +961,8 @@ func (sl *ShadowList) add(ss *ShadowSprite) {
 	(*sl)[i] = ss
 }
 func (sl ShadowList) draw(x, y, scl float32) {
+	sprBatch.begin()
+	defer sprBatch.end()
 	for _, s := range sl {
 		intensity := sys.stage.sdw.intensity
 		color, alpha := s.shadowColor, s.shadowAlpha
@@ -975,7 +992,7 @@ func (sl ShadowList) draw(x, y, scl float32) {
 		if sys.stage.sdw.yscale > 0 {
 			xshear = -xshear
 		}
-		xshearoff := -sys.stage.sdw.xshear * (float32(s.anim.spr.Size[1])*sys.stage.localscl - s.pos[1])
+		xshearoff := -sys.stage.sdw.xshear * (float32(s.anim.spr.Size[1])*s.anim.spr.texelScale()*sys.stage.localscl - s.pos[1])
 		if s.window[0] != 0 || s.window[1] != 0 || s.window[2] != 0 || s.window[3] != 0 {
 			w := s.window
 			w[1], w[3] = -w[1], -w[3]
@@ -0,0 +1,127 @@
+package main
+
+// Sprite atlases pack the textures of an SFF's sprites into a few large
+// pages, so that consecutive sprites of a character or stage can be drawn
+// with a single call (see spriteBatch in render.go). 8-bit and true color
+// sprites use separate pages, since their texture formats differ. A sprite
+// in an atlas gets a texture that shares its page's handle and only knows
+// its rectangle in it, so the rest of the engine is unaware of atlases.
+
+const AtlasPageSize = 2048
+
+type SpriteAtlas struct {
+	pages [2][]*atlasPage
+}
+
+type atlasPage struct {
+	tex     *Texture
+	shelves []atlasShelf
+	top     int32
+}
+
+type atlasShelf struct {
+	x, y, height int32
+}
+
+func newSpriteAtlas() *SpriteAtlas {
+	return &SpriteAtlas{}
+}
+
+// Finds room for a w by h rectangle, on the lowest shelf it fits in or on
+// a new shelf.
+func (p *atlasPage) alloc(w, h int32) (x, y int32, ok bool) {
+	best := -1
+	for i, sh := range p.shelves {
+		if h <= sh.height && sh.x+w <= AtlasPageSize &&
+			(best < 0 || sh.height < p.shelves[best].height) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		sh := &p.shelves[best]
+		x, y = sh.x, sh.y
+		sh.x += w
+		return x, y, true
+	}
+	if p.top+h > AtlasPageSize || w > AtlasPageSize {
+		return 0, 0, false
+	}
+	p.shelves = append(p.shelves, atlasShelf{w, p.top, h})
+	x, y = 0, p.top
+	p.top += h
+	return x, y, true
+}
+
+// Packs a sprite's pixels into a page and returns the texture of its
+// region, or nil if the sprite is too large to share a page. Sprites get a
+// one pixel border repeating their edges, which keeps filtering identical
+// to a texture of their own. Must be called from the main thread.
+func (sa *SpriteAtlas) add(width, height, depth int32, data []byte) *Texture {
+	if width <= 0 || height <= 0 || width+2 > AtlasPageSize/2 || height+2 > AtlasPageSize/2 ||
+		int64(len(data)) < int64(width)*int64(height)*int64(depth/8) {
+		return nil
+	}
+	kind, pdepth := 0, int32(8)
+	if depth > 8 {
+		kind, pdepth = 1, 32
+	}
+	var page *atlasPage
+	var x, y int32
+	for _, p := range sa.pages[kind] {
+		var ok bool
+		if x, y, ok = p.alloc(width+2, height+2); ok {
+			page = p
+			break
+		}
+	}
+	if page == nil {
+		page = &atlasPage{tex: newTexture(AtlasPageSize, AtlasPageSize, pdepth,
+			depth > 8 && sys.pngFilter)}
+		page.tex.SetData(make([]byte, AtlasPageSize*AtlasPageSize*pdepth/8))
+		sa.pages[kind] = append(sa.pages[kind], page)
+		x, y, _ = page.alloc(width+2, height+2)
+	}
+	page.tex.SetSubData(x, y, width+2, height+2, atlasBorder(width, height, depth, pdepth, data))
+	t := *page.tex
+	t.width, t.height, t.page = width, height, page.tex
+	s := float32(AtlasPageSize)
+	t.uv = [...]float32{float32(x+1) / s, float32(y+1) / s,
+		float32(x+1+width) / s, float32(y+1+height) / s}
+	return &t
+}
+
+// Adds the border around a sprite's pixels, converting them to the page's
+// color depth.
+func atlasBorder(width, height, depth, pdepth int32, data []byte) []byte {
+	sb, db := depth/8, pdepth/8
+	pw, ph := width+2, height+2
+	out := make([]byte, pw*ph*db)
+	for y := int32(0); y < ph; y++ {
+		sy := Clamp(y-1, 0, height-1)
+		for x := int32(0); x < pw; x++ {
+			sx := Clamp(x-1, 0, width-1)
+			dst := out[(y*pw+x)*db:]
+			copy(dst[:db], data[(sy*width+sx)*sb:][:sb])
+			if sb == 3 {
+				dst[3] = 255
+			}
+		}
+	}
+	return out
+}
+
+// Returns the rectangle of the texture's texels in uv coordinates.
+func (t *Texture) uvRect() [4]float32 {
+	if t.page == nil {
+		return [...]float32{0, 0, 1, 1}
+	}
+	return t.uv
+}
+
+// Returns the texture that is actually bound when drawing t.
+func (t *Texture) atlasPage() *Texture {
+	if t.page != nil {
+		return t.page
+	}
+	return t
+}
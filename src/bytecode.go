@@ -381,6 +381,7 @@ const (
 	OC_st_fvaradd
 	OC_st_sysfvaradd
 	OC_st_map
+	OC_st_namedvar
 )
 const (
 	OC_ex_p2dist_x OpCode = iota
@@ -526,6 +527,9 @@ const (
 	OC_ex_envshakevar_time
 	OC_ex_envshakevar_freq
 	OC_ex_envshakevar_ampl
+	OC_ex_namedvar
+	OC_ex_soundlevel
+	OC_ex_soundpeak
 )
 const (
 	NumVar     = 60
@@ -545,6 +549,14 @@ func NewStringPool() *StringPool {
 func (sp *StringPool) Clear() {
 	sp.List, sp.Map = nil, make(map[string]int)
 }
+
+// Replaces the strings with a copy of those of base, keeping their indices.
+func (sp *StringPool) Reset(base *StringPool) {
+	sp.List, sp.Map = append([]string(nil), base.List...), make(map[string]int, len(base.Map))
+	for s, i := range base.Map {
+		sp.Map[s] = i
+	}
+}
 func (sp *StringPool) Add(s string) int {
 	i, ok := sp.Map[s]
 	if !ok {
@@ -704,6 +716,9 @@ func (be *BytecodeExp) appendI32Op(op OpCode, addr int32) {
 	be.append(op)
 	be.append((*(*[4]OpCode)(unsafe.Pointer(&addr)))[:]...)
 }
+func (be *BytecodeExp) appendI32(v int32) {
+	be.append((*(*[4]OpCode)(unsafe.Pointer(&v)))[:]...)
+}
 func (be *BytecodeExp) appendI64Op(op OpCode, addr int64) {
 	be.append(op)
 	be.append((*(*[8]OpCode)(unsafe.Pointer(&addr)))[:]...)
@@ -928,6 +943,10 @@ func (BytecodeExp) round(v1 *BytecodeValue, v2 BytecodeValue) {
 	v1.SetF(float32(math.Floor((v1.v*shift)+0.5) / shift))
 }
 func (be BytecodeExp) run(c *Char) BytecodeValue {
+	if sys.profiler.exprActive() {
+		sys.profiler.enter("expr", PK_Expression)
+		defer sys.profiler.leave()
+	}
 	oc := c
 	for i := 1; i <= len(be); i++ {
 		switch be[i-1] {
@@ -1439,8 +1458,24 @@ func (be BytecodeExp) run_st(c *Char, i *int) {
 		v := sys.bcStack.Pop().ToF()
 		sys.bcStack.Push(c.mapSet(sys.stringPool[sys.workingState.playerNo].List[*(*int32)(unsafe.Pointer(&be[*i]))], v, 0))
 		*i += 4
+	case OC_st_namedvar:
+		v := sys.bcStack.Pop()
+		*sys.bcStack.Top() = c.namedVarSet(be.namedVarSlot(i, sys.bcStack.Top().ToI()), v)
 	}
 }
+
+// Reads the base slot, element count and stride operands of a named variable
+// and returns the slot of the given element, or -1 if out of range.
+func (be BytecodeExp) namedVarSlot(i *int, idx int32) int32 {
+	base := *(*int32)(unsafe.Pointer(&be[*i]))
+	count := *(*int32)(unsafe.Pointer(&be[*i+4]))
+	stride := *(*int32)(unsafe.Pointer(&be[*i+8]))
+	*i += 12
+	if idx < 0 || idx >= count {
+		return -1
+	}
+	return base + idx*stride
+}
 func (be BytecodeExp) run_const(c *Char, i *int, oc *Char) {
 	(*i)++
 	switch be[*i-1] {
@@ -2026,6 +2061,8 @@ func (be BytecodeExp) run_ex(c *Char, i *int, oc *Char) {
 	case OC_ex_maparray:
 		sys.bcStack.PushF(c.mapArray[sys.stringPool[sys.workingState.playerNo].List[*(*int32)(unsafe.Pointer(&be[*i]))]])
 		*i += 4
+	case OC_ex_namedvar:
+		*sys.bcStack.Top() = c.namedVarGet(be.namedVarSlot(i, sys.bcStack.Top().ToI()))
 	case OC_ex_max:
 		v2 := sys.bcStack.Pop()
 		be.max(sys.bcStack.Top(), v2)
@@ -2065,6 +2102,10 @@ func (be BytecodeExp) run_ex(c *Char, i *int, oc *Char) {
 		sys.bcStack.PushF(c.scoreTotal())
 	case OC_ex_selfstatenoexist:
 		*sys.bcStack.Top() = c.selfStatenoExist(*sys.bcStack.Top())
+	case OC_ex_soundlevel:
+		*sys.bcStack.Top() = c.soundLevel(*sys.bcStack.Top(), false)
+	case OC_ex_soundpeak:
+		*sys.bcStack.Top() = c.soundLevel(*sys.bcStack.Top(), true)
 	case OC_ex_sprpriority:
 		sys.bcStack.PushI(c.sprPriority)
 	case OC_ex_stagebackedgedist:
@@ -2167,7 +2208,7 @@ func (bf bytecodeFunction) run(c *Char, ret []uint8) (changeState bool) {
 				continue
 			}
 		}
-		if sc.Run(c, nil) {
+		if sys.profiler.runController(sc, c, nil) {
 			changeState = true
 			break
 		}
@@ -2275,7 +2316,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 							continue
 						}
 					}
-					if sc.Run(c, ps) {
+					if sys.profiler.runController(sc, c, ps) {
 						if sys.loopBreak {
 							sys.loopBreak = false
 							interrupt = true
@@ -2328,7 +2369,7 @@ func (b StateBlock) Run(c *Char, ps []int32) (changeState bool) {
 					continue
 				}
 			}
-			if sc.Run(c, ps) {
+			if sys.profiler.runController(sc, c, ps) {
 				return true
 			}
 		}
@@ -2613,6 +2654,12 @@ const (
 	playSnd_loop
 	playSnd_redirectid
 	playSnd_priority
+	playSnd_category
+	playSnd_lowpass
+	playSnd_highpass
+	playSnd_reverb
+	playSnd_pitch
+	playSnd_echo
 )
 
 func (sc playSnd) Run(c *Char, _ []int32) bool {
@@ -2621,10 +2668,11 @@ func (sc playSnd) Run(c *Char, _ []int32) bool {
 	}
 	crun := c
 	f, lw, lp := "", false, false
-	var g, n, ch, vo, pri int32 = -1, 0, -1, 100, 0
+	var g, n, ch, vo, pri, cat int32 = -1, 0, -1, 100, 0, -1
 	var p, fr float32 = 0, 1
 	x := &c.pos[0]
 	ls := c.localscl
+	dsp, setDSP := newSoundDSP(), false
 	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
 		switch id {
 		case playSnd_value:
@@ -2653,6 +2701,11 @@ func (sc playSnd) Run(c *Char, _ []int32) bool {
 			lp = exp[0].evalB(c)
 		case playSnd_priority:
 			pri = exp[0].evalI(c)
+		case playSnd_category:
+			cat = exp[0].evalI(c)
+		case playSnd_lowpass, playSnd_highpass, playSnd_reverb, playSnd_pitch, playSnd_echo:
+			dsp.read(id-playSnd_lowpass+sndEffect_lowpass, exp, c)
+			setDSP = true
 		case playSnd_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -2664,7 +2717,9 @@ func (sc playSnd) Run(c *Char, _ []int32) bool {
 		}
 		return true
 	})
-	crun.playSound(f, lw, lp, g, n, ch, vo, p, fr, ls, x, true, pri)
+	if sch := crun.playSound(f, lw, lp, g, n, ch, vo, p, fr, ls, x, true, pri, cat); sch != nil && setDSP {
+		sch.SetDSP(dsp)
+	}
 	return false
 }
 
@@ -5837,7 +5892,7 @@ func (sc superPause) Run(c *Char, _ []int32) bool {
 			vo := int32(100)
 			ffx := string(*(*[]byte)(unsafe.Pointer(&exp[0])))
 			crun.playSound(ffx, false, false, exp[1].evalI(c), n, -1,
-				vo, 0, 1, 1, nil, false, 0)
+				vo, 0, 1, 1, nil, false, 0, -1)
 		case superPause_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -6602,6 +6657,71 @@ func (sc sndPan) Run(c *Char, _ []int32) bool {
 	return false
 }
 
+type sndEffect StateControllerBase
+
+const (
+	sndEffect_channel byte = iota
+	sndEffect_lowpass
+	sndEffect_highpass
+	sndEffect_reverb
+	sndEffect_pitch
+	sndEffect_echo
+	sndEffect_redirectid
+)
+
+// Reads a sound effect parameter shared by PlaySnd and SndEffect.
+func (dsp *SoundDSP) read(id byte, exp []BytecodeExp, c *Char) {
+	switch id {
+	case sndEffect_lowpass:
+		dsp.lowpass = MaxF(0, exp[0].evalF(c))
+	case sndEffect_highpass:
+		dsp.highpass = MaxF(0, exp[0].evalF(c))
+	case sndEffect_reverb:
+		dsp.reverb = ClampF(exp[0].evalF(c), 0, 1)
+	case sndEffect_pitch:
+		dsp.pitch = ClampF(exp[0].evalF(c), 0.25, 4)
+	case sndEffect_echo:
+		dsp.echoDelay = ClampF(exp[0].evalF(c), 0, 2000)
+		dsp.echoFeedback, dsp.echoMix = 0.5, 0.5
+		if len(exp) > 1 {
+			dsp.echoFeedback = ClampF(exp[1].evalF(c), 0, 0.95)
+		}
+		if len(exp) > 2 {
+			dsp.echoMix = ClampF(exp[2].evalF(c), 0, 1)
+		}
+	}
+}
+
+// Changes the effects of a playing sound. Only the parameters that are set
+// are changed.
+func (sc sndEffect) Run(c *Char, _ []int32) bool {
+	crun := c
+	var ch *SoundChannel
+	var dsp SoundDSP
+	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
+		switch id {
+		case sndEffect_redirectid:
+			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
+				crun = rid
+			} else {
+				return false
+			}
+		case sndEffect_channel:
+			if ch = crun.soundChannels.Get(exp[0].evalI(c)); ch == nil {
+				return false
+			}
+			dsp = ch.sfx.dsp
+		default:
+			dsp.read(id, exp, c)
+		}
+		return true
+	})
+	if ch != nil {
+		ch.SetDSP(dsp)
+	}
+	return false
+}
+
 type varRandom StateControllerBase
 
 const (
@@ -7962,13 +8082,14 @@ const (
 	playBgm_loopstart
 	playBgm_loopend
 	playBgm_startposition
+	playBgm_soundfont
 	playBgm_redirectid
 )
 
 func (sc playBgm) Run(c *Char, _ []int32) bool {
 	crun := c
 	var b bool
-	var bgm string
+	var bgm, soundfont string
 	var loop, volume, loopstart, loopend, startposition int = 1, 100, 0, 0, 0
 	StateControllerBase(sc).run(c, func(id byte, exp []BytecodeExp) bool {
 		switch id {
@@ -7991,6 +8112,10 @@ func (sc playBgm) Run(c *Char, _ []int32) bool {
 			loopend = int(exp[0].evalI(c))
 		case playBgm_startposition:
 			startposition = int(exp[0].evalI(c))
+		case playBgm_soundfont:
+			if soundfont = string(*(*[]byte)(unsafe.Pointer(&exp[0]))); soundfont != "" {
+				soundfont = SearchFile(soundfont, []string{crun.gi().def, "", "sound/"})
+			}
 		case playBgm_redirectid:
 			if rid := sys.playerID(exp[0].evalI(c)); rid != nil {
 				crun = rid
@@ -8001,7 +8126,7 @@ func (sc playBgm) Run(c *Char, _ []int32) bool {
 		return true
 	})
 	if b {
-		sys.bgm.Open(bgm, loop, volume, loopstart, loopend, startposition)
+		sys.bgm.Open(bgm, loop, volume, loopstart, loopend, startposition, sys.bgmCrossfade, soundfont)
 		sys.playBgmFlg = true
 	}
 	return false
@@ -8513,6 +8638,7 @@ type StateBytecode struct {
 	prevMoveType MoveType
 	physics      StateType
 	playerNo     int
+	stateNo      int32
 	stateDef     stateDef
 	block        StateBlock
 	ctrlsps      []int32
@@ -8546,6 +8672,10 @@ func (sb *StateBytecode) init(c *Char) {
 	sb.stateDef.Run(c)
 }
 func (sb *StateBytecode) run(c *Char) (changeState bool) {
+	if sys.profiler.enabled {
+		sys.profiler.enterState(sb, c)
+		defer sys.profiler.leaveState()
+	}
 	sys.bcVar = sys.bcVarStack.Alloc(int(sb.numVars))
 	sys.workingState = sb
 	changeState = sb.block.Run(c, sb.ctrlsps)
@@ -1651,6 +1651,7 @@ type CharGlobalInfo struct {
 	quotes           [MaxQuotes]string
 	portraitscale    float32
 	constants        map[string]float32
+	namedVars        *NamedVarLayout
 	remapPreset      map[string]RemapPreset
 	remappedpal      [2]int32
 	localcoord       [2]float32
@@ -1658,6 +1659,35 @@ type CharGlobalInfo struct {
 	fnt              [10]*Fnt
 }
 
+// Reads the character's air file and the common air files into the
+// animation table.
+func (cgi *CharGlobalInfo) loadAnimations(def, anim string) error {
+	str := ""
+	if len(anim) > 0 {
+		// A missing air file isn't an error, the character just has no
+		// animations of its own
+		LoadFile(&anim, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
+			var err error
+			str, err = LoadText(filename)
+			return err
+		})
+	}
+	for _, s := range sys.commonAir {
+		if err := LoadFile(&s, []string{def, sys.motifDir, sys.lifebar.def, "", "data/"}, func(filename string) error {
+			txt, err := LoadText(filename)
+			if err != nil {
+				return err
+			}
+			str += "\n" + txt
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	lines, i := SplitAndTrim(str, "\n"), 0
+	cgi.anim = ReadAnimationTable(cgi.sff, &cgi.palettedata.palList, lines, &i)
+	return nil
+}
 func (cgi *CharGlobalInfo) clearPCTime() {
 	cgi.pctype = PC_Hit
 	cgi.pctime = -1
@@ -1798,6 +1828,7 @@ type Char struct {
 	vel             [3]float32
 	facing          float32
 	ivar            [NumVar + NumSysVar]int32
+	nvar            []BytecodeValue
 	fvar            [NumFvar + NumSysFvar]float32
 	CharSystemVar
 	aimg                  AfterImage
@@ -1861,6 +1892,7 @@ func (c *Char) init(n int, idx int32) {
 	c.clear1()
 	c.playerNo, c.helperIndex = n, idx
 	c.animPN = c.playerNo
+	c.nvar = nil
 	if c.helperIndex == 0 {
 		c.player = true
 		c.kovelocity = true
@@ -2445,33 +2477,9 @@ func (c *Char) load(def string) error {
 	for key, value := range gi.sff.palList.numcols {
 		gi.palettedata.palList.numcols[key] = value
 	}
-	str = ""
-	if len(anim) > 0 {
-		if LoadFile(&anim, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
-			var err error
-			str, err = LoadText(filename)
-			if err != nil {
-				return err
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
-	}
-	for _, s := range sys.commonAir {
-		if err := LoadFile(&s, []string{def, sys.motifDir, sys.lifebar.def, "", "data/"}, func(filename string) error {
-			txt, err := LoadText(filename)
-			if err != nil {
-				return err
-			}
-			str += "\n" + txt
-			return nil
-		}); err != nil {
-			return err
-		}
+	if err := gi.loadAnimations(def, anim); err != nil {
+		return err
 	}
-	lines, i = SplitAndTrim(str, "\n"), 0
-	gi.anim = ReadAnimationTable(gi.sff, &gi.palettedata.palList, lines, &i)
 	if len(sound) > 0 {
 		if LoadFile(&sound, []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
 			var err error
@@ -2548,9 +2556,13 @@ func (c *Char) loadPalette() {
 			delete(gi.palettedata.palList.PalTable, [...]int16{1, 1})
 		}
 	} else {
+		// Undo palettes changed by a user palette or the palette editor
+		copy(gi.palettedata.palList.palettes, gi.sff.palList.palettes)
+		copy(gi.palettedata.palList.PalTex, gi.sff.palList.PalTex)
 		for i := 0; i < MaxPalNo; i++ {
-			_, gi.palExist[i] =
-				gi.palettedata.palList.PalTable[[...]int16{1, int16(i + 1)}]
+			// loadSff marks slots taken by palettes of other groups with -1
+			idx, ok := gi.palettedata.palList.PalTable[[...]int16{1, int16(i + 1)}]
+			gi.palExist[i] = ok && idx >= 0
 		}
 	}
 	for i := range gi.palSelectable {
@@ -2621,6 +2633,14 @@ func (c *Char) loadPalette() {
 		}
 	}
 	gi.remappedpal = [...]int32{1, gi.palno}
+	// A user palette chosen in the select screen replaces the drawn one
+	if name := c.ocd().userPal; name != "" {
+		if pal, err := loadUserPalette(gi.def, name); err != nil {
+			sys.errLog.Printf("Failed to load user palette %v of %v: %v\n", name, gi.def, err)
+		} else {
+			setSlotPalette(gi, gi.drawpalno, pal)
+		}
+	}
 }
 func (c *Char) clearHitCount() {
 	c.hitCount, c.uniqHitCount = 0, 0
@@ -3259,6 +3279,24 @@ func (c *Char) selfStatenoExist(stateno BytecodeValue) BytecodeValue {
 	_, ok := c.gi().states[stateno.ToI()]
 	return BytecodeBool(ok)
 }
+
+// Level of the sound playing on the given channel, shared with the parent or
+// root as with PlaySnd's channel inheritance.
+func (c *Char) soundLevel(ch BytecodeValue, peak bool) BytecodeValue {
+	if ch.IsSF() {
+		return BytecodeSF()
+	}
+	crun := c
+	if c.inheritChannels == 1 && c.parent() != nil {
+		crun = c.parent()
+	} else if c.inheritChannels == 2 && c.root() != nil {
+		crun = c.root()
+	}
+	if sch := crun.soundChannels.Get(ch.ToI()); sch != nil {
+		return BytecodeFloat(sch.Level(peak))
+	}
+	return BytecodeFloat(0)
+}
 func (c *Char) stageFrontEdgeDist() float32 {
 	side := float32(0)
 	if c.facing < 0 {
@@ -3329,9 +3367,9 @@ func (c *Char) winType(wt WinType) bool {
 	return c.win() && sys.winTrigger[c.playerNo&1] == wt
 }
 func (c *Char) playSound(ffx string, lowpriority, loop bool, g, n, chNo, vol int32,
-	p, freqmul, ls float32, x *float32, log bool, priority int32) {
+	p, freqmul, ls float32, x *float32, log bool, priority, category int32) *SoundChannel {
 	if g < 0 {
-		return
+		return nil
 	}
 	var s *Sound
 	if ffx == "" || ffx == "s" {
@@ -3359,7 +3397,7 @@ func (c *Char) playSound(ffx string, lowpriority, loop bool, g, n, chNo, vol int
 				str += fmt.Sprintf("P%v:", c.playerNo+1)
 			}
 			sys.errLog.Printf("%v%v,%v\n", str, g, n)
-			return
+			return nil
 		}
 	}
 	crun := c
@@ -3368,8 +3406,21 @@ func (c *Char) playSound(ffx string, lowpriority, loop bool, g, n, chNo, vol int
 	} else if c.inheritChannels == 2 && c.root() != nil {
 		crun = c.root()
 	}
+	// Without a category, stage sounds go to the ambience bus, and channel 0,
+	// which is used for voices, to the voice bus
+	bus := AudioBusType(category)
+	if category < 0 {
+		switch {
+		case c.playerNo >= MaxSimul*2:
+			bus = AB_Ambience
+		case chNo == 0 && ffx == "":
+			bus = AB_Voice
+		default:
+			bus = AB_Sfx
+		}
+	}
 	if ch := crun.soundChannels.New(chNo, lowpriority, priority); ch != nil {
-		ch.Play(s, loop, freqmul)
+		ch.Play(s, bus, loop, freqmul)
 		vol = Clamp(vol, -25600, 25600)
 		//if c.gi().ver[0] == 1 {
 		if ffx != "" {
@@ -3391,7 +3442,9 @@ func (c *Char) playSound(ffx string, lowpriority, loop bool, g, n, chNo, vol int
 		//	}
 		//}
 		ch.SetPan(p*c.facing, ls, x)
+		return ch
 	}
+	return nil
 }
 
 // Furimuki = Turn around
@@ -3453,6 +3506,7 @@ func (c *Char) stateChange1(no int32, pn int) bool {
 		sys.appendToConsole(c.warn() + fmt.Sprintf("changed to invalid state %v (from state %v)", no, c.ss.prevno))
 		sys.errLog.Printf("Invalid state: P%v:%v\n", pn+1, no)
 		c.ss.sb = *newStateBytecode(pn)
+		c.ss.sb.stateNo = no
 		c.ss.sb.prevMoveType = c.ss.sb.moveType
 		c.ss.sb.stateType, c.ss.sb.moveType, c.ss.sb.physics = ST_U, MT_U, ST_U
 	}
@@ -6104,7 +6158,7 @@ func (c *Char) update(cvmin, cvmax,
 		} else {
 			if c.koEchoTime == 60 || c.koEchoTime == 120 {
 				vo := int32(100 * (240 - (c.koEchoTime + 60)) / 240)
-				c.playSound("", false, false, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0)
+				c.playSound("", false, false, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0, -1)
 			}
 			c.koEchoTime++
 		}
@@ -6251,7 +6305,7 @@ func (c *Char) tick() {
 		if c.life <= 0 && !sys.sf(GSF_noko) && !c.sf(CSF_noko) && (!c.ghv.guarded || !c.sf(CSF_noguardko)) {
 			if !sys.sf(GSF_nokosnd) && c.alive() {
 				vo := int32(100)
-				c.playSound("", false, false, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0)
+				c.playSound("", false, false, 11, 0, -1, vo, 0, 1, c.localscl, &c.pos[0], false, 0, -1)
 				if c.gi().data.ko.echo != 0 {
 					c.koEchoTime = 1
 				}
@@ -6959,7 +7013,7 @@ func (cl *CharList) clsn(getter *Char, proj bool) {
 			if hd.hitsound[0] >= 0 {
 				vo := int32(100)
 				c.playSound(hd.hitsound_ffx, false, false, hd.hitsound[0], hd.hitsound[1],
-					hd.hitsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0)
+					hd.hitsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0, int32(AB_Sfx))
 			}
 			if hitType > 0 {
 				c.powerAdd(hd.hitgetpower)
@@ -6997,7 +7051,7 @@ func (cl *CharList) clsn(getter *Char, proj bool) {
 			if hd.guardsound[0] >= 0 {
 				vo := int32(100)
 				c.playSound(hd.guardsound_ffx, false, false, hd.guardsound[0], hd.guardsound[1],
-					hd.guardsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0)
+					hd.guardsound_channel, vo, 0, 1, getter.localscl, &getter.pos[0], true, 0, int32(AB_Sfx))
 			}
 			if hitType > 0 {
 				c.powerAdd(hd.guardgetpower)
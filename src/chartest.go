@@ -0,0 +1,490 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// CharTest is a scripted match used to regression test character states.
+// The match runs headlessly: both players are driven by the test inputs and
+// trigger expressions are asserted on the frames listed in the test file.
+//
+// Test files use one directive per line, ';' and '#' start a comment:
+//
+//	name    crouching light punch
+//	p1      kfm 1
+//	p2      kfm 2
+//	stage   stages/stage0.def
+//	pos     p1 -70 0
+//	state   p2 0
+//	frames  40
+//	input   1-3 p1 D,x
+//	expect  4 p1 stateno = 400
+//	expect  * p2 alive
+//	expect  end p1 movecontact
+//
+// Frames are counted from the first frame after the round starts. Input keys
+// are U, D, F, B, L, R, a, b, c, x, y, z, s, d, w and m. Expectations accept
+// any trigger expression, evaluated as the given player.
+type CharTest struct {
+	name     string
+	filename string
+	stage    string
+	lifebar  string
+	frames   int32
+	players  [2]charTestPlayer
+	inputs   []charTestInput
+	expects  []charTestExpect
+	frame    int32
+	started  bool
+	failures []string
+}
+
+type charTestPlayer struct {
+	def    string
+	pal    int
+	setPos bool
+	pos    [2]float32
+	facing float32
+	state  int32
+	life   int32
+	power  int32
+}
+
+type charTestInput struct {
+	from, to int32
+	pn       int
+	keys     []string
+}
+
+const (
+	CT_Always int32 = -1
+	CT_End    int32 = -2
+)
+
+type charTestExpect struct {
+	from, to int32
+	pn       int
+	line     int
+	expr     string
+	be       BytecodeExp
+	failed   bool
+}
+
+func newCharTest(filename string) *CharTest {
+	ct := &CharTest{name: filename, filename: filename,
+		stage: "stages/stage0.def", lifebar: "data/fight.def", frames: 60}
+	for i := range ct.players {
+		ct.players[i] = charTestPlayer{pal: i + 1, state: -1, life: -1, power: -1}
+	}
+	return ct
+}
+
+func loadCharTest(filename string) (*CharTest, error) {
+	str, err := LoadText(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseCharTest(filename, str)
+}
+
+func parseCharTest(filename, src string) (*CharTest, error) {
+	ct := newCharTest(filename)
+	for i, line := range strings.Split(src, "\n") {
+		if idx := strings.IndexAny(line, ";#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := ct.parseLine(i+1, fields, strings.TrimSpace(line)); err != nil {
+			return nil, Error(fmt.Sprintf("%v:%v: %v", filename, i+1, err.Error()))
+		}
+	}
+	for _, p := range ct.players {
+		if p.def == "" {
+			return nil, Error(filename + ": both p1 and p2 have to be defined")
+		}
+	}
+	return ct, nil
+}
+
+func (ct *CharTest) parseLine(ln int, fields []string, line string) error {
+	args := fields[1:]
+	// Returns the remaining text of the line after n fields
+	rest := func(n int) string {
+		for i := 0; i < n; i++ {
+			line = strings.TrimSpace(line)
+			line = line[strings.IndexAny(line+" ", " \t"):]
+		}
+		return strings.TrimSpace(line)
+	}
+	need := func(n int) error {
+		if len(args) < n {
+			return Error(fmt.Sprintf("%v needs %v arguments", fields[0], n))
+		}
+		return nil
+	}
+	switch strings.ToLower(fields[0]) {
+	case "name":
+		ct.name = rest(1)
+	case "p1", "p2":
+		if err := need(1); err != nil {
+			return err
+		}
+		p := &ct.players[fields[0][1]-'1']
+		p.def = args[0]
+		if len(args) > 1 {
+			pal, err := strconv.Atoi(args[1])
+			if err != nil || pal < 1 || pal > int(MaxPalNo) {
+				return Error("Invalid palette: " + args[1])
+			}
+			p.pal = pal
+		}
+	case "stage":
+		if err := need(1); err != nil {
+			return err
+		}
+		ct.stage = rest(1)
+	case "lifebar":
+		if err := need(1); err != nil {
+			return err
+		}
+		ct.lifebar = rest(1)
+	case "frames":
+		if err := need(1); err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return Error("Invalid frame count: " + args[0])
+		}
+		ct.frames = int32(n)
+	case "pos", "facing", "state", "life", "power":
+		if err := need(2); err != nil {
+			return err
+		}
+		pn, err := parseCharTestPlayer(args[0])
+		if err != nil {
+			return err
+		}
+		p := &ct.players[pn]
+		var vals []float64
+		for _, a := range args[1:] {
+			v, err := strconv.ParseFloat(a, 64)
+			if err != nil {
+				return Error("Invalid number: " + a)
+			}
+			vals = append(vals, v)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "pos":
+			p.setPos = true
+			p.pos[0] = float32(vals[0])
+			if len(vals) > 1 {
+				p.pos[1] = float32(vals[1])
+			}
+		case "facing":
+			p.facing = float32(vals[0])
+		case "state":
+			p.state = int32(vals[0])
+		case "life":
+			p.life = int32(vals[0])
+		case "power":
+			p.power = int32(vals[0])
+		}
+	case "input":
+		if err := need(3); err != nil {
+			return err
+		}
+		from, to, err := parseCharTestFrames(args[0])
+		if err != nil {
+			return err
+		}
+		if from < 0 {
+			return Error("Invalid input frames: " + args[0])
+		}
+		pn, err := parseCharTestPlayer(args[1])
+		if err != nil {
+			return err
+		}
+		in := charTestInput{from: from, to: to, pn: pn}
+		for _, k := range strings.Split(rest(3), ",") {
+			k = strings.TrimSpace(k)
+			if len(k) != 1 || !strings.Contains("UDFBLRabcxyzsdwm", k) {
+				return Error("Invalid key: " + k)
+			}
+			in.keys = append(in.keys, k)
+		}
+		ct.inputs = append(ct.inputs, in)
+	case "expect":
+		if err := need(3); err != nil {
+			return err
+		}
+		from, to, err := parseCharTestFrames(args[0])
+		if err != nil {
+			return err
+		}
+		pn, err := parseCharTestPlayer(args[1])
+		if err != nil {
+			return err
+		}
+		ct.expects = append(ct.expects, charTestExpect{from: from, to: to,
+			pn: pn, line: ln, expr: rest(3)})
+	default:
+		return Error("Unknown directive: " + fields[0])
+	}
+	return nil
+}
+
+func parseCharTestPlayer(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "p1":
+		return 0, nil
+	case "p2":
+		return 1, nil
+	}
+	return 0, Error("Invalid player: " + s)
+}
+
+// Parses "N", "N-M", "*" (every frame) or "end" (after the last frame).
+func parseCharTestFrames(s string) (from, to int32, err error) {
+	switch strings.ToLower(s) {
+	case "*":
+		return CT_Always, CT_Always, nil
+	case "end":
+		return CT_End, CT_End, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	f, err1 := strconv.Atoi(parts[0])
+	t, err2 := f, error(nil)
+	if len(parts) > 1 {
+		t, err2 = strconv.Atoi(parts[1])
+	}
+	if err1 != nil || err2 != nil || f < 1 || t < f {
+		return 0, 0, Error("Invalid frames: " + s)
+	}
+	return int32(f), int32(t), nil
+}
+
+// Returns the input bits for a key, resolving F and B against facing.
+func charTestKey(k string, facing int32) InputBits {
+	switch k {
+	case "F", "B":
+		if (k == "F") == (facing >= 0) {
+			return IB_PR
+		}
+		return IB_PL
+	}
+	return InputBits(1) << uint(strings.Index("UDLRabcxyzsdwm", k))
+}
+
+// Called from CommandList.Input in place of the keyboard and joysticks.
+func (ct *CharTest) Input(cb *CommandBuffer, i int, facing int32) {
+	var ib InputBits
+	if ct.started {
+		// Inputs are read before step counts the frame being processed
+		frame := ct.frame + 1
+		for _, in := range ct.inputs {
+			if in.pn == i && frame >= in.from && frame <= in.to {
+				for _, k := range in.keys {
+					ib |= charTestKey(k, facing)
+				}
+			}
+		}
+	}
+	ib.GetInput(cb, facing)
+}
+
+// Applies the player setup once the round has started, and compiles the
+// expectations against the loaded characters' command lists.
+func (ct *CharTest) setup() error {
+	for pn, p := range ct.players {
+		c := sys.chars[pn][0]
+		if p.setPos {
+			c.setX(p.pos[0])
+			c.setY(p.pos[1])
+		}
+		if p.facing != 0 {
+			c.setFacing(p.facing)
+		}
+		if p.state >= 0 {
+			c.selfState(p.state, -1, -1, -1, "")
+		}
+		if p.life >= 0 {
+			c.lifeSet(p.life)
+		}
+		if p.power >= 0 {
+			c.powerSet(p.power)
+		}
+	}
+	for i := range ct.expects {
+		e := &ct.expects[i]
+		c := newCompiler()
+		c.playerNo = e.pn
+		c.cmdl = &sys.chars[e.pn][0].cmd[e.pn]
+		in := e.expr
+		be, err := c.fullExpression(&in, VT_Bool)
+		if err != nil {
+			return Error(fmt.Sprintf("%v:%v: %v", ct.filename, e.line, err.Error()))
+		}
+		e.be = be
+	}
+	return nil
+}
+
+func (ct *CharTest) check(e *charTestExpect) {
+	if e.failed {
+		return
+	}
+	c := sys.chars[e.pn][0]
+	sys.workingChar, sys.workingState = c, &c.ss.sb
+	if !e.be.run(c).ToB() {
+		e.failed = true
+		ct.failures = append(ct.failures, fmt.Sprintf(
+			"%v:%v: frame %v: P%v \"%v\" is false (stateno %v, time %v, pos %v,%v, life %v)",
+			ct.filename, e.line, ct.frame, e.pn+1, e.expr, c.ss.no, c.ss.time,
+			c.pos[0], c.pos[1], c.life))
+	}
+}
+
+// Called by the fight loop after every action. Waits for the round to start,
+// then counts frames, checks expectations and ends the match when done.
+func (ct *CharTest) step() {
+	if !sys.tickFrame() || sys.endMatch {
+		return
+	}
+	if !ct.started {
+		if sys.intro > 0 {
+			return
+		}
+		ct.started = true
+		if err := ct.setup(); err != nil {
+			ct.failures = append(ct.failures, err.Error())
+			sys.endMatch = true
+		}
+		return
+	}
+	ct.frame++
+	for i := range ct.expects {
+		e := &ct.expects[i]
+		if e.from == CT_Always || ct.frame >= e.from && ct.frame <= e.to {
+			ct.check(e)
+		}
+	}
+	if ct.frame >= ct.frames {
+		for i := range ct.expects {
+			if ct.expects[i].from == CT_End {
+				ct.check(&ct.expects[i])
+			}
+		}
+		sys.endMatch = true
+	}
+}
+
+// Runs the test as a single round match, using the Lua game function so that
+// the match goes through exactly the same code as a normal one.
+func (ct *CharTest) run(l *lua.LState) (err error) {
+	ct.frame, ct.started, ct.failures = 0, false, nil
+	for i := range ct.expects {
+		ct.expects[i].failed = false
+	}
+	// Everything touched here is restored afterwards, so tests can be run
+	// from the menus without affecting the next match
+	charNum, stageNum := len(sys.sel.charlist), len(sys.sel.stagelist)
+	oldLifebar, oldCommonLua := sys.lifebar, sys.commonLua
+	oldRoundTime, oldCom := sys.roundTime, sys.com
+	oldTmode, oldNumSimul, oldNumTurns := sys.tmode, sys.numSimul, sys.numTurns
+	defer func() {
+		sys.charTest = nil
+		sys.sel.ClearSelected()
+		sys.sel.charlist = sys.sel.charlist[:charNum]
+		sys.sel.stagelist = sys.sel.stagelist[:stageNum]
+		sys.lifebar, sys.commonLua = oldLifebar, oldCommonLua
+		sys.roundTime, sys.com = oldRoundTime, oldCom
+		sys.tmode, sys.numSimul, sys.numTurns = oldTmode, oldNumSimul, oldNumTurns
+	}()
+	lb, err := loadLifebar(ct.lifebar)
+	if err != nil {
+		return Error(fmt.Sprintf("Can't load %v: %v", ct.lifebar, err.Error()))
+	}
+	sys.lifebar = *lb
+	sys.lifebar.ro.match_wins = [2]int32{1, 1}
+	sys.sel.ClearSelected()
+	for pn, p := range ct.players {
+		sys.tmode[pn], sys.numSimul[pn], sys.numTurns[pn] = TM_Single, 1, 1
+		sys.sel.addChar(p.def)
+		if sys.sel.charlist[len(sys.sel.charlist)-1].def == "" {
+			return Error("Unable to add character: " + p.def)
+		}
+		sys.sel.AddSelectedChar(pn, len(sys.sel.charlist)-1, p.pal)
+	}
+	if err := sys.sel.AddStage(ct.stage); err != nil {
+		return Error("Unable to add stage: " + ct.stage)
+	}
+	sys.sel.SelectStage(len(sys.sel.stagelist))
+	sys.commonLua = nil
+	sys.roundTime = -1
+	sys.com = [len(sys.com)]float32{}
+	sys.match = 1
+	sys.charTest = ct
+	sys.loadStart()
+	if err := l.CallByParam(lua.P{Fn: l.GetGlobal("game"), NRet: 0,
+		Protect: true}); err != nil {
+		return err
+	}
+	if !ct.started {
+		ct.failures = append(ct.failures, ct.filename+": the round never started")
+	} else if ct.frame < ct.frames && len(ct.failures) == 0 {
+		ct.failures = append(ct.failures, fmt.Sprintf(
+			"%v: the match ended at frame %v of %v", ct.filename, ct.frame, ct.frames))
+	}
+	return nil
+}
+
+// Runs a single test file or every .test file in a directory, printing the
+// results to stdout. Returns false if any test failed.
+func runCharTests(path string) bool {
+	files := []string{path}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		files = nil
+		filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.ToLower(filepath.Ext(p)) == ".test" {
+				files = append(files, filepath.ToSlash(p))
+			}
+			return nil
+		})
+		sort.Strings(files)
+	}
+	passed := 0
+	for _, f := range files {
+		ct, err := loadCharTest(f)
+		if err == nil {
+			err = ct.run(sys.luaLState)
+		}
+		switch {
+		case err != nil:
+			fmt.Printf("ERROR %v\n      %v\n", f, err.Error())
+		case len(ct.failures) > 0:
+			fmt.Printf("FAIL  %v (%v)\n", ct.name, f)
+			for _, m := range ct.failures {
+				fmt.Printf("      %v\n", m)
+			}
+		default:
+			fmt.Printf("ok    %v (%v)\n", ct.name, f)
+			passed++
+		}
+		if sys.gameEnd {
+			break
+		}
+	}
+	fmt.Printf("%v/%v tests passed\n", passed, len(files))
+	return passed == len(files)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// Clips are captured every ClipFrameStep frames, 30 times per second.
+const ClipFrameStep = 2
+
+// ClipRecorder keeps the last seconds of gameplay in a ring buffer of
+// downscaled frames, which can be saved as an animated GIF, an APNG or a
+// sequence of PNG files for external encoders. A range of frames can also
+// be marked, which is kept apart from the ring buffer. While a range is
+// marked during a replay, no frame is skipped, so the clip is rendered at
+// full framerate however slow capturing is.
+type ClipRecorder struct {
+	seconds int32
+	width   int32
+	format  string
+	ring    []clipFrame
+	next    int
+	marked  []clipFrame
+	marking bool
+	last    int32
+	pixels  []byte
+}
+
+type clipFrame struct {
+	img   *image.RGBA
+	frame int32
+}
+
+func (cr *ClipRecorder) enabled() bool {
+	return cr.seconds > 0
+}
+
+func (cr *ClipRecorder) capacity() int {
+	return int(cr.seconds) * FPS / ClipFrameStep
+}
+
+// Captures the frame being rendered. Must be called before it is ended.
+func (cr *ClipRecorder) capture() {
+	if !cr.enabled() || sys.frameCounter-cr.last < ClipFrameStep && cr.last <= sys.frameCounter {
+		return
+	}
+	cr.last = sys.frameCounter
+	width, height := sys.window.GetSize()
+	if width <= 0 || height <= 0 {
+		return
+	}
+	if len(cr.pixels) != 4*width*height {
+		cr.pixels = make([]byte, 4*width*height)
+	}
+	gfx.ReadPixels(cr.pixels, width, height)
+	w := Min(cr.width, int32(width))
+	h := int32(int64(height) * int64(w) / int64(width))
+	if cr.marking {
+		cr.marked = append(cr.marked, clipFrame{downscale(cr.pixels, width, height, int(w), int(h), nil), cr.last})
+		// Marked ranges are limited to four times the ring buffer
+		if len(cr.marked) >= cr.capacity()*4 {
+			cr.mark()
+		}
+		return
+	}
+	if len(cr.ring) < cr.capacity() {
+		cr.ring = append(cr.ring, clipFrame{})
+		cr.next = len(cr.ring) - 1
+	}
+	f := &cr.ring[cr.next]
+	f.img, f.frame = downscale(cr.pixels, width, height, int(w), int(h), f.img), cr.last
+	cr.next = (cr.next + 1) % cr.capacity()
+}
+
+// Averages the bottom-up RGBA pixels read from the screen into an image of
+// the given size, reusing dst if possible.
+func downscale(px []byte, width, height, w, h int, dst *image.RGBA) *image.RGBA {
+	if dst == nil || dst.Rect.Dx() != w || dst.Rect.Dy() != h {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	for y := 0; y < h; y++ {
+		sy0, sy1 := y*height/h, Max(int32((y+1)*height/h), int32(y*height/h+1))
+		for x := 0; x < w; x++ {
+			sx0, sx1 := x*width/w, int(Max(int32((x+1)*width/w), int32(x*width/w+1)))
+			var r, g, b, n int
+			for sy := sy0; sy < int(sy1); sy++ {
+				row := px[(height-1-sy)*width*4:]
+				for sx := sx0; sx < sx1; sx++ {
+					r += int(row[sx*4])
+					g += int(row[sx*4+1])
+					b += int(row[sx*4+2])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = byte(r/n), byte(g/n), byte(b/n), 255
+		}
+	}
+	return dst
+}
+
+// Saves the ring buffer, which starts over.
+func (cr *ClipRecorder) save() {
+	if !cr.enabled() || len(cr.ring) == 0 {
+		return
+	}
+	frames := append(cr.ring[cr.next:], cr.ring[:cr.next]...)
+	cr.ring, cr.next = nil, 0
+	go saveClip(frames, cr.format)
+}
+
+// Starts marking a range of frames, or ends it and saves it.
+func (cr *ClipRecorder) mark() {
+	if !cr.enabled() {
+		return
+	}
+	if cr.marking = !cr.marking; cr.marking {
+		cr.marked = nil
+		sys.appendToConsole("Clip recording started")
+		return
+	}
+	if len(cr.marked) > 0 {
+		go saveClip(cr.marked, cr.format)
+	}
+	cr.marked = nil
+}
+
+func saveClip(frames []clipFrame, format string) {
+	ext := ".gif"
+	switch format {
+	case "apng":
+		ext = ".png"
+	case "frames":
+		ext = ""
+	}
+	filename, f, err := createClip(ext)
+	if err == nil {
+		switch format {
+		case "apng":
+			err = writeClip(f, frames, writeApng)
+		case "frames":
+			for i, fr := range frames {
+				name := fmt.Sprintf("%v/%05d.png", filename, i)
+				if err = writeClipFile(name, []clipFrame{fr}, func(w io.Writer, frames []clipFrame) error {
+					return png.Encode(w, frames[0].img)
+				}); err != nil {
+					break
+				}
+			}
+		default:
+			err = writeClip(f, frames, writeGif)
+		}
+	}
+	msg := fmt.Sprintf("Clip saved: %v (%v frames)", filename, len(frames))
+	if err != nil {
+		msg = fmt.Sprintf("Failed to save clip %v: %v", filename, err)
+		sys.errLog.Println(msg)
+	}
+	sys.mainThreadTask <- func() {
+		sys.appendToConsole(msg)
+	}
+}
+
+// Creates the first free clip file, or directory if ext is empty. Clips are
+// saved in goroutines, so the name is taken by creating it exclusively rather
+// than checked first, which two clips saved at once could both pass.
+func createClip(ext string) (filename string, f *os.File, err error) {
+	for i := 0; ; i++ {
+		filename = fmt.Sprintf("%sclip%03d%s", sys.screenshotFolder, i, ext)
+		if ext == "" {
+			err = os.Mkdir(filename, 0755)
+		} else {
+			f, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return filename, f, err
+		}
+	}
+}
+
+func writeClipFile(filename string, frames []clipFrame,
+	write func(io.Writer, []clipFrame) error) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	return writeClip(f, frames, write)
+}
+
+// Writes frames to f and closes it.
+func writeClip(f *os.File, frames []clipFrame,
+	write func(io.Writer, []clipFrame) error) error {
+	if err := write(f, frames); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Returns how long each frame is displayed in units of 1/den seconds,
+// carrying rounding errors over to the next frames.
+func clipDelays(frames []clipFrame, den int) []int {
+	delays := make([]int, len(frames))
+	var total, shown int
+	for i := range frames {
+		n := ClipFrameStep
+		if i+1 < len(frames) && frames[i+1].frame > frames[i].frame {
+			n = int(frames[i+1].frame - frames[i].frame)
+		}
+		total += n
+		delays[i] = total*den/FPS - shown
+		shown += delays[i]
+	}
+	return delays
+}
+
+func writeGif(w io.Writer, frames []clipFrame) error {
+	g := &gif.GIF{Delay: clipDelays(frames, 100)}
+	for _, f := range frames {
+		p := image.NewPaletted(f.img.Rect, palette.Plan9)
+		draw.FloydSteinberg.Draw(p, f.img.Rect, f.img, image.Point{})
+		g.Image = append(g.Image, p)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// Writes an animated PNG. Frames are encoded by the png package and their
+// image data moved into the APNG frame chunks.
+func writeApng(w io.Writer, frames []clipFrame) error {
+	chunk := func(typ string, data []byte) error {
+		return writePngChunk(w, typ, data)
+	}
+	if _, err := io.WriteString(w, "\x89PNG\r\n\x1a\n"); err != nil {
+		return err
+	}
+	enc := &png.Encoder{CompressionLevel: png.BestSpeed}
+	delays := clipDelays(frames, FPS)
+	var seq uint32
+	for i, f := range frames {
+		var buf bytes.Buffer
+		if err := enc.Encode(&buf, f.img); err != nil {
+			return err
+		}
+		// Split the encoded image into chunks, skipping the signature
+		var ihdr []byte
+		var idat [][]byte
+		data := buf.Bytes()[8:]
+		for len(data) >= 12 {
+			n := binary.BigEndian.Uint32(data)
+			typ, body := string(data[4:8]), data[8:8+n]
+			switch typ {
+			case "IHDR":
+				ihdr = body
+			case "IDAT":
+				idat = append(idat, body)
+			}
+			data = data[12+n:]
+		}
+		if i == 0 {
+			actl := make([]byte, 8)
+			binary.BigEndian.PutUint32(actl, uint32(len(frames)))
+			if err := chunk("IHDR", ihdr); err != nil {
+				return err
+			}
+			if err := chunk("acTL", actl); err != nil {
+				return err
+			}
+		}
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(f.img.Rect.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(f.img.Rect.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:], uint16(delays[i]))
+		binary.BigEndian.PutUint16(fctl[22:], uint16(FPS))
+		seq++
+		if err := chunk("fcTL", fctl); err != nil {
+			return err
+		}
+		for _, d := range idat {
+			if i == 0 {
+				if err := chunk("IDAT", d); err != nil {
+					return err
+				}
+				continue
+			}
+			fdat := make([]byte, 4+len(d))
+			binary.BigEndian.PutUint32(fdat, seq)
+			copy(fdat[4:], d)
+			seq++
+			if err := chunk("fdAT", fdat); err != nil {
+				return err
+			}
+		}
+	}
+	return chunk("IEND", nil)
+}
+
+func writePngChunk(w io.Writer, typ string, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	copy(hdr[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(hdr[4:])
+	crc.Write(data)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, crc.Sum32())
+}
+
+func (cr *ClipRecorder) setFormat(format string) {
+	switch format = strings.ToLower(strings.TrimSpace(format)); format {
+	case "apng", "frames":
+		cr.format = format
+	default:
+		cr.format = "gif"
+	}
+}
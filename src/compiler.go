@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const specialSymbols = " !=<>()|&+-*/%,[]^:;{}#\"\t\r\n"
@@ -28,12 +32,18 @@ type Compiler struct {
 	linechan         chan *string
 	vars             map[string]uint8
 	funcs            map[string]bytecodeFunction
+	funcFiles        map[string]string
 	funcUsed         map[string]bool
 	stateNo          int32
+	imports          map[string]*zssModule
+	modules          map[string]*zssModule
+	module           *zssModule
+	shared           *zssSharedModule
 }
 
 func newCompiler() *Compiler {
-	c := &Compiler{funcs: make(map[string]bytecodeFunction)}
+	c := &Compiler{funcs: make(map[string]bytecodeFunction),
+		funcFiles: make(map[string]string)}
 	c.scmap = map[string]scFunc{
 		"hitby":                c.hitBy,
 		"nothitby":             c.notHitBy,
@@ -116,6 +126,7 @@ func newCompiler() *Compiler {
 		"remappal":             c.remapPal,
 		"stopsnd":              c.stopSnd,
 		"sndpan":               c.sndPan,
+		"sndeffect":            c.sndEffect,
 		"varrandom":            c.varRandom,
 		"gravity":              c.gravity,
 		"bindtoparent":         c.bindToParent,
@@ -376,6 +387,8 @@ var triggerMap = map[string]int{
 	"score":              1,
 	"scoretotal":         1,
 	"selfstatenoexist":   1,
+	"soundlevel":         1,
+	"soundpeak":          1,
 	"sprpriority":        1,
 	"stagebackedgedist":  1,
 	"stageconst":         1,
@@ -1443,6 +1456,9 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			if !ok {
 				return Error("Command doesn't exist: " + c.token)
 			}
+			if c.shared != nil {
+				c.shared.commands[c.token] = true
+			}
 			i := sys.stringPool[c.playerNo].Add(c.token)
 			out.appendI32Op(OC_command, int32(i))
 			return nil
@@ -2831,6 +2847,16 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 			return bvNone(), err
 		}
 		out.append(OC_ex_, OC_ex_selfstatenoexist)
+	case "soundlevel":
+		if _, err := c.oneArg(out, in, rd, true); err != nil {
+			return bvNone(), err
+		}
+		out.append(OC_ex_, OC_ex_soundlevel)
+	case "soundpeak":
+		if _, err := c.oneArg(out, in, rd, true); err != nil {
+			return bvNone(), err
+		}
+		out.append(OC_ex_, OC_ex_soundpeak)
 	case "sprpriority":
 		out.append(OC_ex_, OC_ex_sprpriority)
 	case "stagebackedgedist", "stagebackedge": //Latter is deprecated
@@ -2923,6 +2949,8 @@ func (c *Compiler) expValue(out *BytecodeExp, in *string,
 				out.append(OC_blnot)
 			}
 			return bv, nil
+		} else if strings.HasPrefix(c.token, "vars.") {
+			return bvNone(), c.namedVarExp(out, in, rd)
 		} else if len(c.token) >= 2 && c.token[0] == '$' && c.token != "$_" {
 			vi, ok := c.vars[c.token[1:]]
 			if !ok {
@@ -4008,7 +4036,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 				return err
 			}
 			str = string(b)
-			return c.stateCompileZ(states, fnz, str, constants)
+			return c.stateCompileZ(states, filename, str, constants)
 		}
 
 		// Try reading as an st file
@@ -4071,6 +4099,7 @@ func (c *Compiler) stateCompile(states map[int32]StateBytecode,
 		if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
 			*sbc = states[c.stateNo]
 		}
+		sbc.stateNo = c.stateNo
 		// Interpret the statedef properties
 		if err := c.stateDef(is, sbc); err != nil {
 			return errmes(err)
@@ -4839,7 +4868,10 @@ func (c *Compiler) callFunc(line *string, root bool,
 	ctrls *[]StateController, ret []uint8) error {
 	var cf callFunction
 	var ok bool
-	cf.bytecodeFunction, ok = c.funcs[c.scan(line)]
+	var err error
+	if cf.bytecodeFunction, ok, err = c.lookupFunc(c.scan(line)); err != nil {
+		return err
+	}
 	cf.ret = ret
 	if !ok {
 		if c.token == "" || c.token == "(" {
@@ -5174,6 +5206,11 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 	}
 	existInThisFile := make(map[int32]bool)
 	funcExistInThisFile := make(map[string]bool)
+	// Imports are only visible in the file that declares them
+	c.imports = make(map[string]*zssModule)
+	if c.modules == nil {
+		c.modules = make(map[string]*zssModule)
+	}
 	var line string
 	c.token = ""
 	for {
@@ -5183,6 +5220,12 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 				break
 			}
 		}
+		if c.token == "import" {
+			if err := c.importModule(&line, filename, constants); err != nil {
+				return errmes(err)
+			}
+			continue
+		}
 		if c.token != "[" {
 			return errmes(c.wrongClosureToken())
 		}
@@ -5190,6 +5233,9 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 		case "":
 			return errmes(c.wrongClosureToken())
 		case "statedef":
+			if c.module != nil {
+				return errmes(Error("Statedef not allowed in an imported module"))
+			}
 			var err error
 			if c.stateNo, err = c.scanStateDef(&line, constants); err != nil {
 				return errmes(err)
@@ -5218,6 +5264,7 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 			if _, ok := states[c.stateNo]; ok && c.stateNo < 0 {
 				*sbc = states[c.stateNo]
 			}
+			sbc.stateNo = c.stateNo
 			c.vars = make(map[string]uint8)
 			if err := c.stateDef(is, sbc); err != nil {
 				return errmes(err)
@@ -5282,12 +5329,45 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 				nil, &fun.ctrls, &fun.numVars); err != nil {
 				return errmes(err)
 			}
-			if _, ok := c.funcs[name]; ok {
-				continue
-				//return errmes(Error("Function already defined in other file: " + name))
+			if file, ok := c.funcFiles[name]; ok {
+				// A file compiled twice, such as one used as both st and
+				// stcommon, keeps the functions it defined the first time
+				if file == filename {
+					continue
+				}
+				return errmes(Error("Function already defined in other file: " +
+					name + " (" + file + ")"))
 			}
 			c.funcs[name] = fun
+			c.funcFiles[name] = filename
 			//c.funcUsed[name] = true
+		case "vars":
+			if c.scan(&line) != "]" {
+				return errmes(c.wrongClosureToken())
+			}
+			if err := c.namedVarDecls(&line, nil); err != nil {
+				return errmes(err)
+			}
+		case "struct":
+			st := &NamedVarStruct{name: c.scan(&line)}
+			if st.name == "" || st.name == "]" {
+				return errmes(c.wrongClosureToken())
+			}
+			if err := c.varNameCheck(st.name); err != nil {
+				return errmes(err)
+			}
+			if c.scan(&line) != "]" {
+				return errmes(c.wrongClosureToken())
+			}
+			if err := c.namedVarDecls(&line, st); err != nil {
+				return errmes(err)
+			}
+			if len(st.fields) == 0 {
+				return errmes(Error("Struct without fields: " + st.name))
+			}
+			if err := sys.cgi[c.playerNo].namedVars.addStruct(st); err != nil {
+				return errmes(err)
+			}
 		default:
 			return errmes(Error("Unrecognized section (group) name: " + c.token))
 		}
@@ -5295,10 +5375,368 @@ func (c *Compiler) stateCompileZ(states map[int32]StateBytecode,
 	return nil
 }
 
+// Parses the declarations in a [Vars] section, or the fields of a [Struct]
+// section if st isn't nil, until the next section.
+func (c *Compiler) namedVarDecls(line *string, st *NamedVarStruct) error {
+	if err := c.checkNamedVars(); err != nil {
+		return err
+	}
+	nl := sys.cgi[c.playerNo].namedVars
+	for {
+		tname := c.scan(line)
+		if tname == "" || tname == "[" {
+			return nil
+		}
+		typ, vst, ok := nl.typeByName(tname)
+		if !ok {
+			return Error("Unknown type: " + tname)
+		}
+		if st != nil && vst != nil {
+			return Error("Struct fields can't be structs: " + tname)
+		}
+		name := c.scan(line)
+		if name == "" || name == ";" {
+			return c.wrongClosureToken()
+		}
+		if err := c.varNameCheck(name); err != nil {
+			return err
+		}
+		var count int32
+		if c.scan(line) == "[" {
+			if st != nil {
+				return Error("Struct fields can't be arrays: " + name)
+			}
+			n, err := strconv.Atoi(c.scan(line))
+			if err != nil || n < 1 {
+				return Error("Invalid array size: " + c.token)
+			}
+			count = int32(n)
+			if c.scan(line) != "]" {
+				return c.wrongClosureToken()
+			}
+			c.scan(line)
+		}
+		if err := c.needToken(";"); err != nil {
+			return err
+		}
+		if st != nil {
+			for _, f := range st.fields {
+				if f.name == name {
+					return Error("Duplicated field: " + name)
+				}
+			}
+			st.fields = append(st.fields, NamedVarField{name, typ})
+		} else if err := nl.declare(name, typ, vst, count); err != nil {
+			return err
+		}
+	}
+}
+
+// Compiles vars.name, vars.name[index] and vars.name[index].field, or an
+// assignment to them with :=.
+func (c *Compiler) namedVarExp(out *BytecodeExp, in *string, rd bool) error {
+	if err := c.checkNamedVars(); err != nil {
+		return err
+	}
+	path := strings.SplitN(c.token[len("vars."):], ".", 2)
+	nv := sys.cgi[c.playerNo].namedVars.get(path[0])
+	if nv == nil {
+		return Error(c.token + " is not declared")
+	}
+	field := ""
+	if len(path) > 1 {
+		field = path[1]
+	}
+	var idx BytecodeExp
+	c.token = c.tokenizer(in)
+	if c.token == "[" {
+		if nv.count == 0 {
+			return Error(nv.name + " is not an array")
+		}
+		c.token = c.tokenizer(in)
+		bv, err := c.expBoolOr(&idx, in)
+		if err != nil {
+			return err
+		}
+		idx.appendValue(bv)
+		if err := c.needToken("]"); err != nil {
+			return err
+		}
+		c.token = c.tokenizer(in)
+		if field == "" && c.token == "." {
+			field = c.tokenizer(in)
+			c.token = c.tokenizer(in)
+		}
+	} else if nv.count > 0 {
+		return Error("Index of " + nv.name + " not specified")
+	} else {
+		idx.appendValue(BytecodeInt(0))
+	}
+	off, err := nv.fieldOffset(field)
+	if err != nil {
+		return err
+	}
+	if rd {
+		out.appendI32Op(OC_nordrun, int32(len(idx)))
+	}
+	out.append(idx...)
+	if c.token == ":=" {
+		var be BytecodeExp
+		c.token = c.tokenizer(in)
+		bv, err := c.expEqne(&be, in)
+		if err != nil {
+			return err
+		}
+		be.appendValue(bv)
+		if rd {
+			out.appendI32Op(OC_nordrun, int32(len(be)))
+		}
+		out.append(be...)
+		out.append(OC_st_)
+		out.appendI32Op(OC_st_namedvar, nv.base+off)
+	} else {
+		out.append(OC_ex_)
+		out.appendI32Op(OC_ex_namedvar, nv.base+off)
+	}
+	out.appendI32(nv.length())
+	out.appendI32(nv.stride())
+	return nil
+}
+
+// A ZSS file imported with 'import "file.zss" as name'. Modules may only
+// contain functions, which are called as name.function(...). Functions whose
+// name starts with _ are private to the module.
+type zssModule struct {
+	filename  string
+	funcs     map[string]bytecodeFunction
+	compiling bool
+	// Imported by a file of the character rather than by another module
+	direct bool
+}
+
+// Files of the ZSS modules imported so far, watched by hot reload
+var zssModuleFiles = map[string]bool{}
+
+// A module compiled once for every character that imports it. Its bytecode
+// refers to strings and ignorehitpause flags by index, so shared modules are
+// compiled against a string pool and a flag count of their own, which the
+// pool and flags of every character start with (see Compile). What else a
+// module's bytecode depends on is checked for each character: the commands
+// its triggers use, and the files it was compiled from, which must not have
+// changed.
+type zssSharedModule struct {
+	funcs    map[string]bytecodeFunction
+	files    map[string]zssModuleFile
+	commands map[string]bool
+	// Set for modules that use named variables, which belong to a character,
+	// and for modules that import them. They're compiled for each character.
+	perChar bool
+}
+
+type zssModuleFile struct {
+	modTime time.Time
+	size    int64
+}
+
+var zssModules = struct {
+	sync.Mutex
+	// By filename, with a suffix for MUGEN 1.0 characters, as their version
+	// changes how some parameters compile
+	shared         map[string]*zssSharedModule
+	pool           StringPool
+	wakewakaLength int32
+}{shared: make(map[string]*zssSharedModule), pool: *NewStringPool()}
+
+func newZssSharedModule() *zssSharedModule {
+	return &zssSharedModule{funcs: make(map[string]bytecodeFunction),
+		files: make(map[string]zssModuleFile), commands: make(map[string]bool)}
+}
+
+// Returns whether none of the files the module was compiled from changed.
+func (sm *zssSharedModule) upToDate() bool {
+	for name, f := range sm.files {
+		info, err := os.Stat(name)
+		if err != nil || !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+			return false
+		}
+	}
+	return true
+}
+
+// Adds what an imported module depends on to the module importing it.
+func (sm *zssSharedModule) merge(imp *zssSharedModule) {
+	for name, f := range imp.files {
+		sm.files[name] = f
+	}
+	for cmd := range imp.commands {
+		sm.commands[cmd] = true
+	}
+	sm.perChar = sm.perChar || imp.perChar
+}
+
+// Named variables belong to a character, so a module using them can't be
+// shared. Stops compiling a shared module, which is then compiled for the
+// character instead.
+func (c *Compiler) checkNamedVars() error {
+	if c.shared != nil {
+		c.shared.perChar = true
+		return Error("Named variables used in a shared module")
+	}
+	return nil
+}
+
+// Parses an import statement and gets the module, compiling it if this
+// character hasn't imported it yet and no other character has compiled it.
+func (c *Compiler) importModule(line *string, filename string,
+	constants map[string]float32) error {
+	if c.scan(line) != "\"" {
+		return Error("Import path not enclosed in \"")
+	}
+	path, err := c.readString(line)
+	if err != nil {
+		return err
+	}
+	if c.scan(line) != "as" {
+		return Error("Missing 'as' in import of " + path)
+	}
+	name := c.scan(line)
+	if name == "" || name == ";" {
+		return c.wrongClosureToken()
+	}
+	if err := c.varNameCheck(name); err != nil {
+		return err
+	}
+	if _, ok := c.imports[name]; ok {
+		return Error("Module name already used in the same file: " + name)
+	}
+	if c.scan(line) == ";" {
+		c.token = ""
+	}
+	var info os.FileInfo
+	if err := LoadFile(&path, []string{filename, "", sys.motifDir, "data/"},
+		func(filename string) (err error) {
+			info, err = os.Stat(filename)
+			zssModuleFiles[filename] = true
+			return
+		}); err != nil {
+		return err
+	}
+	mod, ok := c.modules[path]
+	if !ok {
+		mod = &zssModule{filename: path, compiling: true}
+		c.modules[path] = mod
+		sm, err := c.sharedModule(path, info, constants)
+		if err != nil {
+			delete(c.modules, path)
+			return err
+		}
+		mod.funcs, mod.compiling = sm.funcs, false
+	} else if mod.compiling {
+		return Error("Circular import: " + path)
+	}
+	mod.direct = mod.direct || c.module == nil
+	c.imports[name] = mod
+	return nil
+}
+
+// Returns the shared module compiled from path, compiling it if needed. A
+// module that can't be shared is compiled for the character, unless it's
+// imported by a shared module, which then can't be shared either.
+func (c *Compiler) sharedModule(path string, info os.FileInfo,
+	constants map[string]float32) (*zssSharedModule, error) {
+	key := path
+	if sys.cgi[c.playerNo].ver[0] == 1 {
+		key += "\x00mugen1"
+	}
+	sm, ok := zssModules.shared[key]
+	if !ok || !sm.upToDate() {
+		sm = newZssSharedModule()
+		sm.files[path] = zssModuleFile{info.ModTime(), info.Size()}
+		// Compile against the shared pool, unless already doing so for the
+		// module importing this one
+		if c.shared == nil {
+			pool, wakewaka := sys.stringPool[c.playerNo], sys.cgi[c.playerNo].wakewakaLength
+			sys.stringPool[c.playerNo] = zssModules.pool
+			sys.cgi[c.playerNo].wakewakaLength = zssModules.wakewakaLength
+			defer func() {
+				zssModules.pool = sys.stringPool[c.playerNo]
+				zssModules.wakewakaLength = sys.cgi[c.playerNo].wakewakaLength
+				sys.stringPool[c.playerNo], sys.cgi[c.playerNo].wakewakaLength = pool, wakewaka
+			}()
+		}
+		if err := c.compileModule(path, sm, sm, constants); err != nil && !sm.perChar {
+			return nil, err
+		}
+		if sm.perChar {
+			sm.funcs = nil
+		}
+		zssModules.shared[key] = sm
+	}
+	if c.shared != nil {
+		c.shared.merge(sm)
+		if sm.perChar {
+			return nil, Error("Module can't be shared: " + path)
+		}
+	}
+	if sm.perChar {
+		// Compiled for this character only
+		own := newZssSharedModule()
+		if err := c.compileModule(path, own, nil, constants); err != nil {
+			return nil, err
+		}
+		return own, nil
+	}
+	cmds := make([]string, 0, len(sm.commands))
+	for cmd := range sm.commands {
+		if _, ok := c.cmdl.Names[cmd]; !ok {
+			cmds = append(cmds, cmd)
+		}
+	}
+	if len(cmds) > 0 {
+		sort.Strings(cmds)
+		return nil, Error(path + ":\nCommand doesn't exist: " + cmds[0])
+	}
+	return sm, nil
+}
+
+// Compiles the functions of a module into sm.funcs. shared is the module
+// being compiled against the shared pool, if any.
+func (c *Compiler) compileModule(path string, sm, shared *zssSharedModule,
+	constants map[string]float32) error {
+	src, err := LoadText(path)
+	if err != nil {
+		return err
+	}
+	mc := newCompiler()
+	mc.playerNo, mc.cmdl, mc.funcUsed = c.playerNo, c.cmdl, c.funcUsed
+	mc.modules, mc.module, mc.funcs, mc.shared = c.modules, c.modules[path], sm.funcs, shared
+	return mc.stateCompileZ(nil, path, src, constants)
+}
+
+// Finds a function by name. Names in the form module.function refer to the
+// public functions of a module imported in the current file.
+func (c *Compiler) lookupFunc(name string) (bytecodeFunction, bool, error) {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		f, ok := c.funcs[name]
+		return f, ok, nil
+	}
+	mod, ok := c.imports[name[:i]]
+	if !ok {
+		return bytecodeFunction{}, false, Error("Undefined module: " + name[:i])
+	}
+	fname := name[i+1:]
+	f, ok := mod.funcs[fname]
+	if ok && strings.HasPrefix(fname, "_") {
+		return bytecodeFunction{}, false, Error("Function is private to " +
+			mod.filename + ": " + fname)
+	}
+	return f, ok, nil
+}
+
 // Compile a character definition file
 func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (map[int32]StateBytecode, error) {
 	c.playerNo = pn
-	states := make(map[int32]StateBytecode)
 
 	/* Load initial data from definition file */
 	str, err := LoadText(def)
@@ -5480,9 +5918,34 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 	}
 
 	/* Compile states */
-	sys.stringPool[pn].Clear()
-	sys.cgi[pn].wakewakaLength = 0
+	// Modules compiled for the first time add to the shared pool, past the
+	// strings the character's pool started with, so the character is
+	// compiled again with the grown pool. Its second pass finds them all.
+	zssModules.Lock()
+	defer zssModules.Unlock()
+	for {
+		poolLen, wakewaka := len(zssModules.pool.List), zssModules.wakewakaLength
+		states, err := c.compileStates(pn, def, st[:], cmd, stcommon, constants)
+		if err != nil {
+			return nil, err
+		}
+		if len(zssModules.pool.List) == poolLen && zssModules.wakewakaLength == wakewaka {
+			return states, nil
+		}
+	}
+}
+
+// Compiles the state files of a character, starting with the strings and
+// ignorehitpause flags of the shared modules.
+func (c *Compiler) compileStates(pn int, def string, st []string, cmd, stcommon string,
+	constants map[string]float32) (map[int32]StateBytecode, error) {
+	states := make(map[int32]StateBytecode)
+	sys.stringPool[pn].Reset(&zssModules.pool)
+	sys.cgi[pn].wakewakaLength = zssModules.wakewakaLength
+	c.funcs, c.funcFiles = make(map[string]bytecodeFunction), make(map[string]string)
 	c.funcUsed = make(map[string]bool)
+	c.modules = make(map[string]*zssModule)
+	sys.cgi[pn].namedVars = newNamedVarLayout()
 	// Compile state files
 	for _, s := range st {
 		if len(s) > 0 {
@@ -5516,5 +5979,36 @@ func (c *Compiler) Compile(pn int, def string, constants map[string]float32) (ma
 			return nil, err
 		}
 	}
+	if err := c.checkModuleFuncs(); err != nil {
+		return nil, err
+	}
 	return states, nil
 }
+
+// Checks that no public function of the modules imported by the character's
+// files has the name of one of its functions, once all of them are compiled.
+func (c *Compiler) checkModuleFuncs() error {
+	paths := make([]string, 0, len(c.modules))
+	for path, mod := range c.modules {
+		if mod.direct {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		names := make([]string, 0, len(c.modules[path].funcs))
+		for name := range c.modules[path].funcs {
+			if !strings.HasPrefix(name, "_") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if file, ok := c.funcFiles[name]; ok {
+				return Error(fmt.Sprintf("%v:\nFunction of module %v already defined in this file: %v",
+					file, path, name))
+			}
+		}
+	}
+	return nil
+}
@@ -252,6 +252,42 @@ func (c *Compiler) playSnd(is IniSection, sc *StateControllerBase, _ int8) (Stat
 			playSnd_priority, VT_Int, 1, false); err != nil {
 			return err
 		}
+		if err := c.stateParam(is, "category", func(data string) error {
+			if len(data) == 0 {
+				return Error("Value not specified")
+			}
+			if data[0] == '"' {
+				data = data[1 : len(data)-1]
+			}
+			bus, ok := audioBusByName(data)
+			if !ok || bus == AB_Bgm {
+				return Error("Invalid value: " + data)
+			}
+			sc.add(playSnd_category, sc.iToExp(int32(bus)))
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "lowpass",
+			playSnd_lowpass, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "highpass",
+			playSnd_highpass, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "reverb",
+			playSnd_reverb, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "pitch",
+			playSnd_pitch, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "echo",
+			playSnd_echo, VT_Float, 3, false); err != nil {
+			return err
+		}
 		return nil
 	})
 	return *ret, err
@@ -3189,6 +3225,40 @@ func (c *Compiler) sndPan(is IniSection, sc *StateControllerBase, _ int8) (State
 	})
 	return *ret, err
 }
+func (c *Compiler) sndEffect(is IniSection, sc *StateControllerBase, _ int8) (StateController, error) {
+	ret, err := (*sndEffect)(sc), c.stateSec(is, func() error {
+		if err := c.paramValue(is, sc, "redirectid",
+			sndEffect_redirectid, VT_Int, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "channel",
+			sndEffect_channel, VT_Int, 1, true); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "lowpass",
+			sndEffect_lowpass, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "highpass",
+			sndEffect_highpass, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "reverb",
+			sndEffect_reverb, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "pitch",
+			sndEffect_pitch, VT_Float, 1, false); err != nil {
+			return err
+		}
+		if err := c.paramValue(is, sc, "echo",
+			sndEffect_echo, VT_Float, 3, false); err != nil {
+			return err
+		}
+		return nil
+	})
+	return *ret, err
+}
 func (c *Compiler) varRandom(is IniSection, sc *StateControllerBase, _ int8) (StateController, error) {
 	ret, err := (*varRandom)(sc), c.stateSec(is, func() error {
 		if err := c.paramValue(is, sc, "redirectid",
@@ -4083,6 +4153,15 @@ func (c *Compiler) playBgm(is IniSection, sc *StateControllerBase, _ int8) (Stat
 			playBgm_startposition, VT_Int, 1, false); err != nil {
 			return err
 		}
+		if err := c.stateParam(is, "soundfont", func(data string) error {
+			if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+				return Error("Not enclosed in \"")
+			}
+			sc.add(playBgm_soundfont, sc.beToExp(BytecodeExp(data[1:len(data)-1])))
+			return nil
+		}); err != nil {
+			return err
+		}
 		return nil
 	})
 	return *ret, err
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sort"
+	"strings"
+
+	"github.com/ikemen-engine/beep"
+)
+
+// A FLAC decoder and a simple encoder, so that SND files and music can use
+// lossless compression without depending on a C library. The decoder
+// supports every channel assignment, subframe type and residual coding
+// method, which flac_test.go checks on files made by an encoder written
+// independently. The encoder only uses fixed predictors, which compress
+// voices and sound effects nearly as well as LPC does.
+
+const flacBlockSize = 4096
+
+type flacBitReader struct {
+	r   *bufio.Reader
+	buf uint64
+	n   uint
+	pos int64 // Bytes read
+}
+
+func (br *flacBitReader) bits(n uint) (uint64, error) {
+	for br.n < n {
+		b, err := br.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		br.buf = br.buf<<8 | uint64(b)
+		br.n += 8
+		br.pos++
+	}
+	v := br.buf >> (br.n - n) & (1<<n - 1)
+	br.n -= n
+	br.buf &= 1<<br.n - 1
+	return v, nil
+}
+func (br *flacBitReader) signed(n uint) (int64, error) {
+	v, err := br.bits(n)
+	if n == 0 {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), err
+}
+
+// Counts the zero bits before the next one bit.
+func (br *flacBitReader) unary() (uint64, error) {
+	var n uint64
+	for {
+		if br.n == 0 {
+			b, err := br.r.ReadByte()
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+			br.buf, br.n = uint64(b), 8
+			br.pos++
+		}
+		if br.buf == 0 {
+			n += uint64(br.n)
+			br.n = 0
+			continue
+		}
+		z := br.n - uint(bits.Len64(br.buf))
+		n += uint64(z)
+		br.n -= z + 1
+		br.buf &= 1<<br.n - 1
+		return n, nil
+	}
+}
+func (br *flacBitReader) align() {
+	br.buf, br.n = 0, 0
+}
+
+type flacStreamInfo struct {
+	sampleRate, channels, bps int
+	totalSamples              int64
+}
+
+// flacDecoder streams a FLAC file frame by frame. The start of every frame
+// decoded so far is remembered, so seeking back, as music loops do, doesn't
+// need to decode the file from its start again.
+type flacDecoder struct {
+	rs       io.ReadSeeker
+	br       flacBitReader
+	info     flacStreamInfo
+	comments []string
+	frames   []flacSeekPoint
+	block    [][]int32
+	blockPos int
+	pos      int64
+	err      error
+}
+
+type flacSeekPoint struct {
+	sample, offset int64
+}
+
+// Decodes FLAC data, which must be seekable for Seek to work.
+func flacDecode(r io.Reader) (*flacDecoder, beep.Format, error) {
+	d := &flacDecoder{}
+	d.rs, _ = r.(io.ReadSeeker)
+	d.br.r = bufio.NewReader(r)
+	if err := d.readMetadata(); err != nil {
+		return nil, beep.Format{}, err
+	}
+	d.frames = []flacSeekPoint{{0, d.br.pos}}
+	format := beep.Format{SampleRate: beep.SampleRate(d.info.sampleRate),
+		NumChannels: d.info.channels, Precision: 2}
+	if format.NumChannels > 2 {
+		format.NumChannels = 2
+	}
+	return d, format, nil
+}
+
+func (d *flacDecoder) readMetadata() error {
+	magic, err := d.br.bits(32)
+	if err != nil {
+		return err
+	}
+	// An ID3v2 tag may come first
+	if magic>>8 == 0x494433 {
+		var hdr [6]byte
+		for i := range hdr {
+			b, err := d.br.bits(8)
+			if err != nil {
+				return err
+			}
+			hdr[i] = byte(b)
+		}
+		size := int64(hdr[2])<<21 | int64(hdr[3])<<14 | int64(hdr[4])<<7 | int64(hdr[5])
+		if _, err := d.br.r.Discard(int(size)); err != nil {
+			return err
+		}
+		d.br.pos += size
+		if magic, err = d.br.bits(32); err != nil {
+			return err
+		}
+	}
+	if magic != 0x664c6143 { // fLaC
+		return Error("not a FLAC file")
+	}
+	for last := false; !last; {
+		hdr, err := d.br.bits(32)
+		if err != nil {
+			return err
+		}
+		last = hdr>>31 != 0
+		typ, length := hdr>>24&0x7f, int(hdr&0xffffff)
+		data := make([]byte, length)
+		for i := range data {
+			b, err := d.br.bits(8)
+			if err != nil {
+				return err
+			}
+			data[i] = byte(b)
+		}
+		switch typ {
+		case 0: // STREAMINFO
+			if length < 34 {
+				return Error("invalid FLAC stream info")
+			}
+			v := binary.BigEndian.Uint64(data[10:18])
+			d.info = flacStreamInfo{int(v >> 44), int(v>>41&7) + 1, int(v>>36&31) + 1,
+				int64(v & (1<<36 - 1))}
+		case 4: // VORBIS_COMMENT, little endian unlike the rest
+			d.comments = parseVorbisComments(data)
+		}
+	}
+	if d.info.sampleRate == 0 {
+		return Error("FLAC stream info is missing")
+	}
+	return nil
+}
+
+func parseVorbisComments(data []byte) (comments []string) {
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return nil, false
+		}
+		s := data[4 : 4+n]
+		data = data[4+n:]
+		return s, true
+	}
+	if _, ok := next(); !ok { // Vendor
+		return
+	}
+	if len(data) < 4 {
+		return
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < count; i++ {
+		s, ok := next()
+		if !ok {
+			break
+		}
+		comments = append(comments, string(s))
+	}
+	return
+}
+
+// Returns the value of a Vorbis comment, whose names are case insensitive.
+func (d *flacDecoder) comment(name string) (string, bool) {
+	for _, c := range d.comments {
+		if i := strings.IndexByte(c, '='); i >= 0 && strings.EqualFold(c[:i], name) {
+			return c[i+1:], true
+		}
+	}
+	return "", false
+}
+
+func (d *flacDecoder) readFrame() error {
+	br := &d.br
+	br.align()
+	start := br.pos
+	hdr, err := br.bits(32)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF && br.pos == start {
+			return io.EOF
+		}
+		return err
+	}
+	if hdr>>18 != 0x3ffe {
+		return Error("invalid FLAC frame sync code")
+	}
+	bsCode, srCode := hdr>>12&15, hdr>>8&15
+	chAssign, ssCode := int(hdr>>4&15), hdr>>1&7
+	// The coded frame or sample number
+	first, err := br.bits(8)
+	if err != nil {
+		return err
+	}
+	for i := bits.LeadingZeros8(^uint8(first)); i > 1; i-- {
+		if _, err := br.bits(8); err != nil {
+			return err
+		}
+	}
+	var size int
+	switch {
+	case bsCode == 1:
+		size = 192
+	case bsCode >= 2 && bsCode <= 5:
+		size = 576 << (bsCode - 2)
+	case bsCode == 6, bsCode == 7:
+		v, err := br.bits(8 << (bsCode - 6))
+		if err != nil {
+			return err
+		}
+		size = int(v) + 1
+	case bsCode >= 8:
+		size = 256 << (bsCode - 8)
+	default:
+		return Error("invalid FLAC block size")
+	}
+	switch srCode {
+	case 12:
+		_, err = br.bits(8)
+	case 13, 14:
+		_, err = br.bits(16)
+	}
+	if err != nil {
+		return err
+	}
+	bps := d.info.bps
+	if ssCode != 0 {
+		bps = [...]int{0, 8, 12, 0, 16, 20, 24, 32}[ssCode]
+		if bps == 0 {
+			return Error("invalid FLAC sample size")
+		}
+	}
+	if _, err := br.bits(8); err != nil { // CRC-8
+		return err
+	}
+	channels := chAssign + 1
+	if chAssign >= 8 {
+		if chAssign > 10 {
+			return Error("invalid FLAC channel assignment")
+		}
+		channels = 2
+	}
+	if len(d.block) != channels {
+		d.block = make([][]int32, channels)
+	}
+	for ch := range d.block {
+		sbps := bps
+		// Side channels have an extra bit
+		if chAssign == 8 && ch == 1 || chAssign == 9 && ch == 0 || chAssign == 10 && ch == 1 {
+			sbps++
+		}
+		if cap(d.block[ch]) < size {
+			d.block[ch] = make([]int32, size)
+		}
+		d.block[ch] = d.block[ch][:size]
+		if err := d.readSubframe(d.block[ch], sbps); err != nil {
+			return err
+		}
+	}
+	br.align()
+	if _, err := br.bits(16); err != nil { // CRC-16
+		return err
+	}
+	switch chAssign {
+	case 8: // left, side
+		for i, s := range d.block[1] {
+			d.block[1][i] = d.block[0][i] - s
+		}
+	case 9: // side, right
+		for i, s := range d.block[0] {
+			d.block[0][i] = s + d.block[1][i]
+		}
+	case 10: // mid, side
+		for i, s := range d.block[1] {
+			m := d.block[0][i]<<1 | s&1
+			d.block[0][i], d.block[1][i] = (m+s)>>1, (m-s)>>1
+		}
+	}
+	// Scale samples to 16 bits, the precision music and sounds are mixed at
+	if shift := bps - 16; shift != 0 {
+		for _, b := range d.block {
+			for i := range b {
+				if shift > 0 {
+					b[i] >>= uint(shift)
+				} else {
+					b[i] <<= uint(-shift)
+				}
+			}
+		}
+	}
+	d.blockPos = 0
+	if n := len(d.frames); d.frames[n-1].offset == start {
+		d.frames = append(d.frames, flacSeekPoint{d.frames[n-1].sample + int64(size), br.pos})
+	}
+	return nil
+}
+
+func (d *flacDecoder) readSubframe(out []int32, bps int) error {
+	br := &d.br
+	hdr, err := br.bits(8)
+	if err != nil {
+		return err
+	}
+	typ := hdr >> 1 & 63
+	wasted := 0
+	if hdr&1 != 0 {
+		w, err := br.unary()
+		if err != nil {
+			return err
+		}
+		wasted = int(w) + 1
+		bps -= wasted
+	}
+	switch {
+	case typ == 0: // Constant
+		v, err := br.signed(uint(bps))
+		if err != nil {
+			return err
+		}
+		for i := range out {
+			out[i] = int32(v)
+		}
+	case typ == 1: // Verbatim
+		for i := range out {
+			v, err := br.signed(uint(bps))
+			if err != nil {
+				return err
+			}
+			out[i] = int32(v)
+		}
+	case typ >= 8 && typ <= 12: // Fixed
+		order := int(typ & 7)
+		if err := d.readWarmup(out, order, bps); err != nil {
+			return err
+		}
+		if err := d.readResidual(out, order); err != nil {
+			return err
+		}
+		flacFixedRestore(out, order)
+	case typ >= 32: // LPC
+		order := int(typ&31) + 1
+		if err := d.readWarmup(out, order, bps); err != nil {
+			return err
+		}
+		prec, err := br.bits(4)
+		if err != nil || prec == 15 {
+			return Error("invalid FLAC LPC precision")
+		}
+		shift, err := br.signed(5)
+		if err != nil {
+			return err
+		}
+		coefs := make([]int64, order)
+		for i := range coefs {
+			if coefs[i], err = br.signed(uint(prec) + 1); err != nil {
+				return err
+			}
+		}
+		if err := d.readResidual(out, order); err != nil {
+			return err
+		}
+		for i := order; i < len(out); i++ {
+			var sum int64
+			for j, c := range coefs {
+				sum += c * int64(out[i-1-j])
+			}
+			out[i] += int32(sum >> uint(shift))
+		}
+	default:
+		return Error("invalid FLAC subframe type")
+	}
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= uint(wasted)
+		}
+	}
+	return nil
+}
+
+func (d *flacDecoder) readWarmup(out []int32, order, bps int) error {
+	if order > len(out) {
+		return Error("invalid FLAC predictor order")
+	}
+	for i := 0; i < order; i++ {
+		v, err := d.br.signed(uint(bps))
+		if err != nil {
+			return err
+		}
+		out[i] = int32(v)
+	}
+	return nil
+}
+
+// Reads the Rice coded residual after the warm-up samples.
+func (d *flacDecoder) readResidual(out []int32, order int) error {
+	br := &d.br
+	method, err := br.bits(2)
+	if err != nil || method > 1 {
+		return Error("invalid FLAC residual coding method")
+	}
+	paramBits, escape := uint(4), uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+	porder, err := br.bits(4)
+	if err != nil {
+		return err
+	}
+	parts := 1 << porder
+	i := order
+	for p := 0; p < parts; p++ {
+		n := len(out) >> porder
+		if p == 0 {
+			n -= order
+		}
+		if n < 0 || i+n > len(out) {
+			return Error("invalid FLAC partition order")
+		}
+		param, err := br.bits(paramBits)
+		if err != nil {
+			return err
+		}
+		if param == escape {
+			raw, err := br.bits(5)
+			if err != nil {
+				return err
+			}
+			for end := i + n; i < end; i++ {
+				v, err := br.signed(uint(raw))
+				if err != nil {
+					return err
+				}
+				out[i] = int32(v)
+			}
+			continue
+		}
+		for end := i + n; i < end; i++ {
+			q, err := br.unary()
+			if err != nil {
+				return err
+			}
+			r, err := br.bits(uint(param))
+			if err != nil {
+				return err
+			}
+			u := uint32(q<<param | r)
+			out[i] = int32(u>>1) ^ -int32(u&1)
+		}
+	}
+	return nil
+}
+
+// Turns residuals predicted from the previous samples into samples.
+func flacFixedRestore(s []int32, order int) {
+	for i := order; i < len(s); i++ {
+		switch order {
+		case 1:
+			s[i] += s[i-1]
+		case 2:
+			s[i] += 2*s[i-1] - s[i-2]
+		case 3:
+			s[i] += 3*s[i-1] - 3*s[i-2] + s[i-3]
+		case 4:
+			s[i] += 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+		}
+	}
+}
+
+func (d *flacDecoder) Stream(samples [][2]float64) (n int, ok bool) {
+	if d.err != nil {
+		return 0, false
+	}
+	for n < len(samples) {
+		if len(d.block) == 0 || d.blockPos >= len(d.block[0]) {
+			if err := d.readFrame(); err != nil {
+				if err != io.EOF {
+					d.err = err
+				}
+				d.block = nil
+				break
+			}
+		}
+		l, r := d.block[0], d.block[len(d.block)-1]
+		if len(d.block) > 2 {
+			r = d.block[1]
+		}
+		for ; n < len(samples) && d.blockPos < len(l); n, d.blockPos = n+1, d.blockPos+1 {
+			samples[n][0] = float64(l[d.blockPos]) / (1 << 15)
+			samples[n][1] = float64(r[d.blockPos]) / (1 << 15)
+		}
+	}
+	d.pos += int64(n)
+	return n, n > 0
+}
+func (d *flacDecoder) Err() error {
+	return d.err
+}
+func (d *flacDecoder) Len() int {
+	return int(d.info.totalSamples)
+}
+func (d *flacDecoder) Position() int {
+	return int(d.pos)
+}
+func (d *flacDecoder) Seek(p int) error {
+	if d.rs == nil {
+		return Error("FLAC data is not seekable")
+	}
+	// The last known frame starting at or before p
+	i := sort.Search(len(d.frames), func(i int) bool { return d.frames[i].sample > int64(p) }) - 1
+	if i < 0 {
+		i = 0
+	}
+	sp := d.frames[i]
+	if _, err := d.rs.Seek(sp.offset, io.SeekStart); err != nil {
+		return err
+	}
+	d.br.r.Reset(d.rs)
+	d.br.pos, d.err, d.block = sp.offset, nil, nil
+	d.pos = sp.sample
+	for d.pos < int64(p) {
+		if err := d.readFrame(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			d.err = err
+			return err
+		}
+		if skip := int64(p) - d.pos; skip < int64(len(d.block[0])) {
+			d.blockPos, d.pos = int(skip), int64(p)
+		} else {
+			d.blockPos, d.pos = len(d.block[0]), d.pos+int64(len(d.block[0]))
+		}
+	}
+	return nil
+}
+func (d *flacDecoder) Close() error {
+	if c, ok := d.rs.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------
+// Encoder
+
+type flacBitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (bw *flacBitWriter) bits(v uint64, n uint) {
+	for n > 32 {
+		bw.bits(v>>32, n-32)
+		v, n = v&(1<<32-1), 32
+	}
+	bw.acc = bw.acc<<n | v&(1<<n-1)
+	bw.n += n
+	for bw.n >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc>>(bw.n-8)))
+		bw.n -= 8
+	}
+	bw.acc &= 1<<bw.n - 1
+}
+func (bw *flacBitWriter) align() {
+	if bw.n > 0 {
+		bw.bits(0, 8-bw.n)
+	}
+}
+
+var flacCrc8Table, flacCrc16Table = func() (t8 [256]uint8, t16 [256]uint16) {
+	for i := range t8 {
+		c8, c16 := uint8(i), uint16(i)<<8
+		for j := 0; j < 8; j++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		t8[i], t16[i] = c8, c16
+	}
+	return
+}()
+
+func flacCrc8(data []byte) (crc uint8) {
+	for _, b := range data {
+		crc = flacCrc8Table[crc^b]
+	}
+	return
+}
+func flacCrc16(data []byte) (crc uint16) {
+	for _, b := range data {
+		crc = crc<<8 ^ flacCrc16Table[byte(crc>>8)^b]
+	}
+	return
+}
+
+// Writes the samples of every channel as a FLAC file.
+func flacEncode(w io.Writer, pcm [][]int32, sampleRate, bps int) error {
+	if len(pcm) == 0 || len(pcm) > 8 || bps < 4 || bps > 32 {
+		return Error("unsupported FLAC format")
+	}
+	total := len(pcm[0])
+	var bw flacBitWriter
+	bw.buf = append(bw.buf, "fLaC"...)
+	// The stream info, the only metadata block
+	bw.bits(0x80, 8) // Last block, STREAMINFO
+	bw.bits(34, 24)
+	bw.bits(16, 16)
+	bw.bits(flacBlockSize, 16)
+	bw.bits(0, 24)
+	bw.bits(0, 24)
+	bw.bits(uint64(sampleRate), 20)
+	bw.bits(uint64(len(pcm)-1), 3)
+	bw.bits(uint64(bps-1), 5)
+	bw.bits(uint64(total), 36)
+	bw.bits(0, 64) // No MD5 signature
+	bw.bits(0, 64)
+	if _, err := w.Write(bw.buf); err != nil {
+		return err
+	}
+	for frame, start := 0, 0; start < total; frame, start = frame+1, start+flacBlockSize {
+		size := Min(flacBlockSize, int32(total-start))
+		bw.buf = bw.buf[:0]
+		bw.bits(0xfff8, 16)
+		bw.bits(7, 4) // Block size in 16 bits after the header
+		bw.bits(0, 4)
+		bw.bits(uint64(len(pcm)-1), 4)
+		bw.bits(0, 4)
+		flacWriteUtf8(&bw, uint64(frame))
+		bw.bits(uint64(size-1), 16)
+		bw.bits(uint64(flacCrc8(bw.buf)), 8)
+		for _, ch := range pcm {
+			flacWriteSubframe(&bw, ch[start:start+int(size)], bps)
+		}
+		bw.align()
+		crc := flacCrc16(bw.buf)
+		bw.bits(uint64(crc), 16)
+		if _, err := w.Write(bw.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flacWriteUtf8(bw *flacBitWriter, v uint64) {
+	if v < 0x80 {
+		bw.bits(v, 8)
+		return
+	}
+	n := uint(2)
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	bw.bits(0xff<<(8-n)&0xff|v>>(6*(n-1)), 8)
+	for i := n - 1; i > 0; i-- {
+		bw.bits(0x80|v>>(6*(i-1))&0x3f, 8)
+	}
+}
+
+// Writes a subframe with the fixed predictor that leaves the smallest
+// residual, or as a constant or verbatim if that's smaller.
+func flacWriteSubframe(bw *flacBitWriter, s []int32, bps int) {
+	constant := true
+	for _, v := range s[1:] {
+		if v != s[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		bw.bits(0, 8)
+		bw.bits(uint64(s[0]), uint(bps))
+		return
+	}
+	best, bestOrder := uint64(len(s)*bps), -1
+	res := make([]int32, len(s))
+	var bestRes []int32
+	var bestParts []int
+	var bestPorder int
+	for order := 0; order <= 4 && order < len(s); order++ {
+		flacFixedResidual(s, res, order)
+		cost, porder, params := flacRiceCost(res[order:], len(s), order)
+		cost += uint64(order * bps)
+		if cost < best {
+			best, bestOrder, bestPorder, bestParts = cost, order, porder, params
+			bestRes = append(bestRes[:0], res...)
+		}
+	}
+	if bestOrder < 0 {
+		bw.bits(1<<1, 8)
+		for _, v := range s {
+			bw.bits(uint64(v), uint(bps))
+		}
+		return
+	}
+	bw.bits(uint64(8|bestOrder)<<1, 8)
+	for _, v := range s[:bestOrder] {
+		bw.bits(uint64(v), uint(bps))
+	}
+	bw.bits(0, 2)
+	bw.bits(uint64(bestPorder), 4)
+	i := bestOrder
+	for p, k := range bestParts {
+		n := len(s) >> bestPorder
+		if p == 0 {
+			n -= bestOrder
+		}
+		bw.bits(uint64(k), 4)
+		for _, r := range bestRes[i : i+n] {
+			u := uint64(uint32(r<<1) ^ uint32(r>>31))
+			q := u >> uint(k)
+			for ; q >= 32; q -= 32 {
+				bw.bits(0, 32)
+			}
+			bw.bits(1, uint(q)+1)
+			bw.bits(u, uint(k))
+		}
+		i += n
+	}
+}
+
+func flacFixedResidual(s, res []int32, order int) {
+	copy(res[:order], s)
+	for i := order; i < len(s); i++ {
+		switch order {
+		case 0:
+			res[i] = s[i]
+		case 1:
+			res[i] = s[i] - s[i-1]
+		case 2:
+			res[i] = s[i] - 2*s[i-1] + s[i-2]
+		case 3:
+			res[i] = s[i] - 3*s[i-1] + 3*s[i-2] - s[i-3]
+		case 4:
+			res[i] = s[i] - 4*s[i-1] + 6*s[i-2] - 4*s[i-3] + s[i-4]
+		}
+	}
+}
+
+// Returns the size in bits of the residual with the best partition order
+// and Rice parameters.
+func flacRiceCost(res []int32, size, order int) (best uint64, porder int, params []int) {
+	best = ^uint64(0)
+	for po := 0; po <= 8 && size%(1<<po) == 0 && size>>po > order; po++ {
+		cost := uint64(6)
+		var ps []int
+		i := 0
+		for p := 0; p < 1<<po; p++ {
+			n := size >> po
+			if p == 0 {
+				n -= order
+			}
+			var sum uint64
+			for _, r := range res[i : i+n] {
+				sum += uint64(uint32(r<<1) ^ uint32(r>>31))
+			}
+			// Try the parameters around the one the mean suggests
+			k0 := int32(0)
+			if n > 0 && sum/uint64(n) > 0 {
+				k0 = Min(int32(bits.Len64(sum/uint64(n)))-1, 14)
+			}
+			bk, bc := 0, ^uint64(0)
+			for k := Max(k0-1, 0); k <= Min(k0+1, 14); k++ {
+				c := uint64(4 + n*(int(k)+1))
+				for _, r := range res[i : i+n] {
+					c += uint64(uint32(r<<1)^uint32(r>>31)) >> uint(k)
+				}
+				if c < bc {
+					bk, bc = int(k), c
+				}
+			}
+			cost += bc
+			ps = append(ps, bk)
+			i += n
+		}
+		if cost < best {
+			best, porder, params = cost, po, ps
+		}
+	}
+	return
+}
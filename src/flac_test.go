@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ikemen-engine/beep"
+)
+
+// FLAC files made by testdata/generate.py with an encoder of its own. Between
+// them they use every channel assignment, subframe type and block size code,
+// LPC up to order 32, wasted bits and escaped Rice partitions. md5 is the
+// checksum of the samples flacDecode must stream, computed from the source
+// samples, as little endian 16-bit pairs.
+var flacTests = []struct {
+	file    string
+	samples int
+	md5     string
+}{
+	{"stereo16.flac", 18205, "9f1e0d499d434507ff0eacdd48cfe8d6"},
+	{"mono24.flac", 15258, "7be893fcbe864f5936cb594c457656db"},
+	{"stereo12.flac", 11742, "6a09ae549d12d7f87905cbb794a76d9a"},
+}
+
+// Streams s to its end as little endian 16-bit pairs.
+func streamPcm16(t *testing.T, s beep.Streamer) []byte {
+	var out []byte
+	var buf [1000][2]float64
+	for {
+		n, ok := s.Stream(buf[:])
+		for _, v := range buf[:n] {
+			for c := 0; c < 2; c++ {
+				out = binary.LittleEndian.AppendUint16(out, uint16(int16(math.Round(v[c]*(1<<15)))))
+			}
+		}
+		if !ok || n == 0 {
+			break
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestFlacDecode(t *testing.T) {
+	for _, ft := range flacTests {
+		t.Run(ft.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "flac", ft.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			d, _, err := flacDecode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Len() != ft.samples {
+				t.Fatalf("Len() = %v, want %v", d.Len(), ft.samples)
+			}
+			pcm := streamPcm16(t, d)
+			if len(pcm) != ft.samples*4 {
+				t.Fatalf("decoded %v samples, want %v", len(pcm)/4, ft.samples)
+			}
+			if sum := md5.Sum(pcm); hex.EncodeToString(sum[:]) != ft.md5 {
+				t.Fatalf("decoded samples checksum %x, want %v", sum, ft.md5)
+			}
+			// Seeking back into frames already decoded, and forward past
+			// frames not decoded yet
+			f.Seek(0, 0)
+			d2, _, err := flacDecode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []int{ft.samples / 2, 0, 4097, ft.samples - 10, 191, ft.samples} {
+				if err := d2.Seek(p); err != nil {
+					t.Fatalf("Seek(%v): %v", p, err)
+				}
+				if got := streamPcm16(t, d2); !bytes.Equal(got, pcm[p*4:]) {
+					t.Fatalf("samples after Seek(%v) differ", p)
+				}
+			}
+		})
+	}
+}
+
+// Samples written by flacEncode, as packSnd does, must decode unchanged.
+func TestFlacEncode(t *testing.T) {
+	for _, channels := range []int{1, 2} {
+		pcm := make([][]int32, channels)
+		for ch := range pcm {
+			pcm[ch] = make([]int32, 3*flacBlockSize+123)
+			for i := range pcm[ch] {
+				v := 12000*math.Sin(float64(i)*0.05*float64(ch+1)) + float64(i*7919%301-150)
+				// A silent block for constant subframes
+				if i >= flacBlockSize && i < 2*flacBlockSize {
+					v = 0
+				}
+				pcm[ch][i] = int32(v)
+			}
+		}
+		var buf bytes.Buffer
+		if err := flacEncode(&buf, pcm, 22050, 16); err != nil {
+			t.Fatal(err)
+		}
+		d, format, err := flacDecode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format.SampleRate != 22050 || format.NumChannels != channels {
+			t.Fatalf("format %+v", format)
+		}
+		var want []byte
+		for i := range pcm[0] {
+			for c := 0; c < 2; c++ {
+				want = binary.LittleEndian.AppendUint16(want, uint16(pcm[c*(channels-1)][i]))
+			}
+		}
+		if got := streamPcm16(t, d); !bytes.Equal(got, want) {
+			t.Fatalf("%v channels: decoded samples differ", channels)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// HotReload watches the code and animation files of the loaded characters
+// and reloads them in place during a match, without resetting the round.
+// Changed .def, .cns, .zss, .cmd and .st files recompile the character's
+// states, while changed .air files only rebuild its animation table. Files
+// are polled once per second, which is cheap and needs no OS support.
+type HotReload struct {
+	enabled bool
+	timer   int
+	slots   [MaxSimul*2 + MaxAttachedChar]hotReloadSlot
+	modules map[string]time.Time
+}
+
+type hotReloadSlot struct {
+	def   string
+	anim  string
+	code  map[string]time.Time
+	anims map[string]time.Time
+}
+
+func fileModTime(filename string) time.Time {
+	if fi, err := os.Stat(filename); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// Returns whether any of the files changed since the last call, updating
+// the stored modification times.
+func hotReloadChanged(times map[string]time.Time) (changed bool) {
+	for f, t := range times {
+		if mt := fileModTime(f); !mt.Equal(t) {
+			times[f] = mt
+			changed = true
+		}
+	}
+	return
+}
+
+// Collects the files a character is compiled from, the same way Char.load
+// and Compiler.Compile look them up.
+func (sl *hotReloadSlot) watch(pn int) {
+	gi := &sys.cgi[pn]
+	sl.def, sl.anim = gi.def, ""
+	sl.code = map[string]time.Time{gi.def: fileModTime(gi.def)}
+	sl.anims = make(map[string]time.Time)
+	add := func(times map[string]time.Time, file string, dirs []string) {
+		for _, f := range []string{file, file + ".zss"} {
+			if fp := FileExist(SearchFile(f, dirs)); len(fp) > 0 {
+				times[fp] = fileModTime(fp)
+			}
+		}
+	}
+	charDirs := []string{gi.def, "", sys.motifDir, "data/"}
+	commonDirs := []string{gi.def, sys.motifDir, sys.lifebar.def, "", "data/"}
+	if str, err := LoadText(gi.def); err == nil {
+		lines, i := SplitAndTrim(str, "\n"), 0
+		for i < len(lines) {
+			is, name, _ := ReadIniSection(lines, &i)
+			if name != "files" {
+				continue
+			}
+			for _, k := range []string{"cmd", "st", "stcommon"} {
+				if len(is[k]) > 0 {
+					add(sl.code, is[k], charDirs)
+				}
+			}
+			for j := 0; j < 10; j++ {
+				if f := is[fmt.Sprintf("st%v", j)]; len(f) > 0 {
+					add(sl.code, f, charDirs)
+				}
+			}
+			if sl.anim = is["anim"]; len(sl.anim) > 0 {
+				add(sl.anims, sl.anim, charDirs)
+			}
+			break
+		}
+	}
+	for _, s := range sys.commonStates {
+		add(sl.code, s, commonDirs)
+	}
+	for _, s := range sys.commonCmd {
+		add(sl.code, s, commonDirs)
+	}
+	for _, s := range sys.commonAir {
+		add(sl.anims, s, commonDirs)
+	}
+}
+
+func (hr *HotReload) update() {
+	if !hr.enabled {
+		return
+	}
+	if hr.timer--; hr.timer > 0 {
+		return
+	}
+	hr.timer = FPS
+	// ZSS modules are shared, so a changed module reloads every character
+	if hr.modules == nil {
+		hr.modules = make(map[string]time.Time)
+	}
+	for f := range zssModuleFiles {
+		if _, ok := hr.modules[f]; !ok {
+			hr.modules[f] = fileModTime(f)
+		}
+	}
+	modules := hotReloadChanged(hr.modules)
+	for pn, p := range sys.chars {
+		if len(p) == 0 || sys.cgi[pn].states == nil {
+			continue
+		}
+		sl := &hr.slots[pn]
+		if sl.def != sys.cgi[pn].def {
+			sl.watch(pn)
+			continue
+		}
+		code, anims := hotReloadChanged(sl.code), hotReloadChanged(sl.anims)
+		if anims {
+			hr.reloadAnimations(pn)
+		}
+		if code || modules {
+			hr.reloadStates(pn)
+		}
+		if code || anims {
+			// The list of files may have changed along with the def file
+			sl.watch(pn)
+		}
+	}
+}
+
+func (hr *HotReload) reloadAnimations(pn int) {
+	gi := &sys.cgi[pn]
+	if err := gi.loadAnimations(gi.def, hr.slots[pn].anim); err != nil {
+		hr.error(pn, err)
+		return
+	}
+	sys.appendToConsole(fmt.Sprintf("Reloaded animations of P%v %v (applied on next ChangeAnim)",
+		pn+1, gi.displayname))
+}
+
+// Recompiles the character's states and swaps them in. Position, life,
+// variables and the round timer are untouched. If compiling fails, the
+// previous states keep running and the error is shown in the console.
+func (hr *HotReload) reloadStates(pn int) {
+	gi, c := &sys.cgi[pn], sys.chars[pn][0]
+	oldPool, oldWakawaka, oldLayout := sys.stringPool[pn], gi.wakewakaLength, gi.namedVars
+	oldCmd := c.cmd[pn]
+	c.cmd[pn] = *NewCommandList(oldCmd.Buffer)
+	states, err := func() (states map[int32]StateBytecode, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		return newCompiler().Compile(pn, gi.def, gi.constants)
+	}()
+	if err != nil {
+		sys.stringPool[pn], gi.wakewakaLength, gi.namedVars = oldPool, oldWakawaka, oldLayout
+		c.cmd[pn] = oldCmd
+		hr.error(pn, err)
+		return
+	}
+	gi.states = states
+	// Other players keep their own copy of this player's commands
+	for i, p := range sys.chars {
+		if i != pn && len(p) > 0 && pn < len(p[0].cmd) {
+			p[0].cmd[pn].CopyList(c.cmd[pn])
+		}
+	}
+	// Characters in one of this player's states continue with the new code
+	for _, p := range sys.chars {
+		for _, ch := range p {
+			if ch.ss.sb.playerNo == pn {
+				if sb, ok := states[ch.ss.no]; ok {
+					ch.ss.sb = sb
+				}
+			}
+		}
+	}
+	sys.appendToConsole(fmt.Sprintf("Reloaded states of P%v %v", pn+1, gi.displayname))
+}
+
+func (hr *HotReload) error(pn int, err error) {
+	sys.errLog.Printf("Hot reload of %v failed: %v\n", sys.cgi[pn].def, err)
+	sys.appendToConsole(fmt.Sprintf("Hot reload of P%v failed:", pn+1))
+	for _, l := range strings.Split(strings.TrimSpace(err.Error()), "\n") {
+		sys.appendToConsole(l)
+	}
+}
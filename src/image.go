@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"image"
@@ -10,6 +11,8 @@ import (
 	"math"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -450,6 +453,8 @@ type Sprite struct {
 	coldepth      byte
 	paltemp       []uint32
 	PalTex        *Texture
+	atlas         *SpriteAtlas
+	scale         float32
 }
 
 func newSprite() *Sprite {
@@ -521,7 +526,7 @@ func newSprite() *Sprite {
 						return nil, err
 					}
 				case 2:
-					if err := s.readV2(f, int64(xofs), size); err != nil {
+					if err := s.readV2(f, int64(xofs), size, nil); err != nil {
 						return nil, err
 					}
 				}
@@ -593,6 +598,16 @@ func (s *Sprite) shareCopy(src *Sprite) {
 	//s.paltemp = src.paltemp
 	//s.PalTex = src.PalTex
 }
+
+// Returns the size of a texel in sprite units. High resolution sprites are
+// drawn smaller by their scale, so that they cover the same area as the
+// sprites they replace.
+func (s *Sprite) texelScale() float32 {
+	if s.scale > 0 {
+		return 1 / s.scale
+	}
+	return 1
+}
 func (s *Sprite) GetPal(pl *PaletteList) []uint32 {
 	if s.Pal != nil || s.coldepth > 8 {
 		return s.Pal
@@ -614,6 +629,11 @@ func (s *Sprite) SetPxl(px []byte) {
 		return
 	}
 	sys.mainThreadTask <- func() {
+		if s.atlas != nil {
+			if s.Tex = s.atlas.add(int32(s.Size[0]), int32(s.Size[1]), 8, px); s.Tex != nil {
+				return
+			}
+		}
 		s.Tex = newTexture(int32(s.Size[0]), int32(s.Size[1]), 8, false)
 		s.Tex.SetData(px)
 	}
@@ -621,6 +641,11 @@ func (s *Sprite) SetPxl(px []byte) {
 
 func (s *Sprite) SetRaw(data []byte, sprWidth int32, sprHeight int32, sprDepth int32) {
 	sys.mainThreadTask <- func() {
+		if s.atlas != nil {
+			if s.Tex = s.atlas.add(sprWidth, sprHeight, sprDepth, data); s.Tex != nil {
+				return
+			}
+		}
 		s.Tex = newTexture(sprWidth, sprHeight, sprDepth, sys.pngFilter)
 		s.Tex.SetData(data)
 	}
@@ -723,6 +748,17 @@ func (s *Sprite) RlePcxDecode(rle []byte) (p []byte) {
 }
 func (s *Sprite) read(f *os.File, sh *SffHeader, offset int64, datasize uint32,
 	nextSubheader uint32, prev *Sprite, pl *PaletteList, c00 bool) error {
+	px, err := s.readPcx(f, sh, offset, datasize, nextSubheader, prev, pl, c00)
+	if err != nil {
+		return err
+	}
+	s.SetPxl(px)
+	return nil
+}
+
+// Reads the palette and the decoded pixels of an SFF v1 sprite.
+func (s *Sprite) readPcx(f *os.File, sh *SffHeader, offset int64, datasize uint32,
+	nextSubheader uint32, prev *Sprite, pl *PaletteList, c00 bool) ([]byte, error) {
 	if int64(nextSubheader) > offset {
 		// 最後以外datasizeを無視 / Ignore datasize except last
 		datasize = nextSubheader - uint32(offset)
@@ -732,11 +768,11 @@ func (s *Sprite) read(f *os.File, sh *SffHeader, offset int64, datasize uint32,
 	}
 	var ps byte
 	if err := read(&ps); err != nil {
-		return err
+		return nil, err
 	}
 	paletteSame := ps != 0 && prev != nil
 	if err := s.readPcxHeader(f, offset); err != nil {
-		return err
+		return nil, err
 	}
 	f.Seek(offset+128, 0)
 	var palSize uint32
@@ -750,7 +786,7 @@ func (s *Sprite) read(f *os.File, sh *SffHeader, offset int64, datasize uint32,
 	}
 	px := make([]byte, datasize-(128+palSize))
 	if err := read(px); err != nil {
-		return err
+		return nil, err
 	}
 	if paletteSame {
 		if prev != nil {
@@ -768,13 +804,12 @@ func (s *Sprite) read(f *os.File, sh *SffHeader, offset int64, datasize uint32,
 		var rgb [3]byte
 		for i := range pal {
 			if err := read(rgb[:]); err != nil {
-				return err
+				return nil, err
 			}
 			pal[i] = uint32(255)<<24 | uint32(rgb[2])<<16 | uint32(rgb[1])<<8 | uint32(rgb[0])
 		}
 	}
-	s.SetPxl(s.RlePcxDecode(px))
-	return nil
+	return s.RlePcxDecode(px), nil
 }
 func (s *Sprite) readHeaderV2(r io.Reader, ofs *uint32, size *uint32,
 	lofs uint32, tofs uint32, link *uint16) error {
@@ -971,26 +1006,47 @@ func (s *Sprite) Lz5Decode(rle []byte) (p []byte) {
 	}
 	return
 }
-func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
-	var px []byte
-	var isRaw bool = false
+func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32,
+	dc *SpriteCacheEntry) error {
+	px, w, h, depth, ok := dc.get(offset)
+	if !ok {
+		var err error
+		if px, w, h, depth, err = s.decodeV2(f, offset, datasize); err != nil {
+			return err
+		}
+		dc.put(offset, px, w, h, depth)
+	}
+	if depth > 8 {
+		s.SetRaw(px, w, h, depth)
+	} else {
+		s.SetPxl(px)
+	}
+	return nil
+}
+
+// Reads and decompresses the data of an SFF v2 sprite. 8-bit sprites return
+// their palette indices, others their pixels in the returned color depth.
+func (s *Sprite) decodeV2(f *os.File, offset int64, datasize uint32) (px []byte,
+	w, h, depth int32, err error) {
+	w, h, depth = int32(s.Size[0]), int32(s.Size[1]), 8
 
 	if s.rle > 0 {
-		return nil
+		return
 
 	} else if s.rle == 0 {
 		f.Seek(offset, 0)
 		px = make([]uint8, datasize)
-		binary.Read(f, binary.LittleEndian, px)
+		if err := binary.Read(f, binary.LittleEndian, px); err != nil {
+			return nil, 0, 0, 0, err
+		}
 
 		switch s.coldepth {
 		case 8:
 			// Do nothing, px is already in the expected format
 		case 24, 32:
-			isRaw = true
-			s.SetRaw(px, int32(s.Size[0]), int32(s.Size[1]), int32(s.coldepth))
+			depth = int32(s.coldepth)
 		default:
-			return Error("Unknown color depth")
+			return nil, 0, 0, 0, Error("Unknown color depth")
 		}
 
 	} else {
@@ -1006,8 +1062,7 @@ func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
 			}
 			px = make([]byte, datasize-4)
 			if err := binary.Read(f, binary.LittleEndian, px); err != nil {
-				panic(err)
-				//return err
+				return nil, 0, 0, 0, err
 			}
 		}
 
@@ -1021,7 +1076,7 @@ func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
 		case 10:
 			img, err := png.Decode(f)
 			if err != nil {
-				return err
+				return nil, 0, 0, 0, err
 			}
 			pi, ok := img.(*image.Paletted)
 			if ok {
@@ -1029,12 +1084,11 @@ func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
 			}
 		case 11, 12:
 			var ok bool = false
-			isRaw = true
 
 			// Decode PNG image to RGBA
 			img, err := png.Decode(f)
 			if err != nil {
-				return err
+				return nil, 0, 0, 0, err
 			}
 
 			rect = img.Bounds()
@@ -1044,16 +1098,12 @@ func (s *Sprite) readV2(f *os.File, offset int64, datasize uint32) error {
 				rgba = image.NewRGBA(rect)
 				draw.Draw(rgba, rect, img, rect.Min, draw.Src)
 			}
-			s.SetRaw(rgba.Pix, int32(rect.Max.X-rect.Min.X), int32(rect.Max.Y-rect.Min.Y), 32)
+			px, w, h, depth = rgba.Pix, int32(rect.Max.X-rect.Min.X), int32(rect.Max.Y-rect.Min.Y), 32
 		default:
-			return Error("Unknown format")
+			return nil, 0, 0, 0, Error("Unknown format")
 		}
 	}
-
-	if !isRaw {
-		s.SetPxl(px)
-	}
-	return nil
+	return
 }
 
 // Cache the provided palette data in a sprite. But first check if the
@@ -1079,6 +1129,7 @@ func (s *Sprite) CachePalette(pal []uint32) *Texture {
 }
 
 func (s *Sprite) Draw(x, y, xscale, yscale, angle float32, fx *PalFX, window *[4]int32) {
+	xscale, yscale = xscale*s.texelScale(), yscale*s.texelScale()
 	x += float32(sys.gameWidth-320)/2 - xscale*float32(s.Offset[0])
 	y += float32(sys.gameHeight-240) - yscale*float32(s.Offset[1])
 	if xscale < 0 {
@@ -1103,6 +1154,7 @@ type Sff struct {
 	palList PaletteList
 	//This is the sffCache key
 	filename string
+	atlas    *SpriteAtlas
 }
 type Palette struct {
 	palList PaletteList
@@ -1138,6 +1190,55 @@ func removeSFFCache(filename string) {
 		delete(SffCache, filename)
 	}
 }
+
+// Reads the scale of high resolution sprites from the file next to an SFF
+// with .scale appended to its name, if any. Each line is either
+// "scale = n" for every sprite, "group, number, n" for a single sprite or
+// "group, -1, n" for a whole group, n being how many times the sprite's
+// resolution is higher than the one the AIR file was written for.
+func loadSpriteScales(filename string, sprites map[[2]int16]*Sprite) error {
+	str, err := LoadText(filename + ".scale")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var all float32
+	groups, single := make(map[int16]float32), make(map[[2]int16]float32)
+	for i, line := range SplitAndTrim(str, "\n") {
+		if j := strings.IndexByte(line, ';'); j >= 0 {
+			line = strings.TrimSpace(line[:j])
+		}
+		if line == "" {
+			continue
+		}
+		if kv := SplitAndTrim(line, "="); len(kv) == 2 && strings.ToLower(kv[0]) == "scale" {
+			all = float32(Atof(kv[1]))
+			continue
+		}
+		f := SplitAndTrim(line, ",")
+		if len(f) != 3 || float32(Atof(f[2])) <= 0 {
+			return Error(fmt.Sprintf("%v.scale:%v: invalid line: %v", filename, i+1, line))
+		}
+		g, n, scl := I32ToI16(Atoi(f[0])), I32ToI16(Atoi(f[1])), float32(Atof(f[2]))
+		if n == -1 {
+			groups[g] = scl
+		} else {
+			single[[...]int16{g, n}] = scl
+		}
+	}
+	for gn, s := range sprites {
+		if scl, ok := single[gn]; ok {
+			s.scale = scl
+		} else if scl, ok := groups[gn[0]]; ok {
+			s.scale = scl
+		} else if all > 0 {
+			s.scale = all
+		}
+	}
+	return nil
+}
 func loadSff(filename string, char bool) (*Sff, error) {
 	// If this SFF is already in the cache, just return a copy
 	if cached, ok := SffCache[filename]; ok {
@@ -1147,11 +1248,19 @@ func loadSff(filename string, char bool) (*Sff, error) {
 	}
 	s := newSff()
 	s.filename = filename
+	if sys.spriteAtlas {
+		s.atlas = newSpriteAtlas()
+	}
 	f, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer func() { chk(f.Close()) }()
+	var pf *LoadProgressFile
+	if fi, err := f.Stat(); err == nil {
+		pf = sys.loadProgress.add(filename, fi.Size())
+		defer sys.loadProgress.finish(pf)
+	}
 	var lofs, tofs uint32
 	if err := s.header.Read(f, &lofs, &tofs); err != nil {
 		return nil, err
@@ -1159,6 +1268,8 @@ func loadSff(filename string, char bool) (*Sff, error) {
 	read := func(x interface{}) error {
 		return binary.Read(f, binary.LittleEndian, x)
 	}
+	dc := sys.spriteCache.open(filename, f, &s.header)
+	defer dc.close()
 	if s.header.Ver0 != 1 {
 		uniquePals := make(map[[2]int16]int)
 		for i := 0; i < int(s.header.NumberOfPalettes); i++ {
@@ -1221,9 +1332,14 @@ func loadSff(filename string, char bool) (*Sff, error) {
 	spriteList := make([]*Sprite, int(s.header.NumberOfSprites))
 	var prev *Sprite
 	shofs := int64(s.header.FirstSpriteHeaderOffset)
+	// v2 sprites are decoded in parallel once all headers are read, and
+	// linked sprites can only share their textures after that
+	var jobs []sffDecodeJob
+	var links [][2]*Sprite
 	for i := 0; i < len(spriteList); i++ {
 		f.Seek(shofs, 0)
 		spriteList[i] = newSprite()
+		spriteList[i].atlas = s.atlas
 		var xofs, size uint32
 		var indexOfPrevious uint16
 		switch s.header.Ver0 {
@@ -1241,8 +1357,12 @@ func loadSff(filename string, char bool) (*Sff, error) {
 		if size == 0 {
 			if int(indexOfPrevious) < i {
 				dst, src := spriteList[i], spriteList[int(indexOfPrevious)]
-				sys.mainThreadTask <- func() {
-					dst.shareCopy(src)
+				if s.header.Ver0 == 1 {
+					sys.mainThreadTask <- func() {
+						dst.shareCopy(src)
+					}
+				} else {
+					links = append(links, [...]*Sprite{dst, src})
 				}
 			} else {
 				spriteList[i].palidx = 0 // 不正な sff の場合の index out of range 防止
@@ -1256,10 +1376,9 @@ func loadSff(filename string, char bool) (*Sff, error) {
 						spriteList[i].Number == 0)); err != nil {
 					return nil, err
 				}
+				sys.loadProgress.advance(pf, int64(size))
 			case 2:
-				if err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
-					return nil, err
-				}
+				jobs = append(jobs, sffDecodeJob{spriteList[i], int64(xofs), size})
 			}
 			prev = spriteList[i]
 		}
@@ -1274,6 +1393,20 @@ func loadSff(filename string, char bool) (*Sff, error) {
 			shofs += 28
 		}
 	}
+	if len(jobs) > 0 {
+		if err := decodeSpritesV2(filename, jobs, pf, dc); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range links {
+		dst, src := l[0], l[1]
+		sys.mainThreadTask <- func() {
+			dst.shareCopy(src)
+		}
+	}
+	if err := loadSpriteScales(filename, s.sprites); err != nil {
+		return nil, err
+	}
 	SffCache[filename] = &SffCacheEntry{*s, 1}
 	runtime.SetFinalizer(s, func(s *Sff) {
 		if cached, ok := SffCache[filename]; ok {
@@ -1304,6 +1437,8 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff,
 	read := func(x interface{}) error {
 		return binary.Read(f, binary.LittleEndian, x)
 	}
+	dc := sys.spriteCache.open(filename, f, h)
+	defer dc.close()
 	var shofs, xofs, size uint32 = h.FirstSpriteHeaderOffset, 0, 0
 	var indexOfPrevious uint16
 	var plShofs, plXofs, plSize uint32 = h.FirstPaletteHeaderOffset, 0, 0
@@ -1354,7 +1489,7 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff,
 						return nil, nil, err
 					}
 				case 2:
-					if err := spriteList[i].readV2(f, int64(xofs), size); err != nil {
+					if err := spriteList[i].readV2(f, int64(xofs), size, dc); err != nil {
 						return nil, nil, err
 					}
 				}
@@ -1436,6 +1571,9 @@ func preloadSff(filename string, char bool, preloadSpr map[[2]int16]bool) (*Sff,
 			}
 		}
 	}
+	if err := loadSpriteScales(filename, sff.sprites); err != nil {
+		return nil, nil, err
+	}
 	return sff, selPal, nil
 }
 func (s *Sff) GetSprite(g, n int16) *Sprite {
@@ -1455,11 +1593,21 @@ func (s *Sff) getOwnPalSprite(g, n int16, pl *PaletteList) *Sprite {
 	copy(osp.Pal, pal)
 	return &osp
 }
+
+// Saves a screenshot named after the current time, with the state of the
+// game it was taken in stored in PNG text chunks.
 func captureScreen() {
 	width, height := sys.window.GetSize()
+	if sys.screenshotGameRes {
+		width, height = int(sys.scrrect[2]), int(sys.scrrect[3])
+	}
 	pixdata := make([]uint8, 4*width*height)
 	img := image.NewNRGBA(image.Rect(0, 0, width, height))
-	gfx.ReadPixels(pixdata, width, height)
+	if sys.screenshotGameRes {
+		gfx.ReadGamePixels(pixdata, width, height)
+	} else {
+		gfx.ReadPixels(pixdata, width, height)
+	}
 	for i := 0; i < 4*width*height; i++ {
 		var x, y, j int
 		x = i % (width * 4)
@@ -1470,14 +1618,69 @@ func captureScreen() {
 		}
 		img.Pix[j] = pixdata[i]
 	}
-	for i := sys.captureNum; i < 999; i++ {
-		filename := fmt.Sprintf("%sikemen%03d.png", sys.screenshotFolder, i)
+	base := sys.screenshotFolder + "ikemen_" + time.Now().Format("2006-01-02_15-04-05")
+	filename := base + ".png"
+	for i := 2; ; i++ {
 		if _, err := os.Stat(filename); os.IsNotExist(err) {
-			file, _ := os.Create(filename)
-			defer file.Close()
-			png.Encode(file, img)
-			sys.captureNum = i
 			break
 		}
+		filename = fmt.Sprintf("%v_%v.png", base, i)
+	}
+	if err := writePngText(filename, img, screenshotText()); err != nil {
+		sys.errLog.Printf("Failed to save screenshot %v: %v\n", filename, err)
+	}
+}
+
+// Returns the keywords and text describing the game state of a screenshot.
+func screenshotText() (text [][2]string) {
+	text = append(text, [2]string{"Software", "I.K.E.M.E.N-Go " + Version})
+	if sys.gameMode != "" {
+		text = append(text, [2]string{"Mode", sys.gameMode})
+	}
+	for i, p := range sys.chars {
+		if len(p) > 0 {
+			text = append(text, [2]string{fmt.Sprintf("P%v", i+1),
+				fmt.Sprintf("%v (%v)", p[0].gi().displayname, p[0].gi().def)})
+		}
+	}
+	if sys.stage != nil {
+		text = append(text, [2]string{"Stage",
+			fmt.Sprintf("%v (%v)", sys.stage.displayname, sys.stage.def)})
+	}
+	text = append(text, [2]string{"Round", fmt.Sprint(sys.round)},
+		[2]string{"Frame", fmt.Sprint(sys.frameCounter)})
+	if sys.fileInput != nil && sys.fileInput.f != nil {
+		text = append(text, [2]string{"Replay", sys.fileInput.f.Name()})
+	} else if sys.netInput != nil && sys.netInput.rep != nil {
+		text = append(text, [2]string{"Replay", sys.netInput.rep.Name()})
+	}
+	return
+}
+
+// Writes a PNG file with tEXt chunks added after its header.
+func writePngText(filename string, img image.Image, text [][2]string) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	// The signature and IHDR, which must come first
+	data := buf.Bytes()
+	hdrLen := 8 + 12 + int(binary.BigEndian.Uint32(data[8:]))
+	_, err = f.Write(data[:hdrLen])
+	for _, t := range text {
+		if err == nil {
+			err = writePngChunk(f, "tEXt", []byte(t[0]+"\x00"+t[1]))
+		}
+	}
+	if err == nil {
+		_, err = f.Write(data[hdrLen:])
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
+	return err
 }
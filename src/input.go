@@ -127,6 +127,9 @@ func OnKeyPressed(key Key, mk ModifierKey) {
 		if key == KeyF12 {
 			captureScreen()
 		}
+		if sys.palEditor.enabled {
+			sys.palEditor.key(key, mk)
+		}
 		if key == KeyEnter && (mk&ModAlt) != 0 {
 			sys.window.toggleFullscreen()
 		}
@@ -1498,6 +1501,8 @@ func (cl *CommandList) Input(i int, facing int32, aiLevel float32, ib InputBits)
 	}
 	_else := i < 0
 	if _else {
+	} else if sys.charTest != nil {
+		sys.charTest.Input(cl.Buffer, i, facing)
 	} else if sys.fileInput != nil {
 		sys.fileInput.Input(cl.Buffer, i, facing)
 	} else if sys.netInput != nil {
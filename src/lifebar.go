@@ -1669,13 +1669,13 @@ func (ac *LifeBarAction) draw(layerno int16, f []*Fnt, side int) {
 		if v.bg.anim.spr != nil {
 			v.bg.Draw(x+sys.lifebarOffsetX+float32(k)*float32(ac.spacing[0]),
 				float32(ac.pos[1])+float32(k)*float32(ac.spacing[1])+
-					float32(k)*(float32(v.bg.anim.spr.Size[1])*v.bg.lay.scale[1]),
+					float32(k)*(float32(v.bg.anim.spr.Size[1])*v.bg.anim.spr.texelScale()*v.bg.lay.scale[1]),
 				layerno, sys.lifebarScale)
 		}
 		if v.front.anim.spr != nil {
 			v.front.Draw(x+sys.lifebarOffsetX+float32(k)*float32(ac.spacing[0]),
 				float32(ac.pos[1])+float32(k)*float32(ac.spacing[1])+
-					float32(k)*(float32(v.front.anim.spr.Size[1])*v.front.lay.scale[1]),
+					float32(k)*(float32(v.front.anim.spr.Size[1])*v.front.anim.spr.texelScale()*v.front.lay.scale[1]),
 				layerno, sys.lifebarScale)
 		}
 		if ac.text.font[0] >= 0 && int(ac.text.font[0]) < len(f) && f[ac.text.font[0]] != nil {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ikemen-engine/beep"
+)
+
+// Number of samples compared around each loop point.
+const loopTestLen = 4096
+
+// Checks that music files seek and loop sample accurately in every format
+// decodeBgm supports. The samples around two loop points are decoded
+// straight through, then compared with the ones streamed after seeking to
+// the loop start, as startPosition does, and with the ones bgmLooper streams
+// across the loop end. path is a music file or a directory of them. MIDI
+// files only pass if nothing rings across the loop points, such as reverb
+// or a held note, since the synthesizer carries it over.
+func runLoopTests(path string) bool {
+	files := []string{path}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		files = nil
+		filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && (HasExtension(p, ".ogg") || HasExtension(p, ".mp3") ||
+				HasExtension(p, ".wav") || HasExtension(p, ".flac") || HasExtension(p, ".opus") ||
+				HasExtension(p, ".mid") || HasExtension(p, ".midi")) {
+				files = append(files, filepath.ToSlash(p))
+			}
+			return nil
+		})
+		sort.Strings(files)
+	}
+	passed := 0
+	for _, f := range files {
+		if err := loopTest(f); err != nil {
+			fmt.Printf("FAIL  %v\n      %v\n", f, err.Error())
+		} else {
+			fmt.Printf("ok    %v\n", f)
+			passed++
+		}
+	}
+	fmt.Printf("%v/%v files passed\n", passed, len(files))
+	return passed == len(files)
+}
+
+func loopTest(filename string) error {
+	open := func() (beep.StreamSeekCloser, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		s, _, _, err := decodeBgm(f, filename, sys.soundFont)
+		if err != nil {
+			f.Close()
+		}
+		return s, err
+	}
+	// Fills samples, unless the stream ends first
+	read := func(s beep.Streamer, samples [][2]float64) [][2]float64 {
+		n := 0
+		for n < len(samples) {
+			sn, ok := s.Stream(samples[n:])
+			if !ok || sn == 0 {
+				break
+			}
+			n += sn
+		}
+		return samples[:n]
+	}
+	discard := func(s beep.Streamer, n int) {
+		buf := make([][2]float64, loopTestLen)
+		for n > 0 {
+			if n < len(buf) {
+				buf = buf[:n]
+			}
+			got := read(s, buf)
+			if len(got) == 0 {
+				return
+			}
+			n -= len(got)
+		}
+	}
+	compare := func(what string, got, want [][2]float64) error {
+		if len(got) != len(want) {
+			return Error(fmt.Sprintf("%v: got %v samples instead of %v", what, len(got), len(want)))
+		}
+		for i := range want {
+			for c := 0; c < 2; c++ {
+				// Allow the rounding error of a 16-bit sample
+				if d := math.Abs(got[i][c] - want[i][c]); d > 1.0/32768 {
+					return Error(fmt.Sprintf("%v: sample %v differs by %.6f", what, i, d))
+				}
+			}
+		}
+		return nil
+	}
+
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	length := s.Len()
+	if length < loopTestLen*4 {
+		s.Close()
+		return Error(fmt.Sprintf("too short to test, %v samples", length))
+	}
+	// The file's own loop points, if they leave room to compare samples
+	start, end := length/3, length*2/3
+	if ls, le, ok := bgmLoopPoints(filename); ok {
+		if le <= 0 {
+			le = length
+		}
+		if ls >= 0 && le <= length && le-ls >= 2*loopTestLen {
+			start, end = ls, le
+		}
+	}
+	// Reference samples after the loop start and before the loop end
+	refStart := make([][2]float64, loopTestLen)
+	refEnd := make([][2]float64, loopTestLen)
+	discard(s, start)
+	read(s, refStart)
+	discard(s, end-loopTestLen-start-loopTestLen)
+	read(s, refEnd)
+	s.Close()
+
+	if s, err = open(); err != nil {
+		return err
+	}
+	if err := s.Seek(start); err != nil {
+		s.Close()
+		return err
+	}
+	err = compare(fmt.Sprintf("seeking to %v", start), read(s, make([][2]float64, loopTestLen)), refStart)
+	s.Close()
+	if err != nil {
+		return err
+	}
+
+	if s, err = open(); err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.Seek(end - loopTestLen); err != nil {
+		return err
+	}
+	looper := BgmLooper(s, -1, start, end)
+	return compare(fmt.Sprintf("looping from %v to %v", end, start),
+		read(looper, make([][2]float64, 2*loopTestLen)), append(refEnd, refStart...))
+}
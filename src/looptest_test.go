@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Music files made by testdata/generate.py, with the loop points they store:
+// Vorbis comments in the Ogg and FLAC files, a smpl chunk in the WAV file and
+// CC111 in the MIDI file, which loops at the end of the song. MP3 files have
+// no loop points, so loopTest loops the middle third of it.
+var loopTests = []struct {
+	file       string
+	start, end int
+	ok         bool
+}{
+	{"loop.flac", 5000, 15000, true},
+	{"loop.mid", audioFrequency, 0, true},
+	{"loop.mp3", 0, 0, false},
+	{"loop.ogg", 5000, 15000, true},
+	{"loop.wav", 5000, 15000, true},
+}
+
+func TestBgmLoopPoints(t *testing.T) {
+	for _, lt := range loopTests {
+		start, end, ok := bgmLoopPoints(filepath.Join("testdata", "loop", lt.file))
+		if ok != lt.ok || ok && (start != lt.start || end != lt.end) {
+			t.Errorf("%v: loop points %v, %v, %v, want %v, %v, %v", lt.file,
+				start, end, ok, lt.start, lt.end, lt.ok)
+		}
+	}
+}
+
+func TestLoopTest(t *testing.T) {
+	defer func(sf string) { sys.soundFont = sf }(sys.soundFont)
+	sys.soundFont = filepath.Join("testdata", "loop", "test.sf2")
+	for _, lt := range loopTests {
+		if err := loopTest(filepath.Join("testdata", "loop", lt.file)); err != nil {
+			t.Errorf("%v: %v", lt.file, err)
+		}
+	}
+}
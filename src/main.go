@@ -55,6 +55,36 @@ func main() {
 
 	processCommandLine()
 
+	// Sprite and sound tools run without starting the game
+	if manifest, ok := sys.cmdFlags["-packsff"]; ok {
+		if err := packSff(manifest, sys.cmdFlags["-out"]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if path, ok := sys.cmdFlags["-packsnd"]; ok {
+		if err := packSnd(path, sys.cmdFlags["-out"]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if path, ok := sys.cmdFlags["-looptest"]; ok {
+		if !runLoopTests(path) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if path, ok := sys.cmdFlags["-convertsff"]; ok {
+		_, updateDef := sys.cmdFlags["-updatedef"]
+		if err := convertSffPath(path, sys.cmdFlags["-out"], updateDef); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// Try reading stats
 	if _, err := ioutil.ReadFile("save/stats.json"); err != nil {
 		// If there was an error reading, write an empty json file
@@ -86,6 +116,16 @@ func main() {
 	sys.luaLState = sys.init(tmp.GameWidth, tmp.GameHeight)
 	defer sys.shutdown()
 
+	// Run character tests instead of the game
+	if path, ok := sys.cmdFlags["-test"]; ok {
+		code := 0
+		if !runCharTests(path) {
+			code = 1
+		}
+		sys.shutdown()
+		os.Exit(code)
+	}
+
 	// Begin processing game using its lua scripts
 	if err := sys.luaLState.DoFile(tmp.System); err != nil {
 		// Display error logs.
@@ -148,7 +188,31 @@ Debug Options:
 -ailevel <level>        Changes game difficulty setting to <level> (1-8)
 -speed <speed>          Changes game speed setting to <speed> (10%%-200%%)
 -stresstest <frameskip> Stability test (AI matches at speed increased by <frameskip>)
--speedtest              Speed test (match speed x100)`
+-speedtest              Speed test (match speed x100)
+-profile <file>         Saves bytecode profiler report to <file> when the match ends
+                        (.csv for a spreadsheet, .folded for flamegraph stacks)
+-renderstats <file>     Appends sprite draw calls and frame times to <file> when the
+                        match ends, to compare SpriteAtlas on and off
+-test <path>            Runs the character test <path> (or every .test file in the
+                        <path> directory) headlessly, then quits
+
+Sprite and Sound Tools:
+-packsff <manifest>     Packs the PNG images listed in <manifest> into an SFF v2 file
+                        (lines of group, number, axisx, axisy, image[, palgroup, palnumber])
+-convertsff <path>      Converts the SFF v1 sprites of character <path>.def, file <path>.sff
+                        or every character in directory <path> to SFF v2 (<name>_v2.sff)
+-updatedef              With -convertsff, points the sprite line of each converted .def
+                        file at the new SFF once it is verified (keeps <name>.def.bak)
+-packsnd <file>         Compresses the WAV sounds of SND file <file> to FLAC (<name>_packed.snd)
+                        (SND files can also hold Ogg Vorbis sounds, and Opus ones in
+                        builds with the opus tag)
+-looptest <path>        Checks that music file <path> (or every music file in the <path>
+                        directory) seeks and loops sample accurately, then quits
+-out <file>             Output file of the sprite and sound tools (defaults to one named after the input)
+
+Replay Tools:
+-render <replay>        Renders <replay> frame by frame to numbered PNG files and a WAV
+                        file of its audio in directory -out (defaults to save/render), then quits`
 				//ShowInfoDialog(text, "I.K.E.M.E.N Command line options")
 				fmt.Printf("I.K.E.M.E.N Command line options\n\n" + text + "\nPress ENTER to exit")
 				var s string
@@ -179,13 +243,20 @@ type configSettings struct {
 	AIRamping                  bool
 	AIRandomColor              bool
 	AISurvivalColor            bool
+	AudioBuses                 map[string]AudioBusConfig
 	AudioDucking               bool
 	AudioSampleRate            int32
+	AudioTimeStretch           string
 	AutoGuard                  bool
 	BarGuard                   bool
 	BarRedLife                 bool
 	BarStun                    bool
+	BgmCrossfade               int
 	Borderless                 bool
+	ClipFormat                 string
+	ClipKey                    string
+	ClipSeconds                int32
+	ClipWidth                  int32
 	ComboExtraFrameWindow      int32
 	CommonAir                  []string
 	CommonCmd                  []string
@@ -200,6 +271,7 @@ type configSettings struct {
 	DebugConsoleRows           int
 	DebugFont                  string
 	DebugFontScale             float32
+	DebugHotReload             bool
 	DebugKeys                  bool
 	DebugMode                  bool
 	Difficulty                 int
@@ -248,6 +320,10 @@ type configSettings struct {
 	RoundsNumTag               int32
 	RoundTime                  int32
 	ScreenshotFolder           string
+	ScreenshotGameResolution   bool
+	SoundFont                  string
+	SpriteAtlas                bool
+	SpriteCacheSize            int32
 	StartStage                 string
 	StereoEffects              bool
 	System                     string
@@ -325,9 +401,23 @@ func setupConfig() configSettings {
 	sys.afterImageMax = tmp.MaxAfterImage
 	sys.allowDebugKeys = tmp.DebugKeys
 	sys.allowDebugMode = tmp.DebugMode
+	sys.hotReload.enabled = tmp.DebugHotReload
+	sys.audioBuses.SetConfig(tmp.AudioBuses)
 	sys.audioDucking = tmp.AudioDucking
+	switch strings.ToLower(tmp.AudioTimeStretch) {
+	case "resample":
+		sys.audioTimeStretch = ATS_Resample
+	case "stretch":
+		sys.audioTimeStretch = ATS_Stretch
+	default:
+		sys.audioTimeStretch = ATS_Off
+	}
 	Mp3SampleRate = int(tmp.AudioSampleRate)
 	sys.bgmVolume = tmp.VolumeBgm
+	sys.bgmCrossfade = int(Max(int32(tmp.BgmCrossfade), 0))
+	if tmp.SoundFont != "" {
+		sys.soundFont = tmp.SoundFont
+	}
 	sys.maxBgmVolume = tmp.MaxBgmVolume
 	sys.borderless = tmp.Borderless
 	sys.cam.ZoomDelayEnable = tmp.ZoomDelay
@@ -371,6 +461,12 @@ func setupConfig() configSettings {
 	sys.postProcessingShader = tmp.PostProcessingShader
 	sys.pngFilter = tmp.PngSpriteFilter
 	sys.powerShare = [...]bool{tmp.TeamPowerShare, tmp.TeamPowerShare}
+	sys.spriteAtlas = tmp.SpriteAtlas
+	sys.spriteCache = newSpriteCache("save/spritecache", int64(tmp.SpriteCacheSize)<<20)
+	sys.clipRec.seconds = tmp.ClipSeconds
+	sys.clipRec.width = Max(tmp.ClipWidth, 1)
+	sys.clipRec.setFormat(tmp.ClipFormat)
+	sys.screenshotGameRes = tmp.ScreenshotGameResolution
 	tmp.ScreenshotFolder = strings.TrimSpace(tmp.ScreenshotFolder)
 	if tmp.ScreenshotFolder != "" {
 		tmp.ScreenshotFolder = strings.Replace(tmp.ScreenshotFolder, "\\", "/", -1)
@@ -406,6 +502,18 @@ func setupConfig() configSettings {
 			stoki(b[9].(string)), stoki(b[10].(string)), stoki(b[11].(string)),
 			stoki(b[12].(string)), stoki(b[13].(string))})
 	}
+	if v, ok := sys.cmdFlags["-profile"]; ok {
+		if v == "" {
+			v = "save/profile.txt"
+		}
+		sys.profiler.output = v
+	}
+	if v, ok := sys.cmdFlags["-renderstats"]; ok {
+		if v == "" {
+			v = "save/renderstats.txt"
+		}
+		sys.renderStats.output = v
+	}
 	if _, ok := sys.cmdFlags["-nojoy"]; !ok {
 		for _, jc := range tmp.JoystickConfig {
 			b := jc.Buttons
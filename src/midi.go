@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/ikemen-engine/beep"
+	"github.com/samhocevar/go-meltysynth/meltysynth"
+)
+
+const (
+	midiChannels   = 16
+	midiBlockLen   = 64 // samples rendered between two event checks
+	soundFontCache = 4  // number of soundfonts kept loaded
+)
+
+// ------------------------------------------------------------------
+// MIDI file
+
+type midiEvent struct {
+	time                 int // in samples at audioFrequency
+	status, data1, data2 byte
+}
+
+// midiSong holds the channel events of a standard MIDI file, format 0 or 1,
+// timed in samples.
+type midiSong struct {
+	events    []midiEvent
+	length    int
+	loopStart int // the first CC111 marker, -1 without one
+}
+
+func loadMidiSong(r io.Reader) (*midiSong, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 14 || string(data[:4]) != "MThd" {
+		return nil, Error("not a MIDI file")
+	}
+	format := binary.BigEndian.Uint16(data[8:])
+	tracks := int(binary.BigEndian.Uint16(data[10:]))
+	division := binary.BigEndian.Uint16(data[12:])
+	if format > 1 {
+		return nil, Error(fmt.Sprintf("MIDI format %v is not supported", format))
+	}
+	type tickEvent struct {
+		tick  int
+		tempo int // microseconds per quarter note, 0 for channel events
+		midiEvent
+	}
+	var events []tickEvent
+	pos := 8 + int(binary.BigEndian.Uint32(data[4:]))
+	for t := 0; t < tracks && pos+8 <= len(data); t++ {
+		size := int(binary.BigEndian.Uint32(data[pos+4:]))
+		if size > len(data)-pos-8 {
+			size = len(data) - pos - 8
+		}
+		chunk := data[pos+8 : pos+8+size]
+		isTrack := string(data[pos:pos+4]) == "MTrk"
+		pos += 8 + size
+		if !isTrack {
+			t--
+			continue
+		}
+		r := bytes.NewReader(chunk)
+		tick, status := 0, byte(0)
+		for r.Len() > 0 {
+			delta, err := readMidiVarLen(r)
+			if err != nil {
+				return nil, err
+			}
+			tick += delta
+			b, _ := r.ReadByte()
+			if b < 0x80 {
+				// Running status
+				r.UnreadByte()
+				b = status
+			}
+			switch {
+			case b == 0xFF:
+				typ, _ := r.ReadByte()
+				l, err := readMidiVarLen(r)
+				if err != nil {
+					return nil, err
+				}
+				if l > r.Len() {
+					return nil, io.ErrUnexpectedEOF
+				}
+				meta := make([]byte, l)
+				if _, err := io.ReadFull(r, meta); err != nil {
+					return nil, err
+				}
+				if typ == 0x51 && l == 3 {
+					tempo := int(meta[0])<<16 | int(meta[1])<<8 | int(meta[2])
+					events = append(events, tickEvent{tick: tick, tempo: tempo})
+				} else if typ == 0x2F {
+					events = append(events, tickEvent{tick: tick})
+					r.Seek(0, io.SeekEnd)
+				}
+			case b == 0xF0 || b == 0xF7:
+				l, err := readMidiVarLen(r)
+				if err != nil {
+					return nil, err
+				}
+				r.Seek(int64(l), io.SeekCurrent)
+			case b >= 0x80:
+				status = b
+				e := tickEvent{tick: tick, midiEvent: midiEvent{status: b}}
+				e.data1, _ = r.ReadByte()
+				if b&0xF0 != 0xC0 && b&0xF0 != 0xD0 {
+					e.data2, _ = r.ReadByte()
+				}
+				events = append(events, e)
+			default:
+				return nil, Error("invalid MIDI running status")
+			}
+		}
+	}
+	// Tracks are merged in order of ticks, then converted to samples with
+	// the tempo changes
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].tick < events[j].tick
+	})
+	song := &midiSong{loopStart: -1}
+	tempo, lastTick, time := 500000.0, 0, 0.0
+	for _, e := range events {
+		if division&0x8000 != 0 {
+			// SMPTE frames per second times ticks per frame
+			fps := float64(-int8(division >> 8))
+			time += float64(e.tick-lastTick) / (fps * float64(division&0xFF))
+		} else {
+			time += float64(e.tick-lastTick) * tempo / 1e6 / float64(division)
+		}
+		lastTick = e.tick
+		e.time = int(time * audioFrequency)
+		song.length = e.time
+		if e.tempo > 0 {
+			tempo = float64(e.tempo)
+		} else if e.status != 0 {
+			if e.status&0xF0 == 0xB0 && e.data1 == 111 && song.loopStart < 0 {
+				song.loopStart = e.time
+			}
+			song.events = append(song.events, e.midiEvent)
+		}
+	}
+	if song.length == 0 {
+		return nil, Error("empty MIDI file")
+	}
+	return song, nil
+}
+
+// Reads a variable length quantity, 7 bits per byte, most significant first.
+func readMidiVarLen(r *bytes.Reader) (int, error) {
+	v := 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<7 | int(b&0x7F)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, Error("invalid MIDI variable length quantity")
+}
+
+// Returns the loop start of a MIDI file, in samples, from its CC111 marker,
+// as used by RPG Maker. The loop ends at the end of the song.
+func midiLoopPoints(f io.Reader) (start, end int, ok bool) {
+	song, err := loadMidiSong(f)
+	if err != nil || song.loopStart < 0 {
+		return
+	}
+	return song.loopStart, 0, true
+}
+
+// ------------------------------------------------------------------
+// MIDI decoder
+
+// midiDecoder plays a MIDI song through a synthesizer. Its positions are in
+// samples of the song at its own tempo, so that loop points don't depend on
+// the tempo it is played at. Channels can be muted, or their volume scaled.
+type midiDecoder struct {
+	closer   io.Closer
+	synth    *meltysynth.Synthesizer
+	song     *midiSong
+	pos      float64
+	next     int
+	tempo    float64
+	volume   [midiChannels]float64
+	mute     [midiChannels]bool
+	ccVolume [midiChannels]int32 // channel volume set by the song
+	left     []float32
+	right    []float32
+}
+
+func decodeMidi(rc io.ReadCloser, soundfont *meltysynth.SoundFont) (*midiDecoder, beep.Format, error) {
+	song, err := loadMidiSong(rc)
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	synth, err := meltysynth.NewSynthesizer(soundfont, meltysynth.NewSynthesizerSettings(audioFrequency))
+	if err != nil {
+		return nil, beep.Format{}, err
+	}
+	d := &midiDecoder{closer: rc, synth: synth, song: song, tempo: 1,
+		left: make([]float32, midiBlockLen), right: make([]float32, midiBlockLen)}
+	for i := range d.volume {
+		d.volume[i], d.ccVolume[i] = 1, 100
+	}
+	return d, beep.Format{SampleRate: audioFrequency, NumChannels: 2, Precision: audioPrecision}, nil
+}
+
+// Sends an event to the synthesizer, with the channel settings applied.
+func (d *midiDecoder) send(e midiEvent) {
+	ch, cmd := int32(e.status&0x0F), int32(e.status&0xF0)
+	switch {
+	case cmd == 0x90 && e.data2 > 0 && d.mute[ch]:
+		return
+	case cmd == 0xB0 && e.data1 == 7:
+		d.ccVolume[ch] = int32(e.data2)
+		d.synth.ProcessMidiMessage(ch, cmd, 7, d.channelVolume(ch))
+		return
+	}
+	d.synth.ProcessMidiMessage(ch, cmd, int32(e.data1), int32(e.data2))
+}
+
+func (d *midiDecoder) channelVolume(ch int32) int32 {
+	return int32(math.Round(float64(d.ccVolume[ch]) * d.volume[ch]))
+}
+
+func (d *midiDecoder) Stream(samples [][2]float64) (n int, ok bool) {
+	for n < len(samples) && d.pos < float64(d.song.length) {
+		for d.next < len(d.song.events) && float64(d.song.events[d.next].time) <= d.pos {
+			d.send(d.song.events[d.next])
+			d.next++
+		}
+		m := len(samples) - n
+		if m > midiBlockLen {
+			m = midiBlockLen
+		}
+		if rem := int(math.Ceil((float64(d.song.length) - d.pos) / d.tempo)); rem < m {
+			m = rem
+		}
+		d.synth.Render(d.left[:m], d.right[:m])
+		for i := 0; i < m; i++ {
+			samples[n+i] = [2]float64{float64(d.left[i]), float64(d.right[i])}
+		}
+		n += m
+		d.pos += float64(m) * d.tempo
+	}
+	return n, n > 0
+}
+
+func (d *midiDecoder) Err() error {
+	return nil
+}
+
+func (d *midiDecoder) Len() int {
+	return d.song.length
+}
+
+func (d *midiDecoder) Position() int {
+	return int(d.pos)
+}
+
+// Speed at which the position advances, for bgmLooper.
+func (d *midiDecoder) Speed() float64 {
+	return d.tempo
+}
+
+// Releases the playing notes, so that they ring out across loops, and
+// replays the controller and program changes before p.
+func (d *midiDecoder) Seek(p int) error {
+	if p < 0 || p > d.song.length {
+		return fmt.Errorf("midi: seek position %v out of range [%v, %v]", p, 0, d.song.length)
+	}
+	d.synth.NoteOffAll(false)
+	for ch := int32(0); ch < midiChannels; ch++ {
+		d.synth.ResetAllControllersChannel(ch)
+		d.synth.ProcessMidiMessage(ch, 0xB0, 10, 64)
+		d.ccVolume[ch] = 100
+		d.synth.ProcessMidiMessage(ch, 0xB0, 7, d.channelVolume(ch))
+	}
+	d.next = 0
+	for ; d.next < len(d.song.events) && d.song.events[d.next].time < p; d.next++ {
+		if cmd := d.song.events[d.next].status & 0xF0; cmd != 0x80 && cmd != 0x90 {
+			d.send(d.song.events[d.next])
+		}
+	}
+	d.pos = float64(p)
+	return nil
+}
+
+func (d *midiDecoder) Close() error {
+	return d.closer.Close()
+}
+
+// Sets the tempo, as a multiplier of the song's own.
+func (d *midiDecoder) SetTempo(tempo float64) {
+	d.tempo = float64(ClampF(float32(tempo), 0.25, 4))
+}
+
+// Sets the volume (0-1) of a channel, and whether it is muted.
+func (d *midiDecoder) SetChannel(ch int32, volume float64, mute bool) {
+	if ch < 0 || ch >= midiChannels {
+		return
+	}
+	d.volume[ch] = float64(ClampF(float32(volume), 0, 1))
+	d.synth.ProcessMidiMessage(ch, 0xB0, 7, d.channelVolume(ch))
+	if mute && !d.mute[ch] {
+		d.synth.NoteOffAllChannel(ch, false)
+	}
+	d.mute[ch] = mute
+}
+
+// ------------------------------------------------------------------
+// Soundfonts
+
+// Soundfonts are large, so only the few used last are kept loaded, for
+// stages and screens that switch between the same ones.
+type cachedSoundFont struct {
+	filename string
+	sf       *meltysynth.SoundFont
+}
+
+var soundFonts []cachedSoundFont
+
+func loadSoundFont(filename string) (*meltysynth.SoundFont, error) {
+	for i, c := range soundFonts {
+		if c.filename == filename {
+			copy(soundFonts[1:i+1], soundFonts[:i])
+			soundFonts[0] = c
+			return c.sf, nil
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sf, err := meltysynth.NewSoundFont(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(soundFonts) < soundFontCache {
+		soundFonts = append(soundFonts, cachedSoundFont{})
+	}
+	copy(soundFonts[1:], soundFonts)
+	soundFonts[0] = cachedSoundFont{filename, sf}
+	return sf, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Named variables are persistent per-character variables declared in ZSS:
+//
+//	[Struct Move]
+//	int damage;
+//	bool air;
+//
+//	[Vars]
+//	int combo;
+//	float charge;
+//	int hits[8];
+//	Move lastMove;
+//
+// and used as vars.combo, vars.hits[i] and vars.lastMove.damage. Every
+// declaration is flattened into a list of typed slots, so a variable is just
+// a base slot, an element count and a stride (the size of its struct).
+type NamedVarStruct struct {
+	name   string
+	fields []NamedVarField
+}
+
+type NamedVarField struct {
+	name string
+	typ  ValueType
+}
+
+type NamedVar struct {
+	name  string
+	typ   ValueType
+	st    *NamedVarStruct
+	count int32 // 0 if not an array
+	base  int32
+}
+
+func (nv *NamedVar) stride() int32 {
+	if nv.st != nil {
+		return int32(len(nv.st.fields))
+	}
+	return 1
+}
+func (nv *NamedVar) length() int32 {
+	return Max(1, nv.count)
+}
+
+// Returns the slot offset of a struct field inside one element.
+func (nv *NamedVar) fieldOffset(field string) (int32, error) {
+	if nv.st == nil {
+		if field != "" {
+			return 0, Error(nv.name + " is not a struct")
+		}
+		return 0, nil
+	}
+	if field == "" {
+		return 0, Error("Field of " + nv.name + " not specified")
+	}
+	for i, f := range nv.st.fields {
+		if f.name == field {
+			return int32(i), nil
+		}
+	}
+	return 0, Error(fmt.Sprintf("%v has no field %v", nv.st.name, field))
+}
+
+type NamedVarLayout struct {
+	vars    []*NamedVar
+	byName  map[string]*NamedVar
+	structs map[string]*NamedVarStruct
+	slots   []ValueType
+}
+
+func newNamedVarLayout() *NamedVarLayout {
+	return &NamedVarLayout{byName: make(map[string]*NamedVar),
+		structs: make(map[string]*NamedVarStruct)}
+}
+func (nl *NamedVarLayout) get(name string) *NamedVar {
+	if nl == nil {
+		return nil
+	}
+	return nl.byName[name]
+}
+
+// Returns the value type for int, float and bool, or the struct for a
+// struct name.
+func (nl *NamedVarLayout) typeByName(name string) (ValueType, *NamedVarStruct, bool) {
+	switch name {
+	case "int":
+		return VT_Int, nil, true
+	case "float":
+		return VT_Float, nil, true
+	case "bool":
+		return VT_Bool, nil, true
+	}
+	st, ok := nl.structs[name]
+	return VT_None, st, ok
+}
+func (nl *NamedVarLayout) addStruct(st *NamedVarStruct) error {
+	if _, _, ok := nl.typeByName(st.name); ok {
+		return Error("Type already declared: " + st.name)
+	}
+	nl.structs[st.name] = st
+	return nil
+}
+func (nl *NamedVarLayout) declare(name string, typ ValueType,
+	st *NamedVarStruct, count int32) error {
+	if _, ok := nl.byName[name]; ok {
+		return Error("Variable already declared: " + name)
+	}
+	nv := &NamedVar{name: name, typ: typ, st: st, count: count,
+		base: int32(len(nl.slots))}
+	for i := int32(0); i < nv.length(); i++ {
+		if st != nil {
+			for _, f := range st.fields {
+				nl.slots = append(nl.slots, f.typ)
+			}
+		} else {
+			nl.slots = append(nl.slots, typ)
+		}
+	}
+	nl.vars = append(nl.vars, nv)
+	nl.byName[name] = nv
+	return nil
+}
+
+// Resolves a path like "combo", "hits[2]" or "lastmove.damage" to a slot.
+func (nl *NamedVarLayout) resolve(path string) (int32, error) {
+	path = strings.ToLower(strings.TrimSpace(path))
+	name, field, idx := path, "", int32(0)
+	if i := strings.Index(name, "."); i >= 0 {
+		name, field = name[:i], name[i+1:]
+	}
+	if i := strings.Index(name, "["); i >= 0 {
+		if !strings.HasSuffix(name, "]") {
+			return -1, Error("Invalid index: " + path)
+		}
+		n, err := strconv.Atoi(name[i+1 : len(name)-1])
+		if err != nil {
+			return -1, Error("Invalid index: " + path)
+		}
+		name, idx = name[:i], int32(n)
+	}
+	nv := nl.get(name)
+	if nv == nil {
+		return -1, Error(name + " is not declared")
+	}
+	off, err := nv.fieldOffset(field)
+	if err != nil {
+		return -1, err
+	}
+	if idx < 0 || idx >= nv.length() {
+		return -1, Error(fmt.Sprintf("%v index %v out of range", name, idx))
+	}
+	return nv.base + idx*nv.stride() + off, nil
+}
+
+// Storage is allocated on first use, since helpers and cached characters
+// are initialized before or without compiling the layout.
+func (c *Char) initNamedVars() {
+	nl := c.gi().namedVars
+	if nl == nil || len(c.nvar) == len(nl.slots) {
+		return
+	}
+	c.nvar = make([]BytecodeValue, len(nl.slots))
+	for i, t := range nl.slots {
+		c.nvar[i] = BytecodeValue{t, 0}
+	}
+}
+func (c *Char) namedVarGet(slot int32) BytecodeValue {
+	c.initNamedVars()
+	if slot >= 0 && slot < int32(len(c.nvar)) {
+		return c.nvar[slot]
+	}
+	sys.appendToConsole(c.warn() + "named var index out of range")
+	return BytecodeSF()
+}
+func (c *Char) namedVarSet(slot int32, v BytecodeValue) BytecodeValue {
+	c.initNamedVars()
+	if slot >= 0 && slot < int32(len(c.nvar)) {
+		switch c.nvar[slot].t {
+		case VT_Float:
+			c.nvar[slot] = BytecodeFloat(v.ToF())
+		case VT_Bool:
+			c.nvar[slot] = BytecodeBool(v.ToB())
+		default:
+			c.nvar[slot] = BytecodeInt(v.ToI())
+		}
+		return c.nvar[slot]
+	}
+	sys.appendToConsole(c.warn() + "named var index out of range")
+	return BytecodeSF()
+}
+
+// Formats the named variables for the debug display, a few per line.
+func (c *Char) namedVarText() (lines []string) {
+	nl := c.gi().namedVars
+	if nl == nil || len(nl.vars) == 0 {
+		return nil
+	}
+	c.initNamedVars()
+	str := func(v BytecodeValue) string {
+		switch v.t {
+		case VT_Float:
+			return fmt.Sprintf("%.3f", v.ToF())
+		case VT_Bool:
+			return fmt.Sprint(v.ToB())
+		}
+		return fmt.Sprint(v.ToI())
+	}
+	var parts []string
+	for _, nv := range nl.vars {
+		var elems []string
+		for i := int32(0); i < nv.length(); i++ {
+			s := nv.base + i*nv.stride()
+			if nv.st != nil {
+				var fs []string
+				for j, f := range nv.st.fields {
+					fs = append(fs, f.name+"="+str(c.nvar[s+int32(j)]))
+				}
+				elems = append(elems, "{"+strings.Join(fs, ",")+"}")
+			} else {
+				elems = append(elems, str(c.nvar[s]))
+			}
+		}
+		if nv.count > 0 {
+			parts = append(parts, nv.name+"=["+strings.Join(elems, ",")+"]")
+		} else {
+			parts = append(parts, nv.name+"="+elems[0])
+		}
+	}
+	line := "Vars:"
+	for _, p := range parts {
+		if len(line) > 5 && len(line)+len(p) > 80 {
+			lines = append(lines, line)
+			line = "     "
+		}
+		line += " " + p
+	}
+	return append(lines, line)
+}
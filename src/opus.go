@@ -0,0 +1,150 @@
+//go:build opus
+
+package main
+
+/*
+#cgo pkg-config: opusfile
+#include <stdlib.h>
+#include <opusfile.h>
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/ikemen-engine/beep"
+)
+
+// Opus sounds and music are decoded by opusfile, as there is no pure Go Opus
+// decoder. It's linked only by builds with the opus tag (go build -tags opus),
+// which need the opusfile development files; opus_none.go stands in for it
+// otherwise. opus_test.go checks it on files made by testdata/generate.py.
+
+type opusDecoder struct {
+	of       *C.OggOpusFile
+	data     unsafe.Pointer // The file, copied out of the Go heap for opusfile to keep
+	length   int
+	atEnd    bool // Seeked to the end, which opusfile can't seek to
+	buf      []float32
+	comments []string
+	err      error
+}
+
+// Decodes an Ogg Opus file held in data, which may be reused once it returns.
+// Opus is always decoded at 48 kHz, and downmixed to stereo if it has more
+// channels.
+func opusDecode(data []byte) (*opusDecoder, beep.Format, error) {
+	if len(data) == 0 {
+		return nil, beep.Format{}, Error("not an Opus file")
+	}
+	d := &opusDecoder{data: C.CBytes(data)}
+	var cerr C.int
+	d.of = C.op_open_memory((*C.uchar)(d.data), C.size_t(len(data)), &cerr)
+	if d.of == nil {
+		C.free(d.data)
+		return nil, beep.Format{}, opusError(cerr)
+	}
+	total := C.op_pcm_total(d.of, -1)
+	if total < 0 {
+		d.Close()
+		return nil, beep.Format{}, opusError(C.int(total))
+	}
+	d.length = int(total)
+	if tags := C.op_tags(d.of, -1); tags != nil && tags.comments > 0 {
+		n := int(tags.comments)
+		ptrs := unsafe.Slice(tags.user_comments, n)
+		lengths := unsafe.Slice(tags.comment_lengths, n)
+		for i := range ptrs {
+			d.comments = append(d.comments, C.GoStringN(ptrs[i], lengths[i]))
+		}
+	}
+	format := beep.Format{SampleRate: 48000, NumChannels: 2, Precision: 2}
+	if C.op_channel_count(d.of, -1) == 1 {
+		format.NumChannels = 1
+	}
+	return d, format, nil
+}
+
+func opusError(code C.int) error {
+	switch code {
+	case C.OP_EREAD:
+		return Error("Opus data can't be read")
+	case C.OP_ENOTFORMAT:
+		return Error("not an Opus file")
+	case C.OP_EBADHEADER, C.OP_EVERSION:
+		return Error("invalid or unsupported Opus header")
+	case C.OP_EBADLINK, C.OP_EBADTIMESTAMP, C.OP_EBADPACKET:
+		return Error("corrupted Opus data")
+	case C.OP_EIMPL:
+		return Error("unsupported Opus feature")
+	}
+	return Error(fmt.Sprintf("Opus decoding failed (opusfile error %v)", int(code)))
+}
+
+func (d *opusDecoder) Stream(samples [][2]float64) (n int, ok bool) {
+	if d.err != nil || d.of == nil || d.atEnd {
+		return 0, false
+	}
+	if len(d.buf) < len(samples)*2 {
+		d.buf = make([]float32, len(samples)*2)
+	}
+	for n < len(samples) {
+		buf := d.buf[:(len(samples)-n)*2]
+		r := C.op_read_float_stereo(d.of, (*C.float)(&buf[0]), C.int(len(buf)))
+		if r == C.OP_HOLE {
+			// Missing pages, which opusfile skips
+			continue
+		}
+		if r < 0 {
+			d.err = opusError(r)
+			break
+		}
+		if r == 0 {
+			break
+		}
+		for i := 0; i < int(r); i++ {
+			samples[n+i][0] = float64(buf[i*2])
+			samples[n+i][1] = float64(buf[i*2+1])
+		}
+		n += int(r)
+	}
+	return n, n > 0
+}
+func (d *opusDecoder) Err() error {
+	return d.err
+}
+func (d *opusDecoder) Len() int {
+	return d.length
+}
+func (d *opusDecoder) Position() int {
+	if d.of == nil {
+		return 0
+	} else if d.atEnd {
+		return d.length
+	}
+	return int(C.op_pcm_tell(d.of))
+}
+func (d *opusDecoder) Seek(p int) error {
+	if d.of == nil {
+		return Error("Opus decoder is closed")
+	}
+	d.atEnd = p >= d.length
+	if d.atEnd {
+		d.err = nil
+		return nil
+	}
+	if r := C.op_pcm_seek(d.of, C.ogg_int64_t(p)); r < 0 {
+		return opusError(r)
+	}
+	d.err = nil
+	return nil
+}
+func (d *opusDecoder) Close() error {
+	if d.of != nil {
+		C.op_free(d.of)
+		C.free(d.data)
+		d.of, d.data = nil, nil
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !opus
+
+package main
+
+import (
+	"github.com/ikemen-engine/beep"
+)
+
+// Builds without the opus tag don't link opusfile, so Opus files can't be
+// played, see opus.go.
+
+type opusDecoder struct {
+	beep.StreamSeekCloser
+	comments []string
+}
+
+func opusDecode(data []byte) (*opusDecoder, beep.Format, error) {
+	return nil, beep.Format{}, Error("Opus is not supported by this build (it needs the opus build tag)")
+}
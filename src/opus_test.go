@@ -0,0 +1,123 @@
+//go:build opus
+
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Opus files made by testdata/generate.py, of CELT silence frames, since no
+// Opus encoder is written there. Between them they use every CELT frame size
+// and packet code, and trim their start and end, which is what opusDecode
+// has to get right around opusfile. samples is their length once trimmed.
+var opusTests = []struct {
+	file     string
+	samples  int
+	channels int
+	comments []string
+}{
+	{"mono.opus", 35108, 1, nil},
+	{"stereo.opus", 18680, 2, []string{"LOOPSTART=4800", "LOOPLENGTH=9600"}},
+}
+
+// Streams d to its end and returns how many samples it streamed, which must
+// all be silent.
+func streamOpusSilence(t *testing.T, d *opusDecoder) int {
+	var buf [1000][2]float64
+	total := 0
+	for {
+		n, ok := d.Stream(buf[:])
+		for _, v := range buf[:n] {
+			if math.Abs(v[0]) >= 1.0/(1<<16) || math.Abs(v[1]) >= 1.0/(1<<16) {
+				t.Fatalf("sample %v is %v, want silence", total, v)
+			}
+			total++
+		}
+		if !ok || n == 0 {
+			break
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return total
+}
+
+func TestOpusDecode(t *testing.T) {
+	for _, ot := range opusTests {
+		t.Run(ot.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "opus", ot.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, format, err := opusDecode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			if format.SampleRate != 48000 || format.NumChannels != ot.channels {
+				t.Fatalf("format %+v", format)
+			}
+			if d.Len() != ot.samples {
+				t.Fatalf("Len() = %v, want %v", d.Len(), ot.samples)
+			}
+			if len(d.comments) != len(ot.comments) {
+				t.Fatalf("comments %q, want %q", d.comments, ot.comments)
+			}
+			for i, c := range ot.comments {
+				if d.comments[i] != c {
+					t.Fatalf("comments %q, want %q", d.comments, ot.comments)
+				}
+			}
+			// data is copied, so it may be reused
+			for i := range data {
+				data[i] = 0
+			}
+			if n := streamOpusSilence(t, d); n != ot.samples {
+				t.Fatalf("decoded %v samples, want %v", n, ot.samples)
+			}
+			for _, p := range []int{ot.samples / 2, 0, 4097, ot.samples - 10, 191, ot.samples} {
+				if err := d.Seek(p); err != nil {
+					t.Fatalf("Seek(%v): %v", p, err)
+				}
+				if d.Position() != p {
+					t.Fatalf("Position() = %v after Seek(%v)", d.Position(), p)
+				}
+				if n := streamOpusSilence(t, d); n != ot.samples-p {
+					t.Fatalf("decoded %v samples after Seek(%v), want %v", n, p, ot.samples-p)
+				}
+			}
+		})
+	}
+}
+
+// SND entries are detected by their magic bytes, and are read as a whole.
+func TestOpusReadSound(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "opus", "stereo.opus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.CreateTemp(t.TempDir(), "snd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(0, 0)
+	s, err := readSound(f, uint32(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s == nil || s.format.NumChannels != 2 {
+		t.Fatalf("sound %+v", s)
+	}
+	// Opus is decoded at the output rate, so it isn't resampled
+	if s.length != opusTests[1].samples {
+		t.Fatalf("length %v, want %v", s.length, opusTests[1].samples)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Writes an .act palette, in the reverse order loadAct reads.
+func saveAct(filename string, pal []uint32) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	buf := make([]byte, 0, 768)
+	for i := 255; i >= 0; i-- {
+		var c uint32
+		if i < len(pal) {
+			c = pal[i]
+		}
+		buf = append(buf, byte(c), byte(c>>8), byte(c>>16))
+	}
+	return os.WriteFile(filename, buf, 0644)
+}
+
+// User palettes of a character are kept in a directory named after the
+// path of its def file.
+func userPaletteDir(def string) string {
+	key := strings.ToLower(strings.TrimSuffix(filepath.ToSlash(def), filepath.Ext(def)))
+	key = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, key)
+	return "save/palettes/" + key
+}
+
+// Returns the names of a character's user palettes, in the order they were
+// numbered.
+func userPalettes(def string) (names []string) {
+	dir, err := os.ReadDir(userPaletteDir(def))
+	if err != nil {
+		return nil
+	}
+	for _, de := range dir {
+		if n := de.Name(); !de.IsDir() && strings.ToLower(filepath.Ext(n)) == ".act" {
+			names = append(names, strings.TrimSuffix(n, filepath.Ext(n)))
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) < len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	return
+}
+
+func loadUserPalette(def, name string) ([]uint32, error) {
+	return loadAct(userPaletteDir(def) + "/" + name + ".act")
+}
+
+// Saves a palette as the character's next numbered user palette.
+func saveUserPalette(def string, pal []uint32) (string, error) {
+	dir := userPaletteDir(def)
+	for i := 1; ; i++ {
+		name := fmt.Sprint(i)
+		if _, err := os.Stat(dir + "/" + name + ".act"); os.IsNotExist(err) {
+			return name, saveAct(dir+"/"+name+".act", pal)
+		}
+	}
+}
+
+// Returns the palette of a palette slot, before any remapping.
+func slotPalette(gi *CharGlobalInfo, slot int32) []uint32 {
+	pl := &gi.palettedata.palList
+	idx, ok := pl.PalTable[[...]int16{1, int16(slot)}]
+	if !ok || idx < 0 || idx >= len(pl.palettes) {
+		return nil
+	}
+	return pl.palettes[idx]
+}
+
+// Replaces the palette of a palette slot. The palette is copied, since the
+// previous one may be shared with the SFF and other players.
+func setSlotPalette(gi *CharGlobalInfo, slot int32, pal []uint32) bool {
+	pl := &gi.palettedata.palList
+	idx, ok := pl.PalTable[[...]int16{1, int16(slot)}]
+	if !ok || idx < 0 || idx >= len(pl.palettes) || len(pal) == 0 {
+		return false
+	}
+	p := make([]uint32, 256)
+	copy(p, pal)
+	pl.palettes[idx] = p
+	if idx < len(pl.PalTex) && pl.PalTex[idx] != nil {
+		pl.PalTex[idx] = PaletteToTexture(p)
+	}
+	return true
+}
+
+// Returns the palette a slot had when the character was loaded.
+func originalSlotPalette(gi *CharGlobalInfo, slot int32) (pal []uint32, err error) {
+	if gi.sff.header.Ver0 != 1 {
+		idx, ok := gi.sff.palList.PalTable[[...]int16{1, int16(slot)}]
+		if !ok || idx < 0 {
+			return nil, Error(fmt.Sprintf("palette %v doesn't exist", slot))
+		}
+		return gi.sff.palList.palettes[idx], nil
+	}
+	if slot < 1 || slot > MaxPalNo {
+		return nil, Error(fmt.Sprintf("palette %v doesn't exist", slot))
+	}
+	file := gi.pal[slot-1]
+	err = LoadFile(&file, []string{gi.def, "", sys.motifDir, "data/"}, func(file string) error {
+		pal, err = loadAct(file)
+		return err
+	})
+	return
+}
+
+// PaletteEditor is an overlay to edit the palettes of the characters in a
+// match, which is paused while it is open. It shows the 256 colors of a
+// player's palette slot, and changes are applied right away to the player's
+// own palettes, so they are forgotten after the match unless saved.
+//
+//	Arrows         select a color
+//	Q/W/E, A/S/D   raise or lower its red, green or blue (by 8 with Shift)
+//	PageUp/Down    switch palette slot
+//	Tab            switch player
+//	Enter          save as a user palette, offered by the select screen
+//	X              export to an .act file next to the character
+//	L              load the character's next user palette
+//	R              revert the slot to its original palette
+type PaletteEditor struct {
+	enabled bool
+	paused  bool
+	pn      int
+	slot    int32
+	cursor  int
+	userPal int
+	message string
+}
+
+func (pe *PaletteEditor) char() *Char {
+	if pe.pn < len(sys.chars) && len(sys.chars[pe.pn]) > 0 &&
+		sys.cgi[pe.pn].palettedata != nil {
+		return sys.chars[pe.pn][0]
+	}
+	return nil
+}
+
+func (pe *PaletteEditor) toggle() {
+	if pe.enabled {
+		pe.enabled, sys.paused = false, pe.paused
+		return
+	}
+	if pe.char() == nil {
+		pe.pn = 0
+		if pe.nextPlayer(); pe.char() == nil {
+			return
+		}
+	}
+	pe.enabled, pe.paused, sys.paused = true, sys.paused, true
+	pe.selectSlot(sys.cgi[pe.pn].drawpalno)
+}
+
+func (pe *PaletteEditor) nextPlayer() {
+	for i := 1; i <= len(sys.chars); i++ {
+		pn := (pe.pn + i) % len(sys.chars)
+		if len(sys.chars[pn]) > 0 && sys.cgi[pn].palettedata != nil {
+			pe.pn, pe.userPal = pn, 0
+			pe.selectSlot(sys.cgi[pn].drawpalno)
+			return
+		}
+	}
+}
+
+// Shows a palette slot on the character, as if it had been selected.
+func (pe *PaletteEditor) selectSlot(slot int32) {
+	c, gi := pe.char(), &sys.cgi[pe.pn]
+	if c == nil || slotPalette(gi, slot) == nil {
+		return
+	}
+	pe.slot, pe.message = slot, ""
+	gi.drawpalno = slot
+	c.remapPal(c.getPalfx(), [...]int32{1, 1}, [...]int32{1, slot})
+}
+
+func (pe *PaletteEditor) key(key Key, mk ModifierKey) {
+	c := pe.char()
+	if c == nil {
+		pe.toggle()
+		return
+	}
+	gi := c.gi()
+	step := int32(1)
+	if mk&NewModifierKey(false, false, true) != 0 {
+		step = 8
+	}
+	adjust := func(shift uint, add int32) {
+		pal := append([]uint32{}, slotPalette(gi, pe.slot)...)
+		if pe.cursor >= len(pal) {
+			return
+		}
+		v := Clamp(int32(pal[pe.cursor]>>shift&0xff)+add, 0, 255)
+		pal[pe.cursor] = pal[pe.cursor]&^(0xff<<shift) | uint32(v)<<shift
+		setSlotPalette(gi, pe.slot, pal)
+	}
+	switch KeyToString(key) {
+	case "LEFT":
+		pe.cursor = (pe.cursor + 255) % 256
+	case "RIGHT":
+		pe.cursor = (pe.cursor + 1) % 256
+	case "UP":
+		pe.cursor = (pe.cursor + 240) % 256
+	case "DOWN":
+		pe.cursor = (pe.cursor + 16) % 256
+	case "q":
+		adjust(0, step)
+	case "a":
+		adjust(0, -step)
+	case "w":
+		adjust(8, step)
+	case "s":
+		adjust(8, -step)
+	case "e":
+		adjust(16, step)
+	case "d":
+		adjust(16, -step)
+	case "PAGEUP", "PAGEDOWN":
+		dir := int32(1)
+		if KeyToString(key) == "PAGEUP" {
+			dir = MaxPalNo - 1
+		}
+		for i, s := int32(0), pe.slot; i < MaxPalNo; i++ {
+			if s = (s-1+dir)%MaxPalNo + 1; gi.palExist[s-1] {
+				pe.selectSlot(s)
+				break
+			}
+		}
+	case "TAB":
+		pe.nextPlayer()
+	case "RETURN":
+		if name, err := saveUserPalette(gi.def, slotPalette(gi, pe.slot)); err != nil {
+			pe.message = err.Error()
+		} else {
+			pe.message = "Saved as user palette " + name
+		}
+	case "x":
+		file := fmt.Sprintf("%v_pal%v.act", strings.TrimSuffix(gi.def, filepath.Ext(gi.def)), pe.slot)
+		if err := saveAct(file, slotPalette(gi, pe.slot)); err != nil {
+			pe.message = err.Error()
+		} else {
+			pe.message = "Exported to " + file
+		}
+	case "l":
+		names := userPalettes(gi.def)
+		if len(names) == 0 {
+			pe.message = "No user palettes"
+			break
+		}
+		name := names[pe.userPal%len(names)]
+		pe.userPal++
+		if pal, err := loadUserPalette(gi.def, name); err != nil {
+			pe.message = err.Error()
+		} else {
+			setSlotPalette(gi, pe.slot, pal)
+			pe.message = "Loaded user palette " + name
+		}
+	case "r":
+		if pal, err := originalSlotPalette(gi, pe.slot); err != nil {
+			pe.message = err.Error()
+		} else {
+			setSlotPalette(gi, pe.slot, pal)
+			pe.message = "Reverted"
+		}
+	}
+}
+
+func (pe *PaletteEditor) draw() {
+	c := pe.char()
+	if !pe.enabled || c == nil {
+		return
+	}
+	pal := slotPalette(c.gi(), pe.slot)
+	cell := sys.scrrect[3] / 24
+	x0, y0 := sys.scrrect[2]-cell*33/2, cell
+	FillRect([...]int32{x0 - cell/2, y0 - cell/2, cell * 17, cell * 17}, 0, 160)
+	for i := 0; i < 256 && i < len(pal); i++ {
+		x, y := x0+int32(i%16)*cell, y0+int32(i/16)*cell
+		if i == pe.cursor {
+			FillRect([...]int32{x - 2, y - 2, cell + 4, cell + 4}, 0xffffff, 255)
+		}
+		FillRect([...]int32{x + 1, y + 1, cell - 2, cell - 2},
+			pal[i]&0xff<<16|pal[i]&0xff00|pal[i]>>16&0xff, 255)
+	}
+	var col uint32
+	if pe.cursor < len(pal) {
+		col = pal[pe.cursor]
+	}
+	lines := []string{
+		fmt.Sprintf("P%v %v, palette %v", pe.pn+1, c.gi().displayname, pe.slot),
+		fmt.Sprintf("Color %v: R %v G %v B %v", pe.cursor, col&0xff, col>>8&0xff, col>>16&0xff),
+		pe.message,
+	}
+	x := float32(x0-cell/2)/sys.widthScale + float32(320-sys.gameWidth)/2
+	y := float32(y0+cell*33/2)/sys.heightScale + float32(240-sys.gameHeight)
+	sys.debugFont.SetColor(255, 255, 255)
+	for _, l := range lines {
+		y += float32(sys.debugFont.fnt.Size[1]) * sys.debugFont.yscl / sys.heightScale
+		sys.debugFont.fnt.Print(l, x, y, sys.debugFont.xscl/sys.widthScale,
+			sys.debugFont.yscl/sys.heightScale, 0, 1, &sys.scrrect,
+			sys.debugFont.palfx, sys.debugFont.frgba)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ProfileNodeKind int32
+
+const (
+	PK_Root ProfileNodeKind = iota
+	PK_Player
+	PK_State
+	PK_Controller
+	PK_Expression
+)
+
+// A single frame in the profiler call tree. Every unique call path gets its
+// own node, so the tree can be dumped both as an aggregated report and as
+// flamegraph stacks.
+type profileNode struct {
+	name     string
+	kind     ProfileNodeKind
+	calls    int64
+	total    time.Duration
+	parent   *profileNode
+	children map[string]*profileNode
+}
+
+func newProfileNode(name string, kind ProfileNodeKind, parent *profileNode) *profileNode {
+	return &profileNode{name: name, kind: kind, parent: parent,
+		children: make(map[string]*profileNode)}
+}
+
+// Time spent in this node, excluding the time spent in its children.
+func (pn *profileNode) self(skipExpr bool) time.Duration {
+	d := pn.total
+	for _, ch := range pn.children {
+		if !skipExpr || ch.kind != PK_Expression {
+			d -= ch.total
+		}
+	}
+	return d
+}
+
+// Profiler measures the time spent by the bytecode VM, split by player,
+// statedef and state controller type. It's enabled with the -profile command
+// line flag and dumps its report every time a match ends.
+type Profiler struct {
+	enabled bool
+	output  string
+	root    *profileNode
+	cur     *profileNode
+	starts  []time.Time
+	frames  int32
+	ctrlTyp map[reflect.Type]string
+}
+
+func (p *Profiler) begin() {
+	p.root = newProfileNode("root", PK_Root, nil)
+	p.cur = p.root
+	p.starts = p.starts[:0]
+	p.frames = 0
+	if p.ctrlTyp == nil {
+		p.ctrlTyp = make(map[reflect.Type]string)
+	}
+	p.enabled = true
+}
+func (p *Profiler) end() {
+	if !p.enabled {
+		return
+	}
+	p.enabled = false
+	if err := p.write(p.output); err != nil {
+		sys.errLog.Printf("Failed to write profiler report: %v\n", err)
+	} else {
+		sys.appendToConsole("Profiler report saved to " + p.output)
+	}
+}
+func (p *Profiler) enter(name string, kind ProfileNodeKind) {
+	nd, ok := p.cur.children[name]
+	if !ok {
+		nd = newProfileNode(name, kind, p.cur)
+		p.cur.children[name] = nd
+	}
+	p.cur = nd
+	p.starts = append(p.starts, time.Now())
+}
+func (p *Profiler) leave() {
+	last := len(p.starts) - 1
+	p.cur.total += time.Since(p.starts[last])
+	p.cur.calls++
+	p.cur = p.cur.parent
+	p.starts = p.starts[:last]
+}
+
+// Expressions are only tracked while a state is running, so that triggers
+// evaluated from Lua or the lifebar don't pollute the report.
+func (p *Profiler) exprActive() bool {
+	return p.enabled && p.cur != p.root
+}
+func (p *Profiler) enterState(sb *StateBytecode, c *Char) {
+	p.enter(fmt.Sprintf("P%v %v", c.playerNo+1,
+		strings.Replace(sys.cgi[c.playerNo].displayname, ";", ",", -1)), PK_Player)
+	if sb.playerNo != c.playerNo {
+		p.enter(fmt.Sprintf("State %v (P%v)", sb.stateNo, sb.playerNo+1), PK_State)
+	} else {
+		p.enter(fmt.Sprintf("State %v", sb.stateNo), PK_State)
+	}
+}
+func (p *Profiler) leaveState() {
+	p.leave()
+	p.leave()
+}
+func (p *Profiler) controllerName(sc StateController) string {
+	t := reflect.TypeOf(sc)
+	name, ok := p.ctrlTyp[t]
+	if !ok {
+		name = t.Name()
+		p.ctrlTyp[t] = name
+	}
+	return name
+}
+
+// Runs a state controller, measuring it if the profiler is enabled.
+func (p *Profiler) runController(sc StateController, c *Char, ps []int32) bool {
+	if !p.enabled {
+		return sc.Run(c, ps)
+	}
+	p.enter(p.controllerName(sc), PK_Controller)
+	defer p.leave()
+	return sc.Run(c, ps)
+}
+
+type profileRow struct {
+	player, state, controller string
+	calls, exprCalls          int64
+	total, self, exprTime     time.Duration
+}
+
+// Collapses the call tree into one row per player, state and controller type.
+func (p *Profiler) rows() []*profileRow {
+	rows := make(map[string]*profileRow)
+	var walk func(nd *profileNode, player, state string)
+	walk = func(nd *profileNode, player, state string) {
+		switch nd.kind {
+		case PK_Player:
+			player = nd.name
+		case PK_State, PK_Controller:
+			ctrl := ""
+			if nd.kind == PK_State {
+				state = nd.name
+			} else {
+				ctrl = nd.name
+			}
+			key := player + "\x00" + state + "\x00" + ctrl
+			r, ok := rows[key]
+			if !ok {
+				r = &profileRow{player: player, state: state, controller: ctrl}
+				rows[key] = r
+			}
+			r.calls += nd.calls
+			r.total += nd.total
+			r.self += nd.self(true)
+			for _, ch := range nd.children {
+				if ch.kind == PK_Expression {
+					r.exprCalls += ch.calls
+					r.exprTime += ch.total
+				}
+			}
+		}
+		for _, ch := range nd.children {
+			walk(ch, player, state)
+		}
+	}
+	walk(p.root, "", "")
+	list := make([]*profileRow, 0, len(rows))
+	for _, r := range rows {
+		list = append(list, r)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].self != list[j].self {
+			return list[i].self > list[j].self
+		}
+		return list[i].player+list[i].state+list[i].controller <
+			list[j].player+list[j].state+list[j].controller
+	})
+	return list
+}
+func (p *Profiler) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Ikemen GO bytecode profile (%v frames)\n\n", p.frames)
+	fmt.Fprintf(w, "%-24s %-18s %-20s %10s %12s %12s %10s %10s %12s\n",
+		"Player", "State", "Controller", "Calls", "Total(ms)", "Self(ms)",
+		"Avg(us)", "Exprs", "Expr(ms)")
+	for _, r := range p.rows() {
+		ctrl, avg := r.controller, 0.0
+		if ctrl == "" {
+			ctrl = "-"
+		}
+		if r.calls > 0 {
+			avg = float64(r.total) / float64(time.Microsecond) / float64(r.calls)
+		}
+		fmt.Fprintf(w, "%-24s %-18s %-20s %10d %12.3f %12.3f %10.3f %10d %12.3f\n",
+			r.player, r.state, ctrl, r.calls,
+			float64(r.total)/float64(time.Millisecond),
+			float64(r.self)/float64(time.Millisecond),
+			avg, r.exprCalls, float64(r.exprTime)/float64(time.Millisecond))
+	}
+}
+func (p *Profiler) writeCsv(w io.Writer) {
+	quote := func(s string) string {
+		return "\"" + strings.Replace(s, "\"", "\"\"", -1) + "\""
+	}
+	fmt.Fprintln(w, "player,state,controller,calls,total_us,self_us,expr_calls,expr_us")
+	for _, r := range p.rows() {
+		fmt.Fprintf(w, "%v,%v,%v,%d,%d,%d,%d,%d\n",
+			quote(r.player), quote(r.state), quote(r.controller), r.calls,
+			r.total.Microseconds(), r.self.Microseconds(),
+			r.exprCalls, r.exprTime.Microseconds())
+	}
+}
+
+// Writes the call tree in the collapsed stack format used by flamegraph.pl
+// and compatible viewers, with self time in microseconds as the sample count.
+func (p *Profiler) writeFolded(w io.Writer) {
+	var lines []string
+	var walk func(nd *profileNode, stack string)
+	walk = func(nd *profileNode, stack string) {
+		if nd != p.root {
+			if stack != "" {
+				stack += ";"
+			}
+			stack += nd.name
+			if us := nd.self(false).Microseconds(); us > 0 {
+				lines = append(lines, fmt.Sprintf("%v %d", stack, us))
+			}
+		}
+		for _, ch := range nd.children {
+			walk(ch, stack)
+		}
+	}
+	walk(p.root, "")
+	sort.Strings(lines)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+func (p *Profiler) write(filename string) error {
+	if dir := filepath.Dir(filename); dir != "." {
+		os.MkdirAll(dir, os.ModeSticky|0755)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		p.writeCsv(f)
+	case ".folded":
+		p.writeFolded(f)
+	default:
+		p.writeText(f)
+	}
+	return f.Close()
+}
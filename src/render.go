@@ -77,6 +77,11 @@ func (rp *RenderParams) IsValid() bool {
 }
 
 func drawQuads(modelview mgl.Mat4, x1, y1, x2, y2, x3, y3, x4, y4 float32) {
+	if sprBatch.collecting {
+		sprBatch.add(x1, y1, x2, y2, x3, y3, x4, y4)
+		return
+	}
+	sys.renderStats.draw()
 	gfx.SetUniformMatrix("modelview", modelview[:])
 	gfx.SetUniformF("x1x2x4x3", x1, x2, x4, x3) // this uniform is optional
 	gfx.SetVertexData(
@@ -272,6 +277,7 @@ func RenderSprite(rp RenderParams) {
 	if !rp.IsValid() {
 		return
 	}
+	sys.renderStats.sprite()
 
 	rmInitSub(&rp)
 
@@ -290,42 +296,160 @@ func RenderSprite(rp RenderParams) {
 		//}
 	}
 
-	proj := mgl.Ortho(0, float32(sys.scrrect[2]), 0, float32(sys.scrrect[3]), -65535, 65535)
 	modelview := mgl.Translate3D(0, float32(sys.scrrect[3]), 0)
+	trapez := AbsF(AbsF(rp.xts)-AbsF(rp.xbs)) > 0.001
+	sp := spriteParams{rp.tex.atlasPage(), rp.paltex, rp.trans, rp.mask, invblend,
+		neg, grayscale, padd, pmul, tint, *rp.window}
+
+	// Unrotated quads are collected by the batch, if any
+	if sprBatch.enabled && rp.rot.IsZero() && !trapez {
+		if sp != sprBatch.params {
+			sprBatch.flushFor(sprBatch.params.breakReason(sp))
+			sprBatch.params = sp
+		}
+		sprBatch.uv = rp.tex.uvRect()
+		sprBatch.collecting = true
+		rmTileSub(modelview, rp)
+		sprBatch.collecting = false
+		return
+	}
+	sprBatch.flushFor(RB_Transform)
 
-	gfx.Scissor(rp.window[0], rp.window[1], rp.window[2], rp.window[3])
+	renderSpritePasses(sp, trapez, rp.tex.uvRect(), func() {
+		rmTileSub(modelview, rp)
+	})
+}
+
+// The parameters that sprites drawn in the same call must share
+type spriteParams struct {
+	tex, paltex           *Texture
+	trans, mask, invblend int32
+	neg                   bool
+	gray                  float32
+	add, mult             [3]float32
+	tint                  [4]float32
+	window                [4]int32
+}
+
+// Returns why a batch of sprites drawn with sp can't take a sprite drawn
+// with next, for RenderStats.
+func (sp spriteParams) breakReason(next spriteParams) int {
+	switch {
+	case sp.tex != next.tex:
+		return RB_Texture
+	case sp.paltex != next.paltex || sp.mask != next.mask:
+		return RB_Palette
+	case sp.trans != next.trans || sp.invblend != next.invblend:
+		return RB_Blend
+	case sp.window != next.window:
+		return RB_Window
+	}
+	return RB_PalFX
+}
+
+// Sets up the sprite shader for each blending pass of the parameters and
+// calls draw to emit the quads.
+func renderSpritePasses(sp spriteParams, trapez bool, uv [4]float32, draw func()) {
+	neg, padd, pmul := sp.neg, sp.add, sp.mult
+	proj := mgl.Ortho(0, float32(sys.scrrect[2]), 0, float32(sys.scrrect[3]), -65535, 65535)
+
+	gfx.Scissor(sp.window[0], sp.window[1], sp.window[2], sp.window[3])
 
 	renderWithBlending(func(eq BlendEquation, src, dst BlendFunc, a float32) {
 
 		gfx.SetPipeline(eq, src, dst)
 
 		gfx.SetUniformMatrix("projection", proj[:])
-		gfx.SetTexture("tex", rp.tex)
-		if rp.paltex == nil {
+		gfx.SetTexture("tex", sp.tex)
+		if sp.paltex == nil {
 			gfx.SetUniformI("isRgba", 1)
 		} else {
-			gfx.SetTexture("pal", rp.paltex)
+			gfx.SetTexture("pal", sp.paltex)
 			gfx.SetUniformI("isRgba", 0)
-			gfx.SetUniformI("mask", int(rp.mask))
+			gfx.SetUniformI("mask", int(sp.mask))
 		}
-		gfx.SetUniformI("isTrapez", int(Btoi(AbsF(AbsF(rp.xts)-AbsF(rp.xbs)) > 0.001)))
+		gfx.SetUniformI("isTrapez", int(Btoi(trapez)))
 		gfx.SetUniformI("isFlat", 0)
+		gfx.SetUniformFv("uvRect", uv[:])
 
 		gfx.SetUniformI("neg", int(Btoi(neg)))
-		gfx.SetUniformF("gray", grayscale)
+		gfx.SetUniformF("gray", sp.gray)
 		gfx.SetUniformFv("add", padd[:])
 		gfx.SetUniformFv("mult", pmul[:])
-		gfx.SetUniformFv("tint", tint[:])
+		gfx.SetUniformFv("tint", sp.tint[:])
 		gfx.SetUniformF("alpha", a)
 
-		rmTileSub(modelview, rp)
+		draw()
 
 		gfx.ReleasePipeline()
-	}, rp.trans, rp.paltex != nil, invblend, &neg, &padd, &pmul, rp.paltex == nil)
+	}, sp.trans, sp.paltex != nil, sp.invblend, &neg, &padd, &pmul, sp.paltex == nil)
 
 	gfx.DisableScissor()
 }
 
+// spriteBatch merges consecutive unrotated sprite quads that share a
+// texture (usually an atlas page), a palette and every shader parameter
+// into a single draw call. Only DrawList and ShadowList enable it, since
+// other rendering may interleave with their sprites.
+//
+// A batch is drawn before the next sprite when anything in spriteParams
+// differs (see the RB_ reasons of RenderStats): each palette of an 8-bit
+// sprite is a texture of its own, so the players' palettes and PalFX that
+// remap them break batches, as do changes of trans (add, sub, alpha values)
+// and of PalFX colors. Sprites too large for an atlas page get a texture
+// of their own, rotated and trapezoid sprites are drawn alone, and FillRect
+// draws the batch before its rectangle. Blending itself stays per sprite: a batch is drawn with the passes
+// renderWithBlending picks for its trans, exactly as each sprite was.
+type spriteBatch struct {
+	enabled    bool
+	collecting bool
+	params     spriteParams
+	uv         [4]float32
+	quads      []float32
+}
+
+var sprBatch spriteBatch
+
+func (sb *spriteBatch) begin() {
+	sb.enabled = sys.spriteAtlas
+}
+
+func (sb *spriteBatch) end() {
+	sb.flush()
+	sb.enabled = false
+}
+
+func (sb *spriteBatch) add(x1, y1, x2, y2, x3, y3, x4, y4 float32) {
+	u := func(f float32) float32 { return sb.uv[0] + f*(sb.uv[2]-sb.uv[0]) }
+	v := func(f float32) float32 { return sb.uv[1] + f*(sb.uv[3]-sb.uv[1]) }
+	sb.quads = append(sb.quads,
+		x2, y2, u(1), v(1),
+		x3, y3, u(1), v(0),
+		x1, y1, u(0), v(1),
+		x4, y4, u(0), v(0))
+}
+
+func (sb *spriteBatch) flush() {
+	if len(sb.quads) == 0 {
+		return
+	}
+	modelview := mgl.Translate3D(0, float32(sys.scrrect[3]), 0)
+	renderSpritePasses(sb.params, false, [...]float32{0, 0, 1, 1}, func() {
+		gfx.SetUniformMatrix("modelview", modelview[:])
+		gfx.RenderQuads(sb.quads)
+		sys.renderStats.draw()
+	})
+	sb.quads = sb.quads[:0]
+}
+
+// Draws the batch before a sprite or other draw that can't join it.
+func (sb *spriteBatch) flushFor(reason int) {
+	if len(sb.quads) > 0 {
+		sys.renderStats.batchBreak(reason)
+	}
+	sb.flush()
+}
+
 func renderWithBlending(render func(eq BlendEquation, src, dst BlendFunc, a float32), trans int32, correctAlpha bool, invblend int32, neg *bool, acolor *[3]float32, mcolor *[3]float32, isrgba bool) {
 	blendSourceFactor := BlendSrcAlpha
 	if !correctAlpha {
@@ -414,6 +538,8 @@ func renderWithBlending(render func(eq BlendEquation, src, dst BlendFunc, a floa
 }
 
 func FillRect(rect [4]int32, color uint32, trans int32) {
+	sprBatch.flushFor(RB_Other)
+
 	r := float32(color>>16&0xff) / 255
 	g := float32(color>>8&0xff) / 255
 	b := float32(color&0xff) / 255
@@ -437,6 +563,7 @@ func FillRect(rect [4]int32, color uint32, trans int32) {
 		gfx.SetUniformI("isFlat", 1)
 		gfx.SetUniformF("tint", r, g, b, a)
 		gfx.RenderQuad()
+		sys.renderStats.draw()
 		gfx.ReleasePipeline()
 	}, trans, true, 0, nil, nil, nil, false)
 }
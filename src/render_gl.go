@@ -121,11 +121,15 @@ type Texture struct {
 	depth  int32
 	filter bool
 	handle gl.Texture
+	// Atlas page and uv rectangle of a sprite packed in an atlas
+	page *Texture
+	uv   [4]float32
 }
 
 // Generate a new texture name
 func newTexture(width, height, depth int32, filter bool) (t *Texture) {
-	t = &Texture{width, height, depth, filter, gl.CreateTexture()}
+	t = &Texture{width: width, height: height, depth: depth, filter: filter,
+		handle: gl.CreateTexture()}
 	runtime.SetFinalizer(t, func(t *Texture) {
 		sys.mainThreadTask <- func() {
 			gl.DeleteTexture(t.handle)
@@ -152,6 +156,15 @@ func (t *Texture) SetData(data []byte) {
 	gl.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
 }
 
+// Upload texel data to a rectangle of the texture
+func (t *Texture) SetSubData(x, y, width, height int32, data []byte) {
+	format := InternalFormatLUT[Max(t.depth, 8)]
+
+	gl.BindTexture(gl.TEXTURE_2D, t.handle)
+	gl.PixelStorei(gl.UNPACK_ALIGNMENT, 1)
+	gl.TexSubImage2D(gl.TEXTURE_2D, 0, int(x), int(y), int(width), int(height), format, gl.UNSIGNED_BYTE, data)
+}
+
 // Return whether texture has a valid handle
 func (t *Texture) IsValid() bool {
 	return t.handle.IsValid()
@@ -207,7 +220,7 @@ func (r *Renderer) Init() {
 	// Sprite shader
 	r.spriteShader = newShaderProgram(vertShader, fragShader, "Main Shader")
 	r.spriteShader.RegisterUniforms("modelview", "projection", "x1x2x4x3",
-		"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez")
+		"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez", "uvRect")
 	r.spriteShader.RegisterTextures("pal", "tex")
 
 	// Compile postprocessing shaders
@@ -355,6 +368,22 @@ func (r *Renderer) ReadPixels(data []uint8, width, height int) {
 	r.BeginFrame(false)
 }
 
+// Reads the frame being rendered at the game resolution, before it is
+// postprocessed and scaled to the window.
+func (r *Renderer) ReadGamePixels(data []uint8, width, height int) {
+	if sys.multisampleAntialiasing {
+		gl.BindFramebuffer(gl.DRAW_FRAMEBUFFER, r.fbo_f)
+		gl.BindFramebuffer(gl.READ_FRAMEBUFFER, r.fbo)
+		gl.BlitFramebuffer(0, 0, int(sys.scrrect[2]), int(sys.scrrect[3]), 0, 0, int(sys.scrrect[2]), int(sys.scrrect[3]), gl.COLOR_BUFFER_BIT, gl.LINEAR)
+		gl.BindFramebuffer(gl.FRAMEBUFFER, r.fbo_f)
+	} else {
+		// Screenshots are taken between frames, when the window is bound
+		gl.BindFramebuffer(gl.READ_FRAMEBUFFER, r.fbo)
+	}
+	gl.ReadPixels(data, 0, 0, width, height, gl.RGBA, gl.UNSIGNED_BYTE)
+	gl.BindFramebuffer(gl.FRAMEBUFFER, r.fbo)
+}
+
 func (r *Renderer) Scissor(x, y, width, height int32) {
 	gl.Enable(gl.SCISSOR_TEST)
 	gl.Scissor(x, sys.scrrect[3]-(y+height), width, height)
@@ -416,3 +445,17 @@ func (r *Renderer) SetVertexData(values ...float32) {
 func (r *Renderer) RenderQuad() {
 	gl.DrawArrays(gl.TRIANGLE_STRIP, 0, 4)
 }
+
+// Render quads of four vertices each, in the order used by RenderQuad, with
+// a single draw call
+func (r *Renderer) RenderQuads(values []float32) {
+	n := len(values) / 16
+	tris := make([]float32, 0, n*24)
+	for i := 0; i < n; i++ {
+		q := values[i*16 : i*16+16]
+		tris = append(tris, q[0:12]...)
+		tris = append(tris, q[4:16]...)
+	}
+	r.SetVertexData(tris...)
+	gl.DrawArrays(gl.TRIANGLES, 0, n*6)
+}
@@ -64,6 +64,9 @@ type Texture struct {
 	depth  int32
 	filter bool
 	handle *C.kinc_g4_texture_t
+	// Atlas page and uv rectangle of a sprite packed in an atlas
+	page *Texture
+	uv   [4]float32
 }
 
 var TextureFormatLUT = map[int32]C.kinc_image_format_t{
@@ -74,7 +77,7 @@ var TextureFormatLUT = map[int32]C.kinc_image_format_t{
 
 func newTexture(width, height, depth int32, filter bool) (t *Texture) {
 	handle := (*C.kinc_g4_texture_t)(C.malloc(C.sizeof_kinc_g4_texture_t))
-	t = &Texture{width, height, depth, filter, handle}
+	t = &Texture{width: width, height: height, depth: depth, filter: filter, handle: handle}
 
 	C.kinc_g4_texture_init(t.handle,
 		C.int(width), C.int(height), TextureFormatLUT[depth])
@@ -101,6 +104,19 @@ func (t *Texture) SetData(data []byte) {
 	C.kinc_g4_texture_unlock(t.handle)
 }
 
+func (t *Texture) SetSubData(x, y, width, height int32, data []byte) {
+	pixels := C.kinc_g4_texture_lock(t.handle)
+	stride := C.kinc_g4_texture_stride(t.handle)
+	bpp := t.depth / 8
+	rowBytes := width * bpp
+	for j := int32(0); j < height; j++ {
+		src := unsafe.Pointer(&data[j*rowBytes])
+		dst := unsafe.Add(unsafe.Pointer(pixels), uintptr(y+j)*uintptr(stride)+uintptr(x*bpp))
+		C.memcpy(dst, src, C.size_t(rowBytes))
+	}
+	C.kinc_g4_texture_unlock(t.handle)
+}
+
 func (t *Texture) IsValid() bool {
 	return true
 }
@@ -222,7 +238,7 @@ func (r *Renderer) SetPipeline(eq BlendEquation, src, dst BlendFunc) {
 		p.u = make(map[string]C.kinc_g4_constant_location_t)
 		p.t = make(map[string]C.kinc_g4_texture_unit_t)
 		p.RegisterUniforms("modelview", "projection", "x1x2x4x3",
-			"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez")
+			"alpha", "tint", "mask", "neg", "gray", "add", "mult", "isFlat", "isRgba", "isTrapez", "uvRect")
 		p.RegisterTextures("pal", "tex")
 
 		r.pipelineCache[params] = p
@@ -238,6 +254,10 @@ func (r *Renderer) ReadPixels(data []uint8, width, height int) {
 	sys.errLog.Printf("STUB: ReadPixels()")
 }
 
+func (r *Renderer) ReadGamePixels(data []uint8, width, height int) {
+	sys.errLog.Printf("STUB: ReadGamePixels()")
+}
+
 func (r *Renderer) Scissor(x, y, width, height int32) {
 	C.kinc_g4_scissor(C.int(x), C.int(y), C.int(width), C.int(height))
 }
@@ -304,3 +324,10 @@ func (r *Renderer) RenderQuad() {
 	C.kinc_g4_set_index_buffer(r.indexBuffer)
 	C.kinc_g4_draw_indexed_vertices()
 }
+
+func (r *Renderer) RenderQuads(values []float32) {
+	for i := 0; i+16 <= len(values); i += 16 {
+		r.SetVertexData(values[i : i+16]...)
+		r.RenderQuad()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reasons for a sprite batch to be drawn before the next sprite joins it
+const (
+	RB_Texture   = iota // Another atlas page, or a sprite with its own texture
+	RB_Palette          // Another palette texture or mask color
+	RB_Blend            // Trans, alpha or inverted blending
+	RB_PalFX            // Neg, grayscale, add, mult or tint
+	RB_Window           // Another clipping window
+	RB_Transform        // Rotated or trapezoid sprites, which are drawn alone
+	RB_Other            // Rectangles and other draws between sprites
+	RB_Count
+)
+
+var renderBreakNames = [RB_Count]string{"texture", "palette", "blend",
+	"palfx", "window", "transform", "other"}
+
+// RenderStats measures how sprites are drawn, to compare a scene with sprite
+// atlases on and off (SpriteAtlas in config.json). It's enabled with the
+// -renderstats command line flag and appends a line to its report every
+// time a match ends.
+//
+// Draw time is the CPU time spent submitting the game scene, which is what
+// draw calls cost. Swap time also waits for the GPU, so VRetrace should be 0
+// for it not to be rounded to the refresh rate. A busy 4v4 simul scene is
+// played by AI with quick VS, once with each SpriteAtlas setting:
+//
+//	Ikemen_GO -renderstats save/renderstats.txt -rounds 1 -s stages/stage0.def \
+//		-p1 kfm -p1.ai 8 -p3 kfm -p3.ai 8 -p5 kfm -p5.ai 8 -p7 kfm -p7.ai 8 \
+//		-p2 kfm -p2.ai 8 -p4 kfm -p4.ai 8 -p6 kfm -p6.ai 8 -p8 kfm -p8.ai 8
+//
+// breaks/frame counts, by reason, the batches drawn before they had to,
+// which shows what keeps a scene from being drawn in fewer calls.
+type RenderStats struct {
+	enabled   bool
+	output    string
+	frames    int
+	sprites   int
+	drawCalls int
+	breaks    [RB_Count]int
+	drawTimes []time.Duration
+	swapTime  time.Duration
+	start     time.Time
+}
+
+func (rs *RenderStats) begin() {
+	*rs = RenderStats{output: rs.output, drawTimes: rs.drawTimes[:0], enabled: true}
+}
+func (rs *RenderStats) end() {
+	if !rs.enabled {
+		return
+	}
+	rs.enabled = false
+	if rs.frames == 0 {
+		return
+	}
+	if err := rs.write(rs.output); err != nil {
+		sys.errLog.Printf("Failed to write render stats: %v\n", err)
+	} else {
+		sys.appendToConsole("Render stats saved to " + rs.output)
+	}
+}
+
+// Draws and sprites are counted even while disabled, as that's cheaper than
+// checking.
+func (rs *RenderStats) sprite() {
+	rs.sprites++
+}
+func (rs *RenderStats) draw() {
+	rs.drawCalls++
+}
+func (rs *RenderStats) batchBreak(reason int) {
+	rs.breaks[reason]++
+}
+
+// Brackets the drawing of the game scene.
+func (rs *RenderStats) startDraw() {
+	if rs.enabled {
+		rs.start = time.Now()
+	}
+}
+func (rs *RenderStats) endDraw() {
+	if rs.enabled {
+		rs.drawTimes = append(rs.drawTimes, time.Since(rs.start))
+	}
+}
+
+// Brackets the end of a frame and the buffer swap.
+func (rs *RenderStats) startSwap() {
+	if rs.enabled {
+		rs.start = time.Now()
+	}
+}
+func (rs *RenderStats) endSwap() {
+	if rs.enabled {
+		rs.swapTime += time.Since(rs.start)
+		rs.frames++
+	}
+}
+
+func (rs *RenderStats) write(filename string) error {
+	if dir := filepath.Dir(filename); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(rs.String() + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (rs *RenderStats) String() string {
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+	}
+	perFrame := func(n int) string {
+		return fmt.Sprintf("%.1f", float64(n)/float64(rs.frames))
+	}
+	var drawTotal time.Duration
+	for _, d := range rs.drawTimes {
+		drawTotal += d
+	}
+	var drawAvg, drawP95 time.Duration
+	if n := len(rs.drawTimes); n > 0 {
+		sort.Slice(rs.drawTimes, func(i, j int) bool { return rs.drawTimes[i] < rs.drawTimes[j] })
+		drawAvg, drawP95 = drawTotal/time.Duration(n), rs.drawTimes[n*95/100]
+	}
+	var breaks []string
+	for i, n := range rs.breaks {
+		if n > 0 {
+			breaks = append(breaks, renderBreakNames[i]+":"+perFrame(n))
+		}
+	}
+	return fmt.Sprintf("%v atlas=%v frames=%v sprites/frame=%v drawcalls/frame=%v "+
+		"draw=%v draw95=%v swap=%v breaks/frame=[%v]", time.Now().Format("2006-01-02 15:04:05"),
+		sys.spriteAtlas, rs.frames, perFrame(rs.sprites), perFrame(rs.drawCalls),
+		ms(drawAvg), ms(drawP95), ms(rs.swapTime/time.Duration(rs.frames)),
+		strings.Join(breaks, " "))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// ReplayRenderer writes every game tick of a replay to a numbered PNG file
+// and the mixed audio to a WAV file, for video editing. While it runs the
+// game is not throttled and never skips a frame, and the audio mix is pulled
+// for exactly one tick's worth of samples per frame instead of going to the
+// speaker, so the output doesn't depend on how fast the computer is.
+type ReplayRenderer struct {
+	dir     string
+	frame   int
+	samples int64
+	wav     *os.File
+	buf     [][2]float64
+	pcm     []byte
+	jobs    chan replayFrame
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+}
+
+type replayFrame struct {
+	num           int
+	px            []byte
+	width, height int
+}
+
+func newReplayRenderer(dir string) (*ReplayRenderer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	wav, err := os.Create(dir + "/audio.wav")
+	if err != nil {
+		return nil, err
+	}
+	rr := &ReplayRenderer{dir: dir, wav: wav, jobs: make(chan replayFrame, runtime.NumCPU())}
+	// The sizes in the header are written on close
+	if err := rr.writeWavHeader(); err != nil {
+		wav.Close()
+		return nil, err
+	}
+	if _, err := wav.Seek(44, io.SeekStart); err != nil {
+		wav.Close()
+		return nil, err
+	}
+	for i := 0; i < runtime.NumCPU(); i++ {
+		rr.wg.Add(1)
+		go rr.encode()
+	}
+	sys.audioOut.SetOffline(true)
+	return rr, nil
+}
+
+// Renders the frame that is about to be shown and the audio of its tick.
+// Must be called before the frame is ended.
+func (rr *ReplayRenderer) capture() {
+	width, height := sys.window.GetSize()
+	if width > 0 && height > 0 {
+		px := make([]byte, 4*width*height)
+		gfx.ReadPixels(px, width, height)
+		rr.jobs <- replayFrame{rr.frame, px, width, height}
+	}
+	// Keep the number of samples exact over time, as ticks don't have to
+	// be a whole number of samples long
+	n := int64(rr.frame+1)*audioFrequency/int64(FPS) - rr.samples
+	rr.frame++
+	if n <= 0 {
+		return
+	}
+	if int64(len(rr.buf)) < n {
+		rr.buf = make([][2]float64, n)
+		rr.pcm = make([]byte, 4*n)
+	}
+	sys.audioOut.Read(rr.buf[:n])
+	for i, s := range rr.buf[:n] {
+		for c := 0; c < 2; c++ {
+			v := int16(math.Max(-1, math.Min(1, s[c])) * math.MaxInt16)
+			binary.LittleEndian.PutUint16(rr.pcm[i*4+c*2:], uint16(v))
+		}
+	}
+	if _, err := rr.wav.Write(rr.pcm[:4*n]); err != nil {
+		rr.setErr(err)
+	}
+	rr.samples += n
+}
+
+func (rr *ReplayRenderer) encode() {
+	defer rr.wg.Done()
+	enc := &png.Encoder{CompressionLevel: png.BestSpeed}
+	for j := range rr.jobs {
+		img := image.NewRGBA(image.Rect(0, 0, j.width, j.height))
+		// The screen is read bottom-up
+		for y := 0; y < j.height; y++ {
+			row := img.Pix[y*img.Stride : y*img.Stride+4*j.width]
+			copy(row, j.px[(j.height-1-y)*4*j.width:])
+			for x := 3; x < len(row); x += 4 {
+				row[x] = 255
+			}
+		}
+		f, err := os.Create(fmt.Sprintf("%v/%06d.png", rr.dir, j.num))
+		if err == nil {
+			err = enc.Encode(f, img)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			rr.setErr(err)
+		}
+	}
+}
+
+func (rr *ReplayRenderer) setErr(err error) {
+	rr.mu.Lock()
+	if rr.err == nil {
+		rr.err = err
+	}
+	rr.mu.Unlock()
+}
+
+func (rr *ReplayRenderer) writeWavHeader() error {
+	size := uint32(rr.samples * 4)
+	hdr := make([]byte, 0, 44)
+	le32 := func(v uint32) { hdr = binary.LittleEndian.AppendUint32(hdr, v) }
+	le16 := func(v uint16) { hdr = binary.LittleEndian.AppendUint16(hdr, v) }
+	hdr = append(hdr, "RIFF"...)
+	le32(36 + size)
+	hdr = append(hdr, "WAVEfmt "...)
+	le32(16)
+	le16(1) // PCM
+	le16(2)
+	le32(audioFrequency)
+	le32(audioFrequency * 4)
+	le16(4)
+	le16(16)
+	hdr = append(hdr, "data"...)
+	le32(size)
+	_, err := rr.wav.WriteAt(hdr, 0)
+	return err
+}
+
+// Waits for the frames to be written and completes the WAV file.
+func (rr *ReplayRenderer) Close() error {
+	close(rr.jobs)
+	rr.wg.Wait()
+	sys.audioOut.SetOffline(false)
+	if err := rr.writeWavHeader(); err != nil {
+		rr.setErr(err)
+	}
+	if err := rr.wav.Close(); err != nil {
+		rr.setErr(err)
+	}
+	return rr.err
+}
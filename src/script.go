@@ -172,6 +172,7 @@ func systemScriptInit(l *lua.LState) {
 			subt.RawSetInt(k+1, lua.LNumber(v))
 		}
 		tbl.RawSetString("Offset", subt)
+		tbl.RawSetString("Scale", lua.LNumber(1/spr.texelScale()))
 		tbl.RawSetString("palidx", lua.LNumber(spr.palidx))
 		l.Push(tbl)
 		return 1
@@ -513,11 +514,17 @@ func systemScriptInit(l *lua.LState) {
 		if l.GetTop() >= 11 {
 			priority = int32(numArg(l, 11))
 		}
+		category := int32(-1)
+		if l.GetTop() >= 12 {
+			if t, ok := audioBusByName(strArg(l, 12)); ok {
+				category = int32(t)
+			}
+		}
 		preffix := ""
 		if f {
 			preffix = "f"
 		}
-		sys.chars[pn-1][0].playSound(preffix, lw, lp, g, n, ch, vo, p, fr, ls, x, false, priority)
+		sys.chars[pn-1][0].playSound(preffix, lw, lp, g, n, ch, vo, p, fr, ls, x, false, priority, category)
 		return 0
 	})
 	luaRegister(l, "charSndStop", func(l *lua.LState) int {
@@ -607,6 +614,14 @@ func systemScriptInit(l *lua.LState) {
 		sys.sel.ClearSelected()
 		return 0
 	})
+	luaRegister(l, "clipMark", func(*lua.LState) int {
+		sys.clipRec.mark()
+		return 0
+	})
+	luaRegister(l, "clipSave", func(*lua.LState) int {
+		sys.clipRec.save()
+		return 0
+	})
 	luaRegister(l, "commandAdd", func(l *lua.LState) int {
 		cl, ok := toUserData(l, 1).(*CommandList)
 		if !ok {
@@ -731,6 +746,15 @@ func systemScriptInit(l *lua.LState) {
 		}
 		sys.chars = [len(sys.chars)][]*Char{}
 		sys.fileInput = OpenFileInput(strArg(l, 1))
+		// Optionally render the replay to the given directory
+		if l.GetTop() >= 2 && strArg(l, 2) != "" {
+			rr, err := newReplayRenderer(strArg(l, 2))
+			if err != nil {
+				l.RaiseError("\nCan't render replay to %v: %v\n", strArg(l, 2), err)
+			}
+			sys.replayRender = rr
+			sys.window.SetSwapInterval(0)
+		}
 		return 0
 	})
 	luaRegister(l, "esc", func(l *lua.LState) int {
@@ -755,6 +779,27 @@ func systemScriptInit(l *lua.LState) {
 			sys.fileInput.Close()
 			sys.fileInput = nil
 		}
+		if sys.replayRender != nil {
+			if err := sys.replayRender.Close(); err != nil {
+				sys.errLog.Printf("Failed to render replay: %v\n", err)
+			}
+			sys.replayRender = nil
+		}
+		return 0
+	})
+	// Writes a player's palette slot to an .act file
+	luaRegister(l, "exportPalette", func(l *lua.LState) int {
+		pn := int(numArg(l, 1))
+		if pn < 1 || pn > len(sys.chars) || len(sys.chars[pn-1]) == 0 {
+			l.RaiseError("\nPlayer not found: %v\n", pn)
+		}
+		pal := slotPalette(&sys.cgi[pn-1], int32(numArg(l, 2)))
+		if pal == nil {
+			l.RaiseError("\nPalette not found: %v\n", numArg(l, 2))
+		}
+		if err := saveAct(strArg(l, 3), pal); err != nil {
+			l.RaiseError("\nCan't export %v: %v\n", strArg(l, 3), err.Error())
+		}
 		return 0
 	})
 	luaRegister(l, "fade", func(l *lua.LState) int {
@@ -862,6 +907,8 @@ func systemScriptInit(l *lua.LState) {
 				}
 				sys.await(FPS)
 			}
+			// Upload the textures still waiting for their turn
+			sys.runMainThreadTask()
 			runtime.GC()
 			return nil
 		}
@@ -1089,7 +1136,7 @@ func systemScriptInit(l *lua.LState) {
 				l.Push(lua.LNumber(winp))
 				l.Push(tbl)
 				if sys.playBgmFlg {
-					sys.bgm.Open("", 1, 100, 0, 0, 0)
+					sys.bgm.Open("", 1, 100, 0, 0, 0, sys.bgmCrossfade, "")
 					sys.playBgmFlg = false
 				}
 				sys.clearAllSound()
@@ -1112,6 +1159,28 @@ func systemScriptInit(l *lua.LState) {
 			}
 		}
 	})
+	// RMS and peak level of the audio output over the last frame. Like
+	// getAudioWaveform, it reads what the speaker was last fed, which differs
+	// between machines, so it's for visualizers and not for gameplay.
+	luaRegister(l, "getAudioLevel", func(*lua.LState) int {
+		rms, peak := audioLevels(sys.audioOut.Waveform(audioFrequency / FPS))
+		l.Push(lua.LNumber(rms))
+		l.Push(lua.LNumber(peak))
+		return 2
+	})
+	// Latest samples of the audio output mixed to mono, oldest first
+	luaRegister(l, "getAudioWaveform", func(*lua.LState) int {
+		n := 512
+		if l.GetTop() >= 1 {
+			n = int(numArg(l, 1))
+		}
+		tbl := l.NewTable()
+		for i, s := range sys.audioOut.Waveform(n) {
+			tbl.RawSetInt(i+1, lua.LNumber((s[0]+s[1])/2))
+		}
+		l.Push(tbl)
+		return 1
+	})
 	luaRegister(l, "getCharAttachedInfo", func(*lua.LState) int {
 		def := strArg(l, 1)
 		idx := strings.Index(def, "/")
@@ -1281,6 +1350,16 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 1
 	})
+	// Returns the names of the user palettes saved with the palette editor
+	luaRegister(l, "getCharUserPalettes", func(*lua.LState) int {
+		c := sys.sel.GetChar(int(numArg(l, 1)))
+		tbl := l.NewTable()
+		for _, name := range userPalettes(c.def) {
+			tbl.Append(lua.LString(name))
+		}
+		l.Push(tbl)
+		return 1
+	})
 	luaRegister(l, "getCharVictoryQuote", func(*lua.LState) int {
 		pn := int(numArg(l, 1))
 		if pn < 1 || pn > len(sys.chars) || len(sys.chars[pn-1]) == 0 {
@@ -1489,6 +1568,22 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(newUserData(l, w))
 		return 1
 	})
+	// Replaces a player's palette slot with an .act file for the rest of the
+	// match
+	luaRegister(l, "importPalette", func(l *lua.LState) int {
+		pn := int(numArg(l, 1))
+		if pn < 1 || pn > len(sys.chars) || len(sys.chars[pn-1]) == 0 {
+			l.RaiseError("\nPlayer not found: %v\n", pn)
+		}
+		pal, err := loadAct(strArg(l, 3))
+		if err != nil {
+			l.RaiseError("\nCan't import %v: %v\n", strArg(l, 3), err.Error())
+		}
+		if !setSlotPalette(&sys.cgi[pn-1], int32(numArg(l, 2)), pal) {
+			l.RaiseError("\nPalette not found: %v\n", numArg(l, 2))
+		}
+		return 0
+	})
 	luaRegister(l, "loadDebugFont", func(l *lua.LState) int {
 		ts := NewTextSprite()
 		f, err := loadFnt(strArg(l, 1), -1)
@@ -1516,6 +1611,25 @@ func systemScriptInit(l *lua.LState) {
 		l.Push(lua.LBool(sys.loader.state == LS_Loading))
 		return 1
 	})
+	// Returns the progress of the current loading in bytes, overall and for
+	// each file being loaded
+	luaRegister(l, "loadingProgress", func(l *lua.LState) int {
+		done, total, files := sys.loadProgress.get()
+		tbl := l.NewTable()
+		tbl.RawSetString("done", lua.LNumber(done))
+		tbl.RawSetString("total", lua.LNumber(total))
+		subt := l.NewTable()
+		for i, pf := range files {
+			ft := l.NewTable()
+			ft.RawSetString("name", lua.LString(pf.name))
+			ft.RawSetString("done", lua.LNumber(pf.done))
+			ft.RawSetString("total", lua.LNumber(pf.total))
+			subt.RawSetInt(i+1, ft)
+		}
+		tbl.RawSetString("files", subt)
+		l.Push(tbl)
+		return 1
+	})
 	luaRegister(l, "loadLifebar", func(l *lua.LState) int {
 		lb, err := loadLifebar(strArg(l, 1))
 		if err != nil {
@@ -1588,6 +1702,7 @@ func systemScriptInit(l *lua.LState) {
 	})
 	luaRegister(l, "playBGM", func(l *lua.LState) int {
 		var loop, volume, loopstart, loopend, startposition int = 1, 100, 0, 0, 0
+		fade := sys.bgmCrossfade
 		if l.GetTop() >= 2 {
 			loop = int(numArg(l, 2))
 		}
@@ -1603,7 +1718,51 @@ func systemScriptInit(l *lua.LState) {
 		if l.GetTop() >= 6 && numArg(l, 6) > 1 {
 			startposition = int(numArg(l, 6))
 		}
-		sys.bgm.Open(strArg(l, 1), loop, volume, loopstart, loopend, startposition)
+		if l.GetTop() >= 7 && l.Get(7) != lua.LNil {
+			fade = int(numArg(l, 7))
+		}
+		var soundfont string
+		if l.GetTop() >= 8 && l.Get(8) != lua.LNil {
+			soundfont = strArg(l, 8)
+		}
+		sys.bgm.Open(strArg(l, 1), loop, volume, loopstart, loopend, startposition, fade, soundfont)
+		return 0
+	})
+	luaRegister(l, "playBGMLayer", func(l *lua.LState) int {
+		//file, volume (optional), fade ticks (optional)
+		volume, fade := 100, sys.bgmCrossfade
+		if l.GetTop() >= 2 {
+			volume = int(numArg(l, 2))
+		}
+		if l.GetTop() >= 3 {
+			fade = int(numArg(l, 3))
+		}
+		sys.bgm.SetLayer(strArg(l, 1), volume, fade)
+		return 0
+	})
+	luaRegister(l, "playBGMList", func(l *lua.LState) int {
+		//files table, shuffle (optional), volume (optional), fade ticks (optional), soundfont (optional)
+		var files []string
+		tableArg(l, 1).ForEach(func(_, value lua.LValue) {
+			if s, ok := value.(lua.LString); ok && s != "" {
+				files = append(files, string(s))
+			}
+		})
+		shuffle, volume, fade := false, 100, sys.bgmCrossfade
+		if l.GetTop() >= 2 {
+			shuffle = boolArg(l, 2)
+		}
+		if l.GetTop() >= 3 {
+			volume = int(numArg(l, 3))
+		}
+		if l.GetTop() >= 4 && l.Get(4) != lua.LNil {
+			fade = int(numArg(l, 4))
+		}
+		var soundfont string
+		if l.GetTop() >= 5 && l.Get(5) != lua.LNil {
+			soundfont = strArg(l, 5)
+		}
+		sys.bgm.Playlist(files, shuffle, volume, fade, soundfont)
 		return 0
 	})
 	luaRegister(l, "playerBufReset", func(*lua.LState) int {
@@ -1738,6 +1897,30 @@ func systemScriptInit(l *lua.LState) {
 		sys.roundResetFlg = true
 		return 0
 	})
+	luaRegister(l, "runCharTest", func(l *lua.LState) int {
+		// runCharTest(file) or runCharTest(name, source) runs a character
+		// test and returns whether it passed along with its failures
+		var ct *CharTest
+		var err error
+		if l.GetTop() >= 2 {
+			ct, err = parseCharTest(strArg(l, 1), strArg(l, 2))
+		} else {
+			ct, err = loadCharTest(strArg(l, 1))
+		}
+		if err == nil {
+			err = ct.run(l)
+		}
+		if err != nil {
+			l.RaiseError("\n%v\n", err.Error())
+		}
+		tbl := l.NewTable()
+		for i, f := range ct.failures {
+			tbl.RawSetInt(i+1, lua.LString(f))
+		}
+		l.Push(lua.LBool(len(ct.failures) == 0))
+		l.Push(tbl)
+		return 2
+	})
 	luaRegister(l, "screenshot", func(*lua.LState) int {
 		captureScreen()
 		return 0
@@ -1765,6 +1948,10 @@ func systemScriptInit(l *lua.LState) {
 		}
 		var ret int
 		if sys.sel.AddSelectedChar(tn-1, cn, pl) {
+			// Optional user palette replacing the selected one
+			if l.GetTop() >= 4 && l.Get(4) != lua.LNil {
+				sys.sel.ocd[tn-1][len(sys.sel.ocd[tn-1])-1].userPal = strArg(l, 4)
+			}
 			switch sys.tmode[tn-1] {
 			case TM_Single:
 				ret = 2
@@ -1854,6 +2041,23 @@ func systemScriptInit(l *lua.LState) {
 		sys.allowDebugMode = d
 		return 0
 	})
+	luaRegister(l, "setAudioBus", func(l *lua.LState) int {
+		//bus name, volume, mute (optional), solo (optional)
+		t, ok := audioBusByName(strArg(l, 1))
+		if !ok {
+			l.RaiseError("\nInvalid audio bus: %v\n", strArg(l, 1))
+		}
+		cfg := sys.audioBuses[t].AudioBusConfig
+		cfg.Volume = int(numArg(l, 2))
+		if l.GetTop() >= 3 {
+			cfg.Mute = boolArg(l, 3)
+		}
+		if l.GetTop() >= 4 {
+			cfg.Solo = boolArg(l, 4)
+		}
+		sys.audioBuses.Set(t, cfg)
+		return 0
+	})
 	luaRegister(l, "setAudioDucking", func(l *lua.LState) int {
 		sys.audioDucking = boolArg(l, 1)
 		return 0
@@ -1870,6 +2074,20 @@ func systemScriptInit(l *lua.LState) {
 		sys.autolevel = boolArg(l, 1)
 		return 0
 	})
+	luaRegister(l, "setBGMChannel", func(l *lua.LState) int {
+		//MIDI channel (1-16), volume (0-100), mute (optional)
+		mute := false
+		if l.GetTop() >= 3 {
+			mute = boolArg(l, 3)
+		}
+		sys.bgm.SetMidiChannel(int32(numArg(l, 1))-1, numArg(l, 2)/100, mute)
+		return 0
+	})
+	luaRegister(l, "setBGMTempo", func(l *lua.LState) int {
+		//MIDI tempo, in percent of the song's own
+		sys.bgm.SetMidiTempo(numArg(l, 1) / 100)
+		return 0
+	})
 	luaRegister(l, "setCom", func(*lua.LState) int {
 		pn := int(numArg(l, 1))
 		ailv := float32(numArg(l, 2))
@@ -2360,6 +2578,15 @@ func systemScriptInit(l *lua.LState) {
 		sys.step = true
 		return 0
 	})
+	luaRegister(l, "stopBGMLayer", func(l *lua.LState) int {
+		//file, fade ticks (optional)
+		fade := sys.bgmCrossfade
+		if l.GetTop() >= 2 {
+			fade = int(numArg(l, 2))
+		}
+		sys.bgm.StopLayer(strArg(l, 1), fade)
+		return 0
+	})
 	luaRegister(l, "synchronize", func(*lua.LState) int {
 		if err := sys.synchronize(); err != nil {
 			l.RaiseError(err.Error())
@@ -2552,6 +2779,10 @@ func systemScriptInit(l *lua.LState) {
 		}
 		return 0
 	})
+	luaRegister(l, "togglePaletteEditor", func(*lua.LState) int {
+		sys.palEditor.toggle()
+		return 0
+	})
 	luaRegister(l, "togglePlayer", func(*lua.LState) int {
 		pn := int(numArg(l, 1))
 		if pn < 1 || pn > len(sys.chars) || len(sys.chars[pn-1]) == 0 {
@@ -3398,6 +3629,23 @@ func triggerFunctions(l *lua.LState) {
 		}
 		return 1
 	})
+	// namedvar("combo"), namedvar("hits[2]") or namedvar("lastmove.damage")
+	luaRegister(l, "namedvar", func(*lua.LState) int {
+		slot, err := sys.debugWC.gi().namedVars.resolve(strArg(l, 1))
+		if err != nil {
+			l.Push(lua.LNil)
+			return 1
+		}
+		switch v := sys.debugWC.namedVarGet(slot); v.t {
+		case VT_Bool:
+			l.Push(lua.LBool(v.ToB()))
+		case VT_Float:
+			l.Push(lua.LNumber(v.ToF()))
+		default:
+			l.Push(lua.LNumber(v.ToI()))
+		}
+		return 1
+	})
 	luaRegister(l, "numenemy", func(*lua.LState) int {
 		l.Push(lua.LNumber(sys.debugWC.numEnemy()))
 		return 1
@@ -4142,6 +4390,16 @@ func triggerFunctions(l *lua.LState) {
 			BytecodeInt(int32(numArg(l, 1)))).ToB()))
 		return 1
 	})
+	luaRegister(l, "soundlevel", func(*lua.LState) int {
+		l.Push(lua.LNumber(sys.debugWC.soundLevel(
+			BytecodeInt(int32(numArg(l, 1))), false).ToF()))
+		return 1
+	})
+	luaRegister(l, "soundpeak", func(*lua.LState) int {
+		l.Push(lua.LNumber(sys.debugWC.soundLevel(
+			BytecodeInt(int32(numArg(l, 1))), true).ToF()))
+		return 1
+	})
 	luaRegister(l, "sprpriority", func(*lua.LState) int {
 		l.Push(lua.LNumber(sys.debugWC.sprPriority))
 		return 1
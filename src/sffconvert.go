@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Reads an .act palette, which stores its colors in reverse order.
+func loadAct(filename string) ([]uint32, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pal := make([]uint32, 256)
+	for i := 255; i >= 0; i-- {
+		var rgb [3]byte
+		if _, err := io.ReadFull(f, rgb[:]); err != nil {
+			return nil, Error(filename + ": invalid palette")
+		}
+		pal[i] = uint32(255)<<24 | uint32(rgb[2])<<16 | uint32(rgb[1])<<8 | uint32(rgb[0])
+	}
+	return pal, nil
+}
+
+// Reads every sprite of an SFF v1 file through the PCX decoder, without
+// creating textures. Linked sprites share the pixels of their source.
+func readSffV1(filename string, char bool) (sprites []*Sprite, pixels [][]byte,
+	pl *PaletteList, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+	var h SffHeader
+	var lofs, tofs uint32
+	if err := h.Read(f, &lofs, &tofs); err != nil {
+		return nil, nil, nil, err
+	}
+	if h.Ver0 != 1 {
+		return nil, nil, nil, Error(filename + " is not an SFF v1 file")
+	}
+	pl = &PaletteList{}
+	pl.init()
+	sprites = make([]*Sprite, h.NumberOfSprites)
+	pixels = make([][]byte, h.NumberOfSprites)
+	var prev *Sprite
+	shofs := int64(h.FirstSpriteHeaderOffset)
+	for i := range sprites {
+		f.Seek(shofs, 0)
+		s := newSprite()
+		sprites[i] = s
+		var xofs, size uint32
+		var indexOfPrevious uint16
+		if err := s.readHeader(f, &xofs, &size, &indexOfPrevious); err != nil {
+			return nil, nil, nil, err
+		}
+		if size == 0 {
+			if int(indexOfPrevious) < i {
+				src := sprites[indexOfPrevious]
+				s.Size, s.palidx = src.Size, src.palidx
+				pixels[i] = pixels[indexOfPrevious]
+			} else {
+				s.palidx = 0
+			}
+		} else {
+			if pixels[i], err = s.readPcx(f, &h, shofs+32, size, xofs, prev, pl,
+				char && (prev == nil || s.Group == 0 && s.Number == 0)); err != nil {
+				return nil, nil, nil, err
+			}
+			prev = s
+		}
+		shofs = int64(xofs)
+	}
+	return
+}
+
+// Converts an SFF v1 file to v2. If the file belongs to a character, acts
+// are its pal1 to pal12 files: they become palettes 1,1 to 1,12 and replace
+// the shared palette of sprites 0,0 and 9000,0, which the engine remaps to
+// the selected palette. Sprites with their own palette keep it as a palette
+// of group 2, or group 1 if the file is not a character's. Identical
+// palettes and images are stored once. The result is read back and compared
+// with the original pixels and palettes.
+func convertSff(filename, output string, char bool, acts []string) error {
+	sprites, pixels, pl, err := readSffV1(filename, char)
+	if err != nil {
+		return err
+	}
+	sw := newSffWriter()
+	shared, group := -1, int16(1)
+	if char {
+		group = 2
+		for i, act := range acts {
+			if act == "" {
+				continue
+			}
+			pal, err := loadAct(act)
+			if err != nil {
+				fmt.Printf("%v: %v\n", filename, err)
+				continue
+			}
+			idx, err := sw.AddPalette(1, int16(i+1), pal, 256)
+			if err != nil {
+				return err
+			}
+			if shared < 0 {
+				shared = idx
+			}
+		}
+	}
+	isShared, seen := make(map[int]bool), make(map[[2]int16]bool)
+	for _, s := range sprites {
+		gn := [...]int16{s.Group, s.Number}
+		if char && (gn == [...]int16{0, 0} || gn == [...]int16{9000, 0}) && !seen[gn] && s.palidx >= 0 {
+			seen[gn], isShared[s.palidx] = true, true
+			// Without pal files the shared palette comes from the sprites
+			if shared < 0 {
+				if shared, err = sw.AddPalette(1, 1, pl.Get(s.palidx), 256); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	type expected struct {
+		px  []byte
+		pal int
+	}
+	var want []expected
+	for i, s := range sprites {
+		if _, ok := sw.sprIdx[[...]int16{s.Group, s.Number}]; ok {
+			fmt.Printf("%v: skipped duplicated sprite %v,%v\n", filename, s.Group, s.Number)
+			continue
+		}
+		px := pixels[i]
+		if len(px) != int(s.Size[0])*int(s.Size[1]) || len(px) == 0 {
+			// The engine can't display these either
+			fmt.Printf("%v: skipped invalid sprite %v,%v\n", filename, s.Group, s.Number)
+			continue
+		}
+		palidx := shared
+		if !isShared[s.palidx] {
+			if palidx, err = sw.FindPalette(group, pl.Get(s.palidx), 256); err != nil {
+				return err
+			}
+		}
+		if err := sw.AddIndexed(s.Group, s.Number, s.Offset, int(s.Size[0]),
+			int(s.Size[1]), px, palidx); err != nil {
+			return err
+		}
+		want = append(want, expected{px, palidx})
+	}
+	if err := sw.Write(output); err != nil {
+		return err
+	}
+	// Verify the result with the engine's own v2 decoder
+	f, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var h SffHeader
+	var lofs, tofs uint32
+	if err := h.Read(f, &lofs, &tofs); err != nil {
+		return err
+	}
+	if int(h.NumberOfSprites) != len(want) || int(h.NumberOfPalettes) != len(sw.pals) {
+		return Error(output + ": verification failed, wrong number of sprites or palettes")
+	}
+	for i := range sw.pals {
+		f.Seek(int64(h.FirstPaletteHeaderOffset)+int64(i*16)+6, 0)
+		var hdr struct {
+			Link      uint16
+			Ofs, Size uint32
+		}
+		if err := binary.Read(f, binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+		if hdr.Size == 0 {
+			f.Seek(int64(h.FirstPaletteHeaderOffset)+int64(hdr.Link)*16+8, 0)
+			binary.Read(f, binary.LittleEndian, &hdr.Ofs)
+			binary.Read(f, binary.LittleEndian, &hdr.Size)
+		}
+		data := make([]byte, hdr.Size)
+		f.Seek(int64(lofs+hdr.Ofs), 0)
+		if _, err := io.ReadFull(f, data); err != nil {
+			return err
+		}
+		if !bytes.Equal(data, sw.palData(i)) {
+			return Error(fmt.Sprintf("%v: verification failed, palette %v differs", output, i))
+		}
+	}
+	for i, w := range want {
+		s := newSprite()
+		var xofs, size uint32
+		var link uint16
+		f.Seek(int64(h.FirstSpriteHeaderOffset)+int64(i*28), 0)
+		if err := s.readHeaderV2(f, &xofs, &size, lofs, tofs, &link); err != nil {
+			return err
+		}
+		if s.palidx != w.pal {
+			return Error(fmt.Sprintf("%v: verification failed, palette of sprite %v,%v differs",
+				output, s.Group, s.Number))
+		}
+		if size == 0 {
+			f.Seek(int64(h.FirstSpriteHeaderOffset)+int64(link)*28, 0)
+			if err := s.readHeaderV2(f, &xofs, &size, lofs, tofs, &link); err != nil {
+				return err
+			}
+		}
+		px, _, _, _, err := s.decodeV2(f, int64(xofs), size)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(px, w.px) {
+			return Error(fmt.Sprintf("%v: verification failed, pixels of sprite %v,%v differ",
+				output, s.Group, s.Number))
+		}
+	}
+	linked := 0
+	for _, s := range sw.sprites {
+		if s.link >= 0 {
+			linked++
+		}
+	}
+	fmt.Printf("%v: %v sprites (%v linked), %v palettes\n", output,
+		len(sw.sprites), linked, len(sw.pals))
+	return nil
+}
+
+// Converts a .def file's SFF v1 sprites, or a single .sff file. Given a
+// directory, converts the sprites of every character .def file found in it.
+// The converted file is written next to the original with a _v2 suffix,
+// unless an output file is given for a single conversion. With updateDef,
+// the sprite line of the .def file is pointed at the converted file once it
+// passes verification, and the original .def is kept with a .bak suffix.
+func convertSffPath(path, output string, updateDef bool) error {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		failed := 0
+		filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() && strings.ToLower(filepath.Ext(p)) == ".def" {
+				if err := convertSffPath(p, "", updateDef); err != nil {
+					fmt.Printf("%v: %v\n", p, err)
+					failed++
+				}
+			}
+			return nil
+		})
+		if failed > 0 {
+			return Error(fmt.Sprintf("%v conversions failed", failed))
+		}
+		return nil
+	}
+	sff, char, acts := path, false, make([]string, MaxPalNo)
+	if strings.ToLower(filepath.Ext(path)) == ".def" {
+		str, err := LoadText(path)
+		if err != nil {
+			return err
+		}
+		sff = ""
+		lines, i := SplitAndTrim(str, "\n"), 0
+		for i < len(lines) {
+			is, name, _ := ReadIniSection(lines, &i)
+			if name != "files" {
+				continue
+			}
+			if len(is["sprite"]) > 0 {
+				sff = SearchFile(is["sprite"], []string{path})
+			}
+			for j := range acts {
+				if f := is[fmt.Sprintf("pal%v", j+1)]; len(f) > 0 {
+					acts[j] = SearchFile(f, []string{path})
+				}
+			}
+			break
+		}
+		if sff == "" {
+			// Not a character, or one without sprites
+			return nil
+		}
+		char = true
+		f, err := os.Open(sff)
+		if err != nil {
+			return err
+		}
+		var h SffHeader
+		var lofs, tofs uint32
+		err = h.Read(f, &lofs, &tofs)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if h.Ver0 != 1 {
+			fmt.Printf("%v: already SFF v2\n", sff)
+			return nil
+		}
+	}
+	if output == "" {
+		output = strings.TrimSuffix(sff, filepath.Ext(sff)) + "_v2.sff"
+	}
+	if err := convertSff(sff, output, char, acts); err != nil {
+		return err
+	}
+	if char && updateDef {
+		return updateDefSprite(path, output)
+	}
+	return nil
+}
+
+// Replaces the value of the sprite line in the [Files] section of a .def
+// file, keeping the rest of the file as is, after saving it as <def>.bak.
+func updateDefSprite(def, sff string) error {
+	b, err := os.ReadFile(def)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(filepath.Dir(def), sff)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(b), "\n")
+	section, found := "", false
+	for i, line := range lines {
+		content := line
+		if j := strings.Index(content, ";"); j >= 0 {
+			content = content[:j]
+		}
+		content = strings.TrimSpace(content)
+		if strings.HasPrefix(content, "[") {
+			section = strings.ToLower(strings.Trim(content, "[] \t"))
+			continue
+		}
+		j := strings.Index(content, "=")
+		if section != "files" || j < 0 ||
+			strings.ToLower(strings.TrimSpace(content[:j])) != "sprite" {
+			continue
+		}
+		// Only the value is replaced, so indentation, comments and line
+		// endings stay the same
+		start := strings.Index(line, "=") + 1
+		end := start + len(strings.TrimRight(line[start:], "\r"))
+		if k := strings.Index(line[start:], ";"); k >= 0 {
+			end = start + k
+		}
+		value := line[start:end]
+		lead := value[:len(value)-len(strings.TrimLeft(value, " \t"))]
+		trail := value[len(strings.TrimRight(value, " \t")):]
+		if lead == "" {
+			lead = " "
+		}
+		lines[i] = line[:start] + lead + filepath.ToSlash(rel) + trail + line[end:]
+		found = true
+		break
+	}
+	if !found {
+		return Error(def + ": sprite line not found")
+	}
+	if _, err := os.Stat(def + ".bak"); err == nil {
+		return Error(def + ".bak already exists, the .def file was not updated")
+	}
+	if err := os.WriteFile(def+".bak", b, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(def, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%v: sprite = %v (original saved as %v.bak)\n", def, filepath.ToSlash(rel), def)
+	return nil
+}
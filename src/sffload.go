@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Time the main thread spends per frame on tasks sent by loading goroutines,
+// mostly texture uploads. The rest waits for the next frames, so that loading
+// screens keep animating while large sprite files are streamed in.
+const MainThreadTaskBudget = 4 * time.Millisecond
+
+// LoadProgress tracks how many bytes of each file being loaded have been
+// processed, for loading screens.
+type LoadProgress struct {
+	mu    sync.Mutex
+	files []*LoadProgressFile
+}
+
+type LoadProgressFile struct {
+	name        string
+	done, total int64
+}
+
+// Forgets the files of the previous loading.
+func (lp *LoadProgress) reset() {
+	lp.mu.Lock()
+	lp.files = nil
+	lp.mu.Unlock()
+}
+func (lp *LoadProgress) add(name string, total int64) *LoadProgressFile {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	pf := &LoadProgressFile{name: name, total: total}
+	lp.files = append(lp.files, pf)
+	return pf
+}
+func (lp *LoadProgress) advance(pf *LoadProgressFile, n int64) {
+	if pf == nil {
+		return
+	}
+	lp.mu.Lock()
+	pf.done = Min64(pf.done+n, pf.total)
+	lp.mu.Unlock()
+}
+func (lp *LoadProgress) finish(pf *LoadProgressFile) {
+	if pf == nil {
+		return
+	}
+	lp.mu.Lock()
+	pf.done = pf.total
+	lp.mu.Unlock()
+}
+
+// Returns the overall progress and a copy of every file's.
+func (lp *LoadProgress) get() (done, total int64, files []LoadProgressFile) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	for _, pf := range lp.files {
+		done += pf.done
+		total += pf.total
+		files = append(files, *pf)
+	}
+	return
+}
+
+func Min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type sffDecodeJob struct {
+	spr  *Sprite
+	ofs  int64
+	size uint32
+}
+
+// Decodes SFF v2 sprite data with a pool of workers, each reading through
+// its own file handle, unless the disk cache has the sprite's pixels.
+// Textures are uploaded by the main thread as sprites get decoded, within
+// MainThreadTaskBudget per frame.
+func decodeSpritesV2(filename string, jobs []sffDecodeJob, pf *LoadProgressFile,
+	dc *SpriteCacheEntry) error {
+	workers := runtime.NumCPU()
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+	ch := make(chan sffDecodeJob)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := os.Open(filename)
+			if err == nil {
+				defer f.Close()
+			}
+			for j := range ch {
+				if err == nil {
+					err = j.spr.readV2(f, j.ofs, j.size, dc)
+				}
+				sys.loadProgress.advance(pf, int64(j.size))
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	for _, j := range jobs {
+		ch <- j
+	}
+	close(ch)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
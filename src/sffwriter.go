@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SffWriter builds an SFF v2.01 file. Identical images are stored once and
+// linked, identical palettes are stored once and linked, and every indexed
+// sprite is stored with whichever of raw, RLE8, RLE5, LZ5 or PNG8 is the
+// smallest.
+type SffWriter struct {
+	sprites []*sffWriterSprite
+	pals    []*sffWriterPal
+	sprIdx  map[[2]int16]int
+	palIdx  map[[2]int16]int
+	images  map[string]int
+	colors  map[string]int
+}
+
+type sffWriterSprite struct {
+	group, number int16
+	size          [2]uint16
+	offset        [2]int16
+	link          int
+	format        byte
+	coldepth      byte
+	palidx        int
+	data          []byte
+}
+
+type sffWriterPal struct {
+	group, number int16
+	numcols       int
+	link          int
+	data          []byte
+}
+
+func newSffWriter() *SffWriter {
+	return &SffWriter{sprIdx: make(map[[2]int16]int),
+		palIdx: make(map[[2]int16]int), images: make(map[string]int),
+		colors: make(map[string]int)}
+}
+
+// Adds a palette under group, number and returns its index. A palette with
+// the same colors as an earlier one is linked to it instead of stored again.
+func (sw *SffWriter) AddPalette(group, number int16, pal []uint32, numcols int) (int, error) {
+	if numcols <= 0 || numcols > 256 {
+		numcols = 256
+	}
+	data := make([]byte, numcols*4)
+	for i := 0; i < numcols && i < len(pal); i++ {
+		binary.LittleEndian.PutUint32(data[i*4:], pal[i])
+	}
+	if i, ok := sw.palIdx[[...]int16{group, number}]; ok {
+		if !bytes.Equal(sw.palData(i), data) {
+			return -1, Error(fmt.Sprintf("Palette %v,%v redefined with different colors", group, number))
+		}
+		return i, nil
+	}
+	p := &sffWriterPal{group: group, number: number, numcols: numcols, link: -1}
+	if i, ok := sw.colors[string(data)]; ok {
+		p.link = i
+	} else {
+		p.data = data
+		sw.colors[string(data)] = len(sw.pals)
+	}
+	sw.palIdx[[...]int16{group, number}] = len(sw.pals)
+	sw.pals = append(sw.pals, p)
+	return len(sw.pals) - 1, nil
+}
+
+// Returns the index of a palette of group with the given colors, adding
+// them with the first free number of group if there is none yet.
+func (sw *SffWriter) FindPalette(group int16, pal []uint32, numcols int) (int, error) {
+	if numcols <= 0 || numcols > 256 {
+		numcols = 256
+	}
+	data := make([]byte, numcols*4)
+	for i := 0; i < numcols && i < len(pal); i++ {
+		binary.LittleEndian.PutUint32(data[i*4:], pal[i])
+	}
+	for i, p := range sw.pals {
+		if p.group == group && bytes.Equal(sw.palData(i), data) {
+			return i, nil
+		}
+	}
+	n := int16(1)
+	for _, ok := sw.palIdx[[...]int16{group, n}]; ok; _, ok = sw.palIdx[[...]int16{group, n}] {
+		n++
+	}
+	return sw.AddPalette(group, n, pal, numcols)
+}
+
+func (sw *SffWriter) palData(i int) []byte {
+	for sw.pals[i].link >= 0 {
+		i = sw.pals[i].link
+	}
+	return sw.pals[i].data
+}
+
+func (sw *SffWriter) addSprite(s *sffWriterSprite, key string) error {
+	gn := [...]int16{s.group, s.number}
+	if _, ok := sw.sprIdx[gn]; ok {
+		return Error(fmt.Sprintf("Duplicated sprite: %v,%v", s.group, s.number))
+	}
+	if i, ok := sw.images[key]; ok {
+		src := sw.sprites[i]
+		s.link, s.format, s.coldepth, s.data = i, src.format, src.coldepth, nil
+	} else {
+		sw.images[key] = len(sw.sprites)
+	}
+	sw.sprIdx[gn] = len(sw.sprites)
+	sw.sprites = append(sw.sprites, s)
+	return nil
+}
+
+// Adds an 8-bit sprite using palette palidx, as returned by AddPalette.
+func (sw *SffWriter) AddIndexed(group, number int16, offset [2]int16,
+	width, height int, px []byte, palidx int) error {
+	if width <= 0 || height <= 0 || width > 0xffff || height > 0xffff ||
+		len(px) != width*height {
+		return Error(fmt.Sprintf("Invalid sprite size: %v,%v", group, number))
+	}
+	if palidx < 0 || palidx >= len(sw.pals) {
+		return Error(fmt.Sprintf("Invalid palette of sprite %v,%v", group, number))
+	}
+	s := &sffWriterSprite{group: group, number: number,
+		size: [...]uint16{uint16(width), uint16(height)}, offset: offset,
+		link: -1, coldepth: 8, palidx: palidx}
+	var err error
+	if s.format, s.data, err = encodeIndexedSprite(s.size, px, sw.palData(palidx)); err != nil {
+		return err
+	}
+	return sw.addSprite(s, fmt.Sprintf("8,%v,%v:", width, height)+string(px))
+}
+
+// Adds a true color sprite, stored as PNG24 if it is opaque or PNG32.
+func (sw *SffWriter) AddRGBA(group, number int16, offset [2]int16, img image.Image) error {
+	rect := img.Bounds()
+	if rect.Dx() > 0xffff || rect.Dy() > 0xffff {
+		return Error(fmt.Sprintf("Invalid sprite size: %v,%v", group, number))
+	}
+	rgba := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, rect.Min, draw.Src)
+	s := &sffWriterSprite{group: group, number: number,
+		size: [...]uint16{uint16(rect.Dx()), uint16(rect.Dy())}, offset: offset,
+		link: -1, format: 12, coldepth: 32}
+	if rgba.Opaque() {
+		s.format, s.coldepth = 11, 24
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(rgba.Pix)))
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, rgba); err != nil {
+		return err
+	}
+	s.data = buf.Bytes()
+	return sw.addSprite(s, fmt.Sprintf("32,%v,%v:", rect.Dx(), rect.Dy())+string(rgba.Pix))
+}
+
+func (sw *SffWriter) Write(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := sw.write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (sw *SffWriter) write(w *bufio.Writer) error {
+	le := binary.LittleEndian
+	sprofs := uint32(512)
+	palofs := sprofs + uint32(len(sw.sprites))*28
+	lofs := palofs + uint32(len(sw.pals))*16
+	var ldata []byte
+	palNodes := make([]byte, len(sw.pals)*16)
+	for i, p := range sw.pals {
+		n := palNodes[i*16:]
+		le.PutUint16(n[0:], uint16(p.group))
+		le.PutUint16(n[2:], uint16(p.number))
+		le.PutUint16(n[4:], uint16(p.numcols))
+		if p.link >= 0 {
+			le.PutUint16(n[6:], uint16(p.link))
+		} else {
+			le.PutUint32(n[8:], uint32(len(ldata)))
+			le.PutUint32(n[12:], uint32(len(p.data)))
+			ldata = append(ldata, p.data...)
+		}
+	}
+	sprNodes := make([]byte, len(sw.sprites)*28)
+	for i, s := range sw.sprites {
+		n := sprNodes[i*28:]
+		le.PutUint16(n[0:], uint16(s.group))
+		le.PutUint16(n[2:], uint16(s.number))
+		le.PutUint16(n[4:], s.size[0])
+		le.PutUint16(n[6:], s.size[1])
+		le.PutUint16(n[8:], uint16(s.offset[0]))
+		le.PutUint16(n[10:], uint16(s.offset[1]))
+		n[14], n[15] = s.format, s.coldepth
+		le.PutUint16(n[24:], uint16(s.palidx))
+		if s.link >= 0 {
+			le.PutUint16(n[12:], uint16(s.link))
+		} else {
+			le.PutUint32(n[16:], uint32(len(ldata)))
+			le.PutUint32(n[20:], uint32(len(s.data)))
+			ldata = append(ldata, s.data...)
+		}
+	}
+	hdr := make([]byte, 512)
+	copy(hdr, "ElecbyteSpr\x00")
+	copy(hdr[12:], []byte{0, 1, 0, 2}) // Version 2.01
+	copy(hdr[24:], []byte{0, 1, 0, 2})
+	le.PutUint32(hdr[36:], sprofs)
+	le.PutUint32(hdr[40:], uint32(len(sw.sprites)))
+	le.PutUint32(hdr[44:], palofs)
+	le.PutUint32(hdr[48:], uint32(len(sw.pals)))
+	le.PutUint32(hdr[52:], lofs)
+	le.PutUint32(hdr[56:], uint32(len(ldata)))
+	le.PutUint32(hdr[60:], lofs+uint32(len(ldata)))
+	for _, b := range [][]byte{hdr, sprNodes, palNodes, ldata} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the length of the run of px[j] starting at j, up to max.
+func runLength(px []byte, j, max int) (n int) {
+	for n = 1; n < max && j+n < len(px) && px[j+n] == px[j]; n++ {
+	}
+	return
+}
+
+func Rle8Encode(px []byte) (rle []byte) {
+	for j := 0; j < len(px); {
+		c, n := px[j], runLength(px, j, 63)
+		if n == 1 && c&0xc0 != 0x40 {
+			rle = append(rle, c)
+		} else {
+			rle = append(rle, 0x40|byte(n), c)
+		}
+		j += n
+	}
+	return
+}
+
+// Every packet is a run of any color followed by up to 127 short runs of
+// colors below 32.
+func Rle5Encode(px []byte) (rle []byte) {
+	for j := 0; j < len(px); {
+		c, n := px[j], runLength(px, j, 256)
+		j += n
+		hdr := len(rle)
+		rle = append(rle, byte(n-1), 0)
+		if c != 0 {
+			rle[hdr+1] = 0x80
+			rle = append(rle, c)
+		}
+		dl := byte(0)
+		for ; dl < 127 && j < len(px) && px[j] < 32; dl++ {
+			n = runLength(px, j, 8)
+			rle = append(rle, byte(n-1)<<5|px[j])
+			j += n
+		}
+		rle[hdr+1] |= dl
+	}
+	return
+}
+
+// LZ5 only supports colors below 32. Matches are searched through hash
+// chains of the last 1024 bytes, the longest distance LZ5 can encode.
+func Lz5Encode(px []byte) (rle []byte) {
+	rle = []byte{0}
+	ct, cts := 0, uint(0)
+	packet := func(lz bool) {
+		if cts == 8 {
+			rle = append(rle, 0)
+			ct, cts = len(rle)-1, 0
+		}
+		if lz {
+			rle[ct] |= 1 << cts
+		}
+		cts++
+	}
+	// Every fourth short copy takes its distance from the top bits of the
+	// three previous ones
+	var rbPos [3]int
+	rbc := 0
+	head := make([]int, 1<<16)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int, len(px))
+	insert := func(j int) {
+		if j+1 < len(px) {
+			h := int(px[j])<<8 | int(px[j+1])
+			prev[j], head[h] = head[h], j
+		}
+	}
+	for j := 0; j < len(px); {
+		run := runLength(px, j, 263)
+		length, dist := 0, 0
+		if j+1 < len(px) {
+			for k, steps := head[int(px[j])<<8|int(px[j+1])], 0; k >= 0 &&
+				j-k <= 1024 && steps < 256; k, steps = prev[k], steps+1 {
+				n := 0
+				for n < 258 && j+n < len(px) && px[k+n] == px[j+n] {
+					n++
+				}
+				if n > length {
+					length, dist = n, j-k
+				}
+			}
+		}
+		if length == 2 && dist > 256 {
+			length = 0
+		}
+		if length >= 2 && length > run {
+			if length <= 64 && dist <= 256 {
+				packet(true)
+				d := byte(length - 1)
+				if rbc < 3 {
+					rle = append(rle, d, byte(dist-1))
+					rbPos[rbc] = len(rle) - 2
+					rbc++
+				} else {
+					v := byte(dist - 1)
+					for k := 0; k < 3; k++ {
+						rle[rbPos[k]] |= (v >> (6 - 2*k) & 3) << 6
+					}
+					rle = append(rle, d|(v&3)<<6)
+					rbc = 0
+				}
+			} else {
+				if length > 258 {
+					length = 258
+				}
+				packet(true)
+				rle = append(rle, byte((dist-1)>>8<<6), byte(dist-1), byte(length-3))
+			}
+			run = length
+		} else {
+			packet(false)
+			if run < 8 {
+				rle = append(rle, byte(run)<<5|px[j])
+			} else {
+				rle = append(rle, px[j], byte(run-8))
+			}
+		}
+		for k := 0; k < run; k++ {
+			insert(j + k)
+		}
+		j += run
+	}
+	return
+}
+
+// Encodes an 8-bit sprite in every format that can hold it and returns the
+// smallest. Each encoding is checked against the engine's own decoder.
+func encodeIndexedSprite(size [2]uint16, px []byte, pal []byte) (format byte, data []byte, err error) {
+	format, data = 0, px
+	prefix := func(b []byte) []byte {
+		out := make([]byte, 4, 4+len(b))
+		binary.LittleEndian.PutUint32(out, uint32(len(px)))
+		return append(out, b...)
+	}
+	try := func(f byte, b []byte) {
+		if len(b) < len(data) {
+			format, data = f, b
+		}
+	}
+	maxColor := byte(0)
+	for _, c := range px {
+		if c > maxColor {
+			maxColor = c
+		}
+	}
+	s := &Sprite{Size: size}
+	if rle := Rle8Encode(px); bytes.Equal(s.Rle8Decode(rle), px) {
+		try(2, prefix(rle))
+	}
+	if rle := Rle5Encode(px); bytes.Equal(s.Rle5Decode(rle), px) {
+		try(3, prefix(rle))
+	}
+	if maxColor < 32 {
+		if rle := Lz5Encode(px); bytes.Equal(s.Lz5Decode(rle), px) {
+			try(4, prefix(rle))
+		}
+	}
+	p := make(color.Palette, 256)
+	for i := range p {
+		var rgba [4]byte
+		if i*4+4 <= len(pal) {
+			copy(rgba[:], pal[i*4:])
+		}
+		p[i] = color.NRGBA{rgba[0], rgba[1], rgba[2], rgba[3]}
+	}
+	img := &image.Paletted{Pix: px, Stride: int(size[0]),
+		Rect: image.Rect(0, 0, int(size[0]), int(size[1])), Palette: p}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err = enc.Encode(&buf, img); err != nil {
+		return
+	}
+	try(10, prefix(buf.Bytes()))
+	return
+}
+
+// Converts a PNG palette to the engine's palette format.
+func pngPalette(p color.Palette) []uint32 {
+	pal := make([]uint32, 256)
+	for i := 0; i < len(p) && i < len(pal); i++ {
+		c := color.NRGBAModel.Convert(p[i]).(color.NRGBA)
+		pal[i] = uint32(c.A)<<24 | uint32(c.B)<<16 | uint32(c.G)<<8 | uint32(c.R)
+	}
+	return pal
+}
+
+// Packs the PNG images listed in a manifest into an SFF v2 file. Each line
+// of the manifest is
+//
+//	group, number, axisx, axisy, image[, palgroup, palnumber]
+//
+// with the image path relative to the manifest. Paletted PNGs become 8-bit
+// sprites, and sprites without an explicit palette share the palette of
+// the other sprites with the same colors, numbered 1,1, 1,2 and so on.
+// Other PNGs become true color sprites.
+func packSff(manifest, output string) error {
+	str, err := LoadText(manifest)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = strings.TrimSuffix(manifest, filepath.Ext(manifest)) + ".sff"
+	}
+	sw := newSffWriter()
+	type entry struct {
+		line         int
+		gn, axis, pl [2]int16
+		hasPal       bool
+		img          image.Image
+	}
+	var entries []entry
+	for i, line := range SplitAndTrim(str, "\n") {
+		if j := strings.Index(line, ";"); j >= 0 {
+			line = line[:j]
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		e := entry{line: i + 1}
+		fields := SplitAndTrim(line, ",")
+		if len(fields) != 5 && len(fields) != 7 {
+			return Error(fmt.Sprintf("%v:%v: expected group, number, axisx, axisy, image[, palgroup, palnumber]",
+				manifest, e.line))
+		}
+		nums := append(append([]string{}, fields[:4]...), fields[5:]...)
+		vals := make([]int16, len(nums))
+		for j, n := range nums {
+			v, err := strconv.ParseInt(n, 10, 16)
+			if err != nil {
+				return Error(fmt.Sprintf("%v:%v: invalid number %v", manifest, e.line, n))
+			}
+			vals[j] = int16(v)
+		}
+		e.gn, e.axis = [...]int16{vals[0], vals[1]}, [...]int16{vals[2], vals[3]}
+		if e.hasPal = len(vals) == 6; e.hasPal {
+			e.pl = [...]int16{vals[4], vals[5]}
+		}
+		f, err := os.Open(filepath.Join(filepath.Dir(manifest), fields[4]))
+		if err != nil {
+			return err
+		}
+		e.img, err = png.Decode(f)
+		f.Close()
+		if err != nil {
+			return Error(fmt.Sprintf("%v: %v", fields[4], err))
+		}
+		entries = append(entries, e)
+	}
+	// Explicit palettes first, so that shared ones get the free numbers
+	for _, e := range entries {
+		if pi, ok := e.img.(*image.Paletted); ok && e.hasPal {
+			if _, err := sw.AddPalette(e.pl[0], e.pl[1], pngPalette(pi.Palette), len(pi.Palette)); err != nil {
+				return Error(fmt.Sprintf("%v:%v: %v", manifest, e.line, err))
+			}
+		}
+	}
+	for _, e := range entries {
+		pi, ok := e.img.(*image.Paletted)
+		if !ok {
+			if err := sw.AddRGBA(e.gn[0], e.gn[1], e.axis, e.img); err != nil {
+				return Error(fmt.Sprintf("%v:%v: %v", manifest, e.line, err))
+			}
+			continue
+		}
+		var palidx int
+		if e.hasPal {
+			palidx = sw.palIdx[e.pl]
+		} else if palidx, err = sw.FindPalette(1, pngPalette(pi.Palette), len(pi.Palette)); err != nil {
+			return Error(fmt.Sprintf("%v:%v: %v", manifest, e.line, err))
+		}
+		w, h := pi.Rect.Dx(), pi.Rect.Dy()
+		px := make([]byte, w*h)
+		for y := 0; y < h; y++ {
+			copy(px[y*w:], pi.Pix[pi.PixOffset(pi.Rect.Min.X, pi.Rect.Min.Y+y):][:w])
+		}
+		if err := sw.AddIndexed(e.gn[0], e.gn[1], e.axis, w, h, px, palidx); err != nil {
+			return Error(fmt.Sprintf("%v:%v: %v", manifest, e.line, err))
+		}
+	}
+	if err := sw.Write(output); err != nil {
+		return err
+	}
+	linked := 0
+	for _, s := range sw.sprites {
+		if s.link >= 0 {
+			linked++
+		}
+	}
+	fmt.Printf("%v: %v sprites (%v linked), %v palettes\n", output,
+		len(sw.sprites), linked, len(sw.pals))
+	return nil
+}
@@ -1,7 +1,7 @@
 uniform sampler2D tex;
 uniform sampler2D pal;
 
-uniform vec4 x1x2x4x3;
+uniform vec4 x1x2x4x3, uvRect;
 uniform vec4 tint;
 uniform vec3 add, mult;
 uniform float alpha, gray;
@@ -22,6 +22,8 @@ void main(void) {
 			// Correct uv.x from the fragment position on that segment
 			uv.x = (gl_FragCoord.x - bounds[0]) / (bounds[1] - bounds[0]);
 		}
+		// Map to the sprite's rectangle in its texture (for atlas pages)
+		uv = mix(uvRect.xy, uvRect.zw, uv);
 
 		vec4 c = texture2D(tex, uv);
 		vec3 neg_base = vec3(1.0);
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rewrites an SND file with its PCM WAV sounds compressed to FLAC, which is
+// lossless. Sounds that are already compressed, or that FLAC doesn't make
+// smaller, are copied as they are.
+func packSnd(input, output string) error {
+	if output == "" {
+		output = strings.TrimSuffix(input, filepath.Ext(input)) + "_packed.snd"
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	read := func(x interface{}) error {
+		return binary.Read(f, binary.LittleEndian, x)
+	}
+	var hdr struct {
+		Magic          [12]byte
+		Ver, Ver2      uint16
+		NumberOfSounds uint32
+		SubHeaderOfs   uint32
+	}
+	if err := read(&hdr); err != nil {
+		return err
+	}
+	if string(hdr.Magic[:]) != "ElecbyteSnd\x00" {
+		return Error("Unrecognized SND file, invalid header")
+	}
+	type entry struct {
+		gn   [2]int32
+		data []byte
+	}
+	entries := make([]entry, 0, hdr.NumberOfSounds)
+	var packed int
+	var before, after int64
+	ofs := hdr.SubHeaderOfs
+	for i := uint32(0); i < hdr.NumberOfSounds; i++ {
+		if _, err := f.Seek(int64(ofs), 0); err != nil {
+			return err
+		}
+		var sub struct {
+			Next, Length uint32
+			GN           [2]int32
+		}
+		if err := read(&sub); err != nil {
+			return err
+		}
+		e := entry{gn: sub.GN, data: make([]byte, sub.Length)}
+		if _, err := io.ReadFull(f, e.data); err != nil {
+			return err
+		}
+		before += int64(len(e.data))
+		if data, err := wavToFlac(e.data); err == nil && len(data) < len(e.data) {
+			e.data = data
+			packed++
+		}
+		after += int64(len(e.data))
+		entries = append(entries, e)
+		ofs = sub.Next
+	}
+	var buf bytes.Buffer
+	hdr.SubHeaderOfs = 512
+	binary.Write(&buf, binary.LittleEndian, hdr)
+	buf.Write(make([]byte, 512-buf.Len()))
+	for i, e := range entries {
+		next := uint32(buf.Len() + 16 + len(e.data))
+		if i == len(entries)-1 {
+			next = 0
+		}
+		binary.Write(&buf, binary.LittleEndian, [...]uint32{next, uint32(len(e.data))})
+		binary.Write(&buf, binary.LittleEndian, e.gn)
+		buf.Write(e.data)
+	}
+	if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%v: compressed %v of %v sounds, %v to %v bytes\n",
+		output, packed, len(entries), before, after)
+	return nil
+}
+
+// Converts a PCM WAV file to FLAC.
+func wavToFlac(wav []byte) ([]byte, error) {
+	if len(wav) < 12 || string(wav[:4]) != "RIFF" || string(wav[8:12]) != "WAVE" {
+		return nil, Error("not a WAV file")
+	}
+	var format, channels, bps uint16
+	var sampleRate uint32
+	var data []byte
+	for c := wav[12:]; len(c) >= 8; {
+		id, size := string(c[:4]), binary.LittleEndian.Uint32(c[4:])
+		if uint64(size) > uint64(len(c)-8) {
+			size = uint32(len(c) - 8)
+		}
+		body := c[8 : 8+size]
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, Error("invalid WAV format")
+			}
+			format, channels = binary.LittleEndian.Uint16(body), binary.LittleEndian.Uint16(body[2:])
+			sampleRate, bps = binary.LittleEndian.Uint32(body[4:]), binary.LittleEndian.Uint16(body[14:])
+		case "data":
+			data = body
+		}
+		c = c[8+size:]
+		if size&1 != 0 && len(c) > 0 {
+			c = c[1:]
+		}
+	}
+	if format != 1 || channels < 1 || channels > 8 || sampleRate == 0 || sampleRate >= 1<<20 ||
+		bps != 8 && bps != 16 && bps != 24 {
+		return nil, Error("unsupported WAV format")
+	}
+	width := int(bps / 8)
+	n := len(data) / (width * int(channels))
+	pcm := make([][]int32, channels)
+	for ch := range pcm {
+		pcm[ch] = make([]int32, n)
+		for i := range pcm[ch] {
+			p := data[(i*int(channels)+ch)*width:]
+			switch bps {
+			case 8:
+				pcm[ch][i] = int32(p[0]) - 128
+			case 16:
+				pcm[ch][i] = int32(int16(binary.LittleEndian.Uint16(p)))
+			case 24:
+				pcm[ch][i] = int32(uint32(p[0])<<8|uint32(p[1])<<16|uint32(p[2])<<24) >> 8
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := flacEncode(&buf, pcm, int(sampleRate), int(bps)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -4,17 +4,20 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
+	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/ikemen-engine/beep"
 	"github.com/ikemen-engine/beep/effects"
-
-	"github.com/ikemen-engine/beep/midi"
 	"github.com/ikemen-engine/beep/mp3"
 	"github.com/ikemen-engine/beep/speaker"
 	"github.com/ikemen-engine/beep/vorbis"
 	"github.com/ikemen-engine/beep/wav"
+	"github.com/jfreymuth/oggvorbis"
 )
 
 const (
@@ -22,7 +25,7 @@ const (
 	audioFrequency       = 48000
 	audioPrecision       = 4
 	audioResampleQuality = 1
-	audioSoundFont       = "sound/soundfont.sf2" // default path for MIDI soundfont
+	audioSoundFont       = "sound/soundfont.sf2" // default path for MIDI soundfont, if not set in config
 )
 
 // ------------------------------------------------------------------
@@ -95,8 +98,10 @@ type bgmLooper struct {
 	loopend   int
 }
 
+// Loops s between loopstart and loopend. A loopend of 0 or less, or one of
+// a stream whose length is unknown (Len() == 0), loops at the end of s.
 func BgmLooper(s beep.StreamSeeker, loopcount, loopstart, loopend int) beep.Streamer {
-	if loopstart < 0 || loopstart >= s.Len() {
+	if loopstart < 0 || s.Len() > 0 && loopstart >= s.Len() {
 		loopstart = 0
 	}
 	if loopend <= loopstart {
@@ -110,38 +115,135 @@ func BgmLooper(s beep.StreamSeeker, loopcount, loopstart, loopend int) beep.Stre
 	}
 }
 
+// Streamers whose position doesn't advance by one per sample streamed, such
+// as MIDI played at another tempo.
+type bgmSpeeder interface {
+	Speed() float64
+}
+
 func (b *bgmLooper) Stream(samples [][2]float64) (n int, ok bool) {
 	if b.loopcount == 0 || b.s.Err() != nil {
 		return 0, false
 	}
+	looped := false
 	for len(samples) > 0 {
-		sn, sok := b.s.Stream(samples)
-		if !sok || b.s.Position() >= b.loopend {
-			if b.loopcount > 0 {
-				b.loopcount--
-			}
-			if b.loopcount == 0 {
-				break
+		// Never stream past the loop end, so that looping is sample accurate
+		sn, sok := 0, false
+		toEnd := len(samples)
+		if b.loopend > 0 {
+			toEnd = b.loopend - b.s.Position()
+			if sp, ok := b.s.(bgmSpeeder); ok && toEnd > 0 {
+				toEnd = int(math.Ceil(float64(toEnd) / sp.Speed()))
 			}
-			err := b.s.Seek(b.loopstart)
-			if err != nil {
-				return n, true
+		}
+		if toEnd > 0 {
+			if toEnd < len(samples) {
+				sn, sok = b.s.Stream(samples[:toEnd])
+			} else {
+				sn, sok = b.s.Stream(samples)
 			}
+			samples = samples[sn:]
+			n += sn
+		}
+		if sok && sn > 0 {
+			looped = false
 			continue
 		}
-		samples = samples[sn:]
-		n += sn
+		// The loop end or the end of the stream was reached. Give up if
+		// nothing could be streamed since the last loop.
+		if b.loopcount > 0 {
+			b.loopcount--
+		}
+		if b.loopcount == 0 || looped {
+			break
+		}
+		if err := b.s.Seek(b.loopstart); err != nil {
+			break
+		}
+		looped = true
 	}
-	return n, true
+	return n, n > 0
 }
 
 func (b *bgmLooper) Err() error {
 	return b.s.Err()
 }
 
+// ------------------------------------------------------------------
+// AudioOutput
+
+// Number of output samples kept for getAudioWaveform.
+const audioWaveLen = 4096
+
+// AudioOutput mixes sound effects and music for the speaker. While offline
+// is set the speaker is fed silence, and the mix is pulled with Read instead.
+// The latest samples of the mix are kept for visualizers.
+type AudioOutput struct {
+	mixer   beep.Mixer
+	offline bool
+	wave    [audioWaveLen][2]float32
+	wavePos int
+}
+
+func (o *AudioOutput) Add(s beep.Streamer) {
+	speaker.Lock()
+	o.mixer.Add(s)
+	speaker.Unlock()
+}
+func (o *AudioOutput) SetOffline(offline bool) {
+	speaker.Lock()
+	o.offline = offline
+	speaker.Unlock()
+}
+
+// Mixes the next samples while offline.
+func (o *AudioOutput) Read(samples [][2]float64) {
+	speaker.Lock()
+	o.mixer.Stream(samples)
+	o.record(samples)
+	speaker.Unlock()
+}
+func (o *AudioOutput) Stream(samples [][2]float64) (n int, ok bool) {
+	if o.offline {
+		for i := range samples {
+			samples[i] = [2]float64{}
+		}
+		return len(samples), true
+	}
+	n, ok = o.mixer.Stream(samples)
+	o.record(samples[:n])
+	return n, ok
+}
+func (o *AudioOutput) record(samples [][2]float64) {
+	for _, s := range samples {
+		o.wave[o.wavePos] = [2]float32{float32(s[0]), float32(s[1])}
+		o.wavePos = (o.wavePos + 1) % audioWaveLen
+	}
+}
+
+// Returns the latest n samples of the mix, oldest first.
+func (o *AudioOutput) Waveform(n int) [][2]float64 {
+	n = int(Clamp(int32(n), 0, audioWaveLen))
+	samples := make([][2]float64, n)
+	speaker.Lock()
+	for i := range samples {
+		s := o.wave[(o.wavePos-n+i+audioWaveLen)%audioWaveLen]
+		samples[i] = [2]float64{float64(s[0]), float64(s[1])}
+	}
+	speaker.Unlock()
+	return samples
+}
+func (o *AudioOutput) Err() error {
+	return nil
+}
+
 // ------------------------------------------------------------------
 // Bgm
 
+// Bgm plays music through its own mixer, so that the current track can be
+// crossfaded with the previous one and played along with layers, such as
+// extra stems faded in when a player's life is low. It can also play a
+// playlist, moving to the next track whenever one ends.
 type Bgm struct {
 	filename     string
 	bgmVolume    int
@@ -151,91 +253,468 @@ type Bgm struct {
 	streamer     beep.StreamSeekCloser
 	ctrl         *beep.Ctrl
 	volctrl      *effects.Volume
+	fader        *bgmFader
 	format       string
+	sampleRate   beep.SampleRate
+	mixer        *beep.Mixer
+	layers       map[string]*bgmLayer
+	playlist     []string
+	playlistPos  int
+	shuffle      bool
+	soundFont    string
+	midiTempo    float64
+	midiVolume   [midiChannels]float64
+	midiMute     [midiChannels]bool
+}
+
+type bgmLayer struct {
+	streamer beep.StreamSeekCloser
+	volctrl  *effects.Volume
+	fader    *bgmFader
 }
 
 func newBgm() *Bgm {
-	return &Bgm{}
+	return &Bgm{mixer: &beep.Mixer{}, layers: make(map[string]*bgmLayer)}
 }
 
-func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd, startPosition int) {
+// Plays a music file, crossfading from the current one over fade ticks.
+// MIDI files are played with soundFont, or the default one if it's empty.
+func (bgm *Bgm) Open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd, startPosition, fade int, soundFont string) {
+	bgm.playlist = nil
+	bgm.setSoundFont(soundFont)
+	bgm.open(filename, loop, bgmVolume, bgmLoopStart, bgmLoopEnd, startPosition, fade)
+}
+
+func (bgm *Bgm) open(filename string, loop, bgmVolume, bgmLoopStart, bgmLoopEnd, startPosition, fade int) {
 	bgm.filename = filename
 	bgm.loop = loop
 	bgm.bgmVolume = bgmVolume
 	bgm.bgmLoopStart = bgmLoopStart
 	bgm.bgmLoopEnd = bgmLoopEnd
-	// Starve the current music streamer
-	if bgm.ctrl != nil {
-		speaker.Lock()
-		bgm.ctrl.Streamer = nil
-		speaker.Unlock()
+	// All music goes through one control, so that it is paused together
+	if bgm.ctrl == nil {
+		bgm.ctrl = &beep.Ctrl{Streamer: bgm.mixer}
+		sys.audioBuses.Add(AB_Bgm, bgm.ctrl)
 	}
+	// Fade out the current music and its layers
+	crossfade := fade > 0 && bgm.fader != nil
+	speaker.Lock()
+	if bgm.fader != nil {
+		bgm.fader.fadeTo(0, fade, true)
+	}
+	for _, l := range bgm.layers {
+		l.fader.fadeTo(0, fade, true)
+	}
+	speaker.Unlock()
+	bgm.fader, bgm.layers = nil, make(map[string]*bgmLayer)
 	// Special value "" is used to stop music
 	if filename == "" {
 		return
 	}
 
-	f, err := os.Open(bgm.filename)
+	s, format, name, err := bgm.decode(filename)
 	if err != nil {
-		sys.bgm = *newBgm()
-		sys.errLog.Printf("Failed to open bgm: %v", err)
+		bgm.streamer, bgm.volctrl = nil, nil
+		sys.errLog.Printf("Failed to load bgm: %v", err)
 		return
 	}
-	var format beep.Format
-	if HasExtension(bgm.filename, ".ogg") {
-		bgm.streamer, format, err = vorbis.Decode(f)
-		bgm.format = "ogg"
-	} else if HasExtension(bgm.filename, ".mp3") {
-		bgm.streamer, format, err = mp3.Decode(f)
-		bgm.format = "mp3"
-	} else if HasExtension(bgm.filename, ".wav") {
-		bgm.streamer, format, err = wav.Decode(f)
-		bgm.format = "wav"
-		// TODO: Reactivate FLAC support. Check that seeking/looping works correctly.
-		//} else if HasExtension(bgm.filename, ".flac") {
-		//	bgm.streamer, format, err = flac.Decode(f)
-		//	bgm.format = "flac"
-	} else if HasExtension(bgm.filename, ".mid") || HasExtension(bgm.filename, ".midi") {
-		if soundfont, sferr := loadSoundFont(audioSoundFont); sferr != nil {
-			err = sferr
-		} else {
-			bgm.streamer, format, err = midi.Decode(f, soundfont)
-			bgm.format = "midi"
+	bgm.streamer, bgm.format, bgm.sampleRate = s, name, format.SampleRate
+
+	// Loop points not given by the def file are read from the file's tags
+	if bgm.bgmLoopStart <= 0 || bgm.bgmLoopEnd <= 0 {
+		if start, end, ok := bgmLoopPoints(bgm.filename); ok {
+			if bgm.bgmLoopStart <= 0 {
+				bgm.bgmLoopStart = start
+			}
+			if bgm.bgmLoopEnd <= 0 {
+				bgm.bgmLoopEnd = end
+			}
 		}
-	} else {
-		err = Error(fmt.Sprintf("unsupported file extension: %v", bgm.filename))
 	}
+
+	bgm.applyMidi(bgm.streamer)
+	bgm.volctrl, bgm.fader = bgm.newTrack(bgm.streamer, format, bgm.bgmLoopStart, bgm.bgmLoopEnd)
+	if crossfade {
+		bgm.fader.gain = 0
+		bgm.fader.fadeTo(1, fade, false)
+	}
+	bgm.UpdateVolume()
+	bgm.streamer.Seek(startPosition)
+	speaker.Lock()
+	bgm.mixer.Add(bgm.fader)
+	speaker.Unlock()
+}
+
+func (bgm *Bgm) decode(filename string) (beep.StreamSeekCloser, beep.Format, string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, beep.Format{}, "", err
+	}
+	s, format, name, err := decodeBgm(f, filename, bgm.soundFont)
 	if err != nil {
 		f.Close()
-		sys.errLog.Printf("Failed to load bgm: %v", err)
-		return
 	}
+	return s, format, name, err
+}
 
+// Returns the volume control and the fader of a track, which loops like the
+// current music.
+func (bgm *Bgm) newTrack(s beep.StreamSeekCloser, format beep.Format,
+	loopStart, loopEnd int) (*effects.Volume, *bgmFader) {
 	loopCount := int(1)
-	if loop > 0 {
+	if bgm.loop > 0 {
 		loopCount = -1
 	}
 	//streamer := beep.Loop(loopCount, bgm.streamer)
-	streamer := BgmLooper(bgm.streamer, loopCount, bgm.bgmLoopStart, bgm.bgmLoopEnd)
-	bgm.volctrl = &effects.Volume{Streamer: streamer, Base: 2, Volume: 0, Silent: true}
-	resampler := beep.Resample(audioResampleQuality, format.SampleRate, audioFrequency, bgm.volctrl)
-	bgm.ctrl = &beep.Ctrl{Streamer: resampler}
+	streamer := BgmLooper(s, loopCount, loopStart, loopEnd)
+	volctrl := &effects.Volume{Streamer: streamer, Base: 2, Volume: 0, Silent: true}
+	resampler := beep.Resample(audioResampleQuality, format.SampleRate, audioFrequency, volctrl)
+	return volctrl, &bgmFader{s: resampler, closer: s, gain: 1, target: 1}
+}
+
+// Plays a layer along with the current music, starting from the same
+// position, and fades it in to volume (0-100) over fade ticks. If the layer
+// is already playing, it is only faded to the new volume.
+func (bgm *Bgm) SetLayer(filename string, volume, fade int) {
+	gain := float64(Clamp(int32(volume), 0, 100)) / 100
+	if l, ok := bgm.layers[filename]; ok {
+		speaker.Lock()
+		l.fader.fadeTo(gain, fade, false)
+		speaker.Unlock()
+		return
+	}
+	if bgm.fader == nil {
+		return
+	}
+	s, format, _, err := bgm.decode(filename)
+	if err != nil {
+		sys.errLog.Printf("Failed to load bgm layer: %v", err)
+		return
+	}
+	// Loop points and positions are in samples of each file's own rate
+	scale := func(pos int) int {
+		return int(int64(pos) * int64(format.SampleRate) / int64(bgm.sampleRate))
+	}
+	l := &bgmLayer{streamer: s}
+	bgm.applyMidi(s)
+	l.volctrl, l.fader = bgm.newTrack(s, format, scale(bgm.bgmLoopStart), scale(bgm.bgmLoopEnd))
+	l.fader.gain = 0
+	l.fader.fadeTo(gain, fade, false)
+	bgm.layers[filename] = l
 	bgm.UpdateVolume()
-	bgm.streamer.Seek(startPosition)
-	speaker.Play(bgm.ctrl)
+	speaker.Lock()
+	if err := s.Seek(scale(bgm.streamer.Position())); err == nil {
+		bgm.mixer.Add(l.fader)
+	}
+	speaker.Unlock()
+}
+
+// Fades a layer out over fade ticks and removes it.
+func (bgm *Bgm) StopLayer(filename string, fade int) {
+	if l, ok := bgm.layers[filename]; ok {
+		speaker.Lock()
+		l.fader.fadeTo(0, fade, true)
+		speaker.Unlock()
+		delete(bgm.layers, filename)
+	}
+}
+
+// Plays music files one after another, in a random order if shuffle is set,
+// crossfading from the current music to the first one over fade ticks.
+func (bgm *Bgm) Playlist(files []string, shuffle bool, bgmVolume, fade int, soundFont string) {
+	bgm.playlist, bgm.shuffle, bgm.playlistPos = files, shuffle, -1
+	bgm.bgmVolume = bgmVolume
+	bgm.setSoundFont(soundFont)
+	bgm.next(fade)
+}
+
+func (bgm *Bgm) next(fade int) {
+	if len(bgm.playlist) == 0 {
+		return
+	}
+	pos := (bgm.playlistPos + 1) % len(bgm.playlist)
+	// Don't play the same track twice in a row when shuffling
+	if bgm.shuffle {
+		if bgm.playlistPos < 0 {
+			pos = rand.Intn(len(bgm.playlist))
+		} else if len(bgm.playlist) > 1 {
+			pos = (bgm.playlistPos + 1 + rand.Intn(len(bgm.playlist)-1)) % len(bgm.playlist)
+		}
+	}
+	bgm.playlistPos = pos
+	bgm.open(bgm.playlist[pos], 0, bgm.bgmVolume, 0, 0, 0, fade)
+}
+
+// Sets the soundfont of the MIDI music to come, which starts at its own tempo
+// with every channel playing.
+func (bgm *Bgm) setSoundFont(soundFont string) {
+	if soundFont == "" {
+		soundFont = sys.soundFont
+	}
+	bgm.soundFont, bgm.midiTempo = soundFont, 1
+	for i := range bgm.midiVolume {
+		bgm.midiVolume[i], bgm.midiMute[i] = 1, false
+	}
+}
+
+// Applies the tempo and channel settings to a MIDI track.
+func (bgm *Bgm) applyMidi(s beep.Streamer) {
+	if d, ok := s.(*midiDecoder); ok {
+		d.SetTempo(bgm.midiTempo)
+		for i := range bgm.midiVolume {
+			d.SetChannel(int32(i), bgm.midiVolume[i], bgm.midiMute[i])
+		}
+	}
+}
+
+// Sets the tempo of MIDI music and its layers, as a multiplier of their own,
+// until other music is played.
+func (bgm *Bgm) SetMidiTempo(tempo float64) {
+	bgm.midiTempo = tempo
+	bgm.updateMidi()
+}
+
+// Sets the volume (0-1) of a channel (0-15) of MIDI music and its layers,
+// and whether it is muted, until other music is played.
+func (bgm *Bgm) SetMidiChannel(ch int32, volume float64, mute bool) {
+	if ch < 0 || ch >= midiChannels {
+		return
+	}
+	bgm.midiVolume[ch], bgm.midiMute[ch] = volume, mute
+	bgm.updateMidi()
+}
+
+func (bgm *Bgm) updateMidi() {
+	speaker.Lock()
+	if bgm.fader != nil {
+		bgm.applyMidi(bgm.streamer)
+	}
+	for _, l := range bgm.layers {
+		bgm.applyMidi(l.streamer)
+	}
+	speaker.Unlock()
 }
 
-func loadSoundFont(filename string) (*midi.SoundFont, error) {
+// Moves to the next track of the playlist once the current one has ended.
+// Called every tick.
+func (bgm *Bgm) update() {
+	if len(bgm.playlist) == 0 || bgm.fader == nil {
+		return
+	}
+	speaker.Lock()
+	ended := bgm.fader.ended
+	speaker.Unlock()
+	if ended {
+		bgm.next(0)
+	}
+}
+
+// bgmFader ramps the gain of a music track linearly. Once it is faded out to
+// stop, or the track ends, it closes the track and ends, so that the mixer
+// drops it.
+type bgmFader struct {
+	s                  beep.Streamer
+	closer             io.Closer
+	gain, target, step float64
+	stop, ended        bool
+}
+
+// Must be called with the speaker locked once the fader has been added.
+func (f *bgmFader) fadeTo(target float64, fade int, stop bool) {
+	f.target, f.stop = target, stop
+	if samples := int64(fade) * audioFrequency / int64(FPS); samples > 0 {
+		f.step = (target - f.gain) / float64(samples)
+	} else {
+		f.gain, f.step = target, 0
+	}
+}
+
+func (f *bgmFader) Stream(samples [][2]float64) (n int, ok bool) {
+	if f.ended || f.stop && f.gain == f.target {
+		f.end()
+		return 0, false
+	}
+	n, ok = f.s.Stream(samples)
+	for i := range samples[:n] {
+		if f.gain != f.target {
+			f.gain += f.step
+			if f.step > 0 && f.gain > f.target || f.step < 0 && f.gain < f.target {
+				f.gain = f.target
+			}
+		}
+		samples[i][0] *= f.gain
+		samples[i][1] *= f.gain
+	}
+	if !ok {
+		f.end()
+	}
+	return n, ok
+}
+
+func (f *bgmFader) end() {
+	if !f.ended {
+		f.ended = true
+		f.closer.Close()
+	}
+}
+
+func (f *bgmFader) Err() error {
+	return f.s.Err()
+}
+
+// Returns a streamer of a music file, its format and the name of its format.
+// MIDI files are played with the soundfont file given.
+func decodeBgm(f *os.File, filename, soundFont string) (s beep.StreamSeekCloser, format beep.Format, name string, err error) {
+	if HasExtension(filename, ".ogg") {
+		s, format, err = vorbis.Decode(f)
+		name = "ogg"
+	} else if HasExtension(filename, ".mp3") {
+		if s, format, err = mp3.Decode(f); err == nil {
+			s = &mp3Seeker{s}
+		}
+		name = "mp3"
+	} else if HasExtension(filename, ".wav") {
+		s, format, err = wav.Decode(f)
+		name = "wav"
+	} else if HasExtension(filename, ".flac") {
+		s, format, err = flacDecode(f)
+		name = "flac"
+	} else if HasExtension(filename, ".opus") {
+		// opusfile reads from memory, so the file isn't kept open
+		var data []byte
+		if data, err = io.ReadAll(f); err == nil {
+			var d *opusDecoder
+			if d, format, err = opusDecode(data); err == nil {
+				f.Close()
+				s = d
+			}
+		}
+		name = "opus"
+	} else if HasExtension(filename, ".mid") || HasExtension(filename, ".midi") {
+		if sf, sferr := loadSoundFont(soundFont); sferr != nil {
+			err = sferr
+		} else if d, dformat, derr := decodeMidi(f, sf); derr != nil {
+			err = derr
+		} else {
+			s, format = d, dformat
+			name = "midi"
+		}
+	} else {
+		err = Error(fmt.Sprintf("unsupported file extension: %v", filename))
+	}
+	return
+}
+
+// Number of samples decoded before the position an MP3 file seeks to.
+const mp3SeekPreroll = 8192
+
+// mp3Seeker makes MP3 seeking sample accurate. A frame can start its data in
+// the frames before it (the bit reservoir), but go-mp3 only decodes the one
+// frame before the position, which isn't enough at low bit rates.
+type mp3Seeker struct {
+	beep.StreamSeekCloser
+}
+
+func (m *mp3Seeker) Seek(p int) error {
+	pos := p - mp3SeekPreroll
+	if pos < 0 {
+		pos = 0
+	}
+	if err := m.StreamSeekCloser.Seek(pos); err != nil {
+		return err
+	}
+	var buf [512][2]float64
+	for pos < p {
+		n, ok := m.Stream(buf[:Min(int32(len(buf)), int32(p-pos))])
+		if !ok || n == 0 {
+			break
+		}
+		pos += n
+	}
+	return m.Err()
+}
+
+// Returns the loop points of a music file, in samples, from its Ogg, Opus or
+// FLAC LOOPSTART and LOOPLENGTH (or LOOPEND) comments, its WAV smpl chunk or
+// its MIDI CC111 marker.
+func bgmLoopPoints(filename string) (start, end int, ok bool) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, err
+		return
 	}
-	soundfont, err := midi.NewSoundFont(f)
-	if err != nil {
-		f.Close()
-		return nil, err
+	defer f.Close()
+	var comments []string
+	switch {
+	case HasExtension(filename, ".ogg"):
+		if r, err := oggvorbis.NewReader(f); err == nil {
+			comments = r.CommentHeader().Comments
+		}
+	case HasExtension(filename, ".flac"):
+		if d, _, err := flacDecode(f); err == nil {
+			comments = d.comments
+		}
+	case HasExtension(filename, ".opus"):
+		if data, err := io.ReadAll(f); err == nil {
+			if d, _, err := opusDecode(data); err == nil {
+				comments = d.comments
+				d.Close()
+			}
+		}
+	case HasExtension(filename, ".wav"):
+		return wavLoopPoints(f)
+	case HasExtension(filename, ".mid") || HasExtension(filename, ".midi"):
+		return midiLoopPoints(f)
+	}
+	tags := make(map[string]int)
+	for _, c := range comments {
+		if i := strings.IndexByte(c, '='); i >= 0 {
+			if v, err := strconv.Atoi(strings.TrimSpace(c[i+1:])); err == nil {
+				tags[strings.ToUpper(c[:i])] = v
+			}
+		}
+	}
+	start, ok = tags["LOOPSTART"]
+	if l, lok := tags["LOOPLENGTH"]; lok {
+		end = start + l
+	} else if e, eok := tags["LOOPEND"]; eok {
+		end = e
+	}
+	// Without an end, the loop goes to the end of the file
+	return start, end, ok && (end == 0 || end > start)
+}
+
+// Returns the first loop of a WAV file's smpl chunk.
+func wavLoopPoints(f *os.File) (start, end int, ok bool) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil ||
+		string(hdr[:4]) != "RIFF" || string(hdr[8:]) != "WAVE" {
+		return
+	}
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if binary.Read(f, binary.LittleEndian, &chunk) != nil {
+			return
+		}
+		if string(chunk.ID[:]) != "smpl" {
+			if _, err := f.Seek(int64(chunk.Size+chunk.Size&1), io.SeekCurrent); err != nil {
+				return
+			}
+			continue
+		}
+		// 36 bytes of header, with the number of loops at 28, then the
+		// loops, whose end sample is included
+		data := make([]byte, chunk.Size)
+		if _, err := io.ReadFull(f, data); err != nil || len(data) < 36+24 ||
+			binary.LittleEndian.Uint32(data[28:]) == 0 {
+			return
+		}
+		start = int(binary.LittleEndian.Uint32(data[36+8:]))
+		end = int(binary.LittleEndian.Uint32(data[36+12:])) + 1
+		return start, end, end > start
 	}
-	return soundfont, nil
 }
 
 func (bgm *Bgm) SetPaused(pause bool) {
@@ -260,49 +739,161 @@ func (bgm *Bgm) UpdateVolume() {
 	speaker.Lock()
 	bgm.volctrl.Volume = volume
 	bgm.volctrl.Silent = silent
+	for _, l := range bgm.layers {
+		l.volctrl.Volume = volume
+		l.volctrl.Silent = silent
+	}
 	speaker.Unlock()
 }
 
 // ------------------------------------------------------------------
 // Sound
 
+// Sound holds decoded samples, resampled to the output rate, so that playing
+// it needs no decoding. Mono sounds are kept mono to halve their memory.
 type Sound struct {
-	wavData []byte
-	format  beep.Format
-	length  int
+	pcm    []float32 // interleaved, format.NumChannels per frame
+	format beep.Format
+	length int
 }
 
 func readSound(f *os.File, size uint32) (*Sound, error) {
 	if size < 128 {
 		return nil, fmt.Errorf("wav size is too small")
 	}
-	wavData := make([]byte, size)
-	if _, err := f.Read(wavData); err != nil {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
 		return nil, err
 	}
-	// Decode the sound at least once, so that we know the format is OK
-	s, fmt, err := wav.Decode(bytes.NewReader(wavData))
+	var s beep.StreamSeeker
+	var format beep.Format
+	var err error
+	if bytes.HasPrefix(data, []byte("fLaC")) {
+		s, format, err = flacDecode(bytes.NewReader(data))
+	} else if bytes.HasPrefix(data, []byte("OggS")) {
+		if bytes.Contains(data[:64], []byte("OpusHead")) {
+			var d *opusDecoder
+			if d, format, err = opusDecode(data); err == nil {
+				defer d.Close()
+				s = d
+			}
+		} else {
+			s, format, err = vorbis.Decode(io.NopCloser(bytes.NewReader(data)))
+		}
+	} else {
+		s, format, err = wav.Decode(bytes.NewReader(data))
+	}
 	if err != nil {
 		return nil, err
 	}
-	// Check if the file can be fully played
+	return decodeSound(s, format)
+}
+
+// Decodes and resamples a whole sound. Returns nil if it can't be fully
+// decoded, so that it's disabled rather than freezing the engine.
+func decodeSound(s beep.StreamSeeker, format beep.Format) (*Sound, error) {
+	var src beep.Streamer = s
+	if format.SampleRate != audioFrequency {
+		src = beep.Resample(audioResampleQuality, format.SampleRate, audioFrequency, s)
+	}
+	channels := 2
+	if format.NumChannels == 1 {
+		channels = 1
+	}
+	// Decoders that know their length don't need the slice to grow
+	frames := int(float64(s.Len())*float64(audioFrequency)/float64(format.SampleRate)) + 1
+	pcm := make([]float32, 0, frames*channels)
 	var samples [512][2]float64
 	for {
-		sn, _ := s.Stream(samples[:])
-		if sn == 0 {
-			// If sound wasn't able to be fully played, we disable it to avoid engine freezing
-			if s.Position() < s.Len() {
-				return nil, nil
+		n, _ := src.Stream(samples[:])
+		if n == 0 {
+			break
+		}
+		for _, v := range samples[:n] {
+			if channels == 1 {
+				pcm = append(pcm, float32(v[0]))
+			} else {
+				pcm = append(pcm, float32(v[0]), float32(v[1]))
 			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if s.Position() < s.Len() {
+		return nil, nil
+	}
+	return &Sound{pcm, beep.Format{SampleRate: audioFrequency, NumChannels: channels,
+		Precision: format.Precision}, len(pcm) / channels}, nil
+}
+
+// Returns the RMS and peak levels of frames [from, to), over both channels.
+// Frames past the end wrap around if loop is set, or are silent otherwise.
+func (s *Sound) levels(from, to int, loop bool) (rms, peak float32) {
+	if to <= from || s.length == 0 {
+		return 0, 0
+	}
+	ch := s.format.NumChannels
+	var sum, max float64
+	for i := from; i < to; i++ {
+		f := i
+		if loop {
+			f %= s.length
+		} else if f >= s.length {
 			break
 		}
+		for _, v := range s.pcm[f*ch : (f+1)*ch] {
+			sum += float64(v) * float64(v)
+			max = math.Max(max, math.Abs(float64(v)))
+		}
 	}
-	return &Sound{wavData, fmt, s.Len()}, nil
+	return float32(math.Sqrt(sum / float64((to-from)*ch))), float32(max)
 }
 
 func (s *Sound) GetStreamer() beep.StreamSeeker {
-	streamer, _, _ := wav.Decode(bytes.NewReader(s.wavData))
-	return streamer
+	return &pcmStreamer{pcm: s.pcm, channels: s.format.NumChannels}
+}
+
+// pcmStreamer plays decoded samples, which are shared by every streamer of
+// a sound. Mono samples are played on both channels.
+type pcmStreamer struct {
+	pcm      []float32
+	channels int
+	pos      int
+}
+
+func (p *pcmStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	length := p.Len()
+	if p.pos >= length {
+		return 0, false
+	}
+	for n < len(samples) && p.pos < length {
+		if p.channels == 1 {
+			v := float64(p.pcm[p.pos])
+			samples[n] = [2]float64{v, v}
+		} else {
+			samples[n] = [2]float64{float64(p.pcm[p.pos*2]), float64(p.pcm[p.pos*2+1])}
+		}
+		n++
+		p.pos++
+	}
+	return n, true
+}
+func (p *pcmStreamer) Err() error {
+	return nil
+}
+func (p *pcmStreamer) Len() int {
+	return len(p.pcm) / p.channels
+}
+func (p *pcmStreamer) Position() int {
+	return p.pos
+}
+func (p *pcmStreamer) Seek(pos int) error {
+	if pos < 0 || pos > p.Len() {
+		return fmt.Errorf("seek position %v out of range [0, %v]", pos, p.Len())
+	}
+	p.pos = pos
+	return nil
 }
 
 // ------------------------------------------------------------------
@@ -435,6 +1026,7 @@ type SoundEffect struct {
 	priority int32
 	channel  int32
 	loop     int32
+	dsp      SoundDSP
 }
 
 func (s *SoundEffect) Stream(samples [][2]float64) (n int, ok bool) {
@@ -473,25 +1065,36 @@ type SoundChannel struct {
 	sfx      *SoundEffect
 	ctrl     *beep.Ctrl
 	sound    *Sound
+	freqmul  float32
+	// Frames of the sound played since the last tick and until now, for
+	// soundLevel. They follow game ticks rather than the audio thread, so
+	// that the level doesn't depend on when the speaker pulls samples.
+	prevPos, pos float64
 }
 
-func (s *SoundChannel) Play(sound *Sound, loop bool, freqmul float32) {
+func (s *SoundChannel) Play(sound *Sound, bus AudioBusType, loop bool, freqmul float32) {
 	if sound == nil {
 		return
 	}
 	s.sound = sound
 	s.streamer = s.sound.GetStreamer()
+	s.freqmul, s.prevPos, s.pos = freqmul, 0, 0
 	loopCount := int(1)
 	if loop {
 		loopCount = -1
 	}
 	looper := beep.Loop(loopCount, s.streamer)
-	s.sfx = &SoundEffect{streamer: looper, volume: 256, priority: 0, channel: -1, loop: int32(loopCount)}
-	srcRate := s.sound.format.SampleRate
-	dstRate := beep.SampleRate(audioFrequency / freqmul)
-	resampler := beep.Resample(audioResampleQuality, srcRate, dstRate, s.sfx)
-	s.ctrl = &beep.Ctrl{Streamer: resampler}
-	sys.soundMixer.Add(s.ctrl)
+	s.sfx = &SoundEffect{streamer: looper, volume: 256, priority: 0, channel: -1, loop: int32(loopCount),
+		dsp: newSoundDSP()}
+	// Sounds are already at the output rate, so only frequency changes
+	// need resampling
+	var streamer beep.Streamer = s.sfx
+	if freqmul != 1 {
+		dstRate := beep.SampleRate(audioFrequency / freqmul)
+		streamer = beep.Resample(audioResampleQuality, s.sound.format.SampleRate, dstRate, s.sfx)
+	}
+	s.ctrl = &beep.Ctrl{Streamer: newDSPStreamer(streamer, &s.sfx.dsp, &sys.audioBuses[bus])}
+	sys.audioBuses.Add(bus, s.ctrl)
 }
 func (s *SoundChannel) IsPlaying() bool {
 	return s.sound != nil
@@ -504,6 +1107,20 @@ func (s *SoundChannel) Stop() {
 	}
 	s.sound = nil
 }
+
+// Returns the RMS or peak level of the channel's sound over the last tick,
+// at the channel's volume. Pan, DSP effects and the player's audio settings
+// aren't included, as they don't change what the game plays.
+func (s *SoundChannel) Level(peak bool) float32 {
+	if !s.IsPlaying() {
+		return 0
+	}
+	rms, pk := s.sound.levels(int(s.prevPos), int(s.pos), s.sfx.loop == -1)
+	if peak {
+		return pk * s.sfx.volume / 256
+	}
+	return rms * s.sfx.volume / 256
+}
 func (s *SoundChannel) SetVolume(vol float32) {
 	if s.ctrl != nil {
 		s.sfx.volume = ClampF(vol, 0, 512)
@@ -516,6 +1133,11 @@ func (s *SoundChannel) SetPan(p, ls float32, x *float32) {
 		s.sfx.p = p * ls
 	}
 }
+func (s *SoundChannel) SetDSP(dsp SoundDSP) {
+	if s.ctrl != nil {
+		s.sfx.dsp = dsp
+	}
+}
 func (s *SoundChannel) SetPriority(priority int32) {
 	if s.ctrl != nil {
 		s.sfx.priority = priority
@@ -602,7 +1224,8 @@ func (s *SoundChannels) Play(sound *Sound, volumescale int32, pan float32) bool
 	if c == nil {
 		return false
 	}
-	c.Play(sound, false, 1.0)
+	c.Play(sound, AB_System, false, 1.0)
+	c.SetDSP(SoundDSP{})
 	c.SetVolume(float32(volumescale * 64 / 25))
 	c.SetPan(pan, 0, nil)
 	return true
@@ -631,10 +1254,18 @@ func (s *SoundChannels) StopAll() {
 }
 func (s *SoundChannels) Tick() {
 	for i := range s.channels {
-		if s.channels[i].IsPlaying() {
-			if s.channels[i].streamer.Position() >= s.channels[i].sound.length && s.channels[i].sfx.loop != -1 {
-				s.channels[i].sound = nil
+		if c := &s.channels[i]; c.IsPlaying() {
+			if c.streamer.Position() >= c.sound.length && c.sfx.loop != -1 {
+				c.sound = nil
+				continue
+			}
+			// The mix follows the game speed when time stretching is on
+			speed := float32(1)
+			if sys.audioTimeStretch != ATS_Off {
+				speed = ClampF(sys.audioSpeed, 0.25, 4)
 			}
+			c.prevPos = c.pos
+			c.pos += float64(audioFrequency) / float64(FPS) * float64(c.freqmul*speed)
 		}
 	}
 }
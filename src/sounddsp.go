@@ -0,0 +1,390 @@
+package main
+
+import (
+	"math"
+
+	"github.com/ikemen-engine/beep"
+)
+
+// ------------------------------------------------------------------
+// SoundDSP
+
+// SoundDSP holds the settings of a sound channel's effect chain. Zero values
+// disable each effect, except for reverb, where a negative send uses the
+// stage's default.
+type SoundDSP struct {
+	lowpass      float32 // cutoff in Hz
+	highpass     float32 // cutoff in Hz
+	reverb       float32 // send level to the shared reverb, 0 to 1
+	pitch        float32 // pitch ratio, without changing speed
+	echoDelay    float32 // in milliseconds
+	echoFeedback float32 // 0 to 0.95
+	echoMix      float32 // 0 to 1
+}
+
+func newSoundDSP() SoundDSP {
+	return SoundDSP{reverb: -1}
+}
+
+// Size of the pitch shifter's delay line, about 43 ms.
+const pitchWindow = 2048
+
+// dspStreamer runs a channel's output through its effect chain: filters,
+// pitch shifting, echo, and the reverb send. It is the last streamer of the
+// channel, so its samples line up with the mixer's. Once the channel's sound
+// ends, the echo is left to ring out.
+type dspStreamer struct {
+	s   beep.Streamer
+	dsp *SoundDSP
+	bus *AudioBus
+	// Filters, whose coefficients are updated when the cutoffs change
+	lp, hp             [2]biquad
+	lpCutoff, hpCutoff float32
+	pitch              pitchShifter
+	// Echo
+	echoBuf  [][2]float64
+	echoPos  int
+	tail     int
+	finished bool
+}
+
+func newDSPStreamer(s beep.Streamer, dsp *SoundDSP, bus *AudioBus) *dspStreamer {
+	return &dspStreamer{s: s, dsp: dsp, bus: bus}
+}
+
+func (d *dspStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	dsp := d.dsp
+	if !d.finished {
+		n, ok = d.s.Stream(samples)
+		if !ok {
+			d.finished = true
+			d.tail = d.echoTail()
+		}
+	}
+	// Let the echo ring out on silence
+	if d.finished {
+		m := int(Min(int32(len(samples)-n), int32(d.tail)))
+		for i := n; i < n+m; i++ {
+			samples[i] = [2]float64{}
+		}
+		n += m
+		d.tail -= m
+		if n == 0 {
+			return 0, false
+		}
+	}
+	if dsp.lowpass > 0 {
+		if d.lpCutoff != dsp.lowpass {
+			d.lpCutoff = dsp.lowpass
+			d.lp[0].setLowpass(float64(dsp.lowpass))
+			d.lp[1].coef = d.lp[0].coef
+		}
+		for i := range samples[:n] {
+			samples[i][0] = d.lp[0].process(samples[i][0])
+			samples[i][1] = d.lp[1].process(samples[i][1])
+		}
+	}
+	if dsp.highpass > 0 {
+		if d.hpCutoff != dsp.highpass {
+			d.hpCutoff = dsp.highpass
+			d.hp[0].setHighpass(float64(dsp.highpass))
+			d.hp[1].coef = d.hp[0].coef
+		}
+		for i := range samples[:n] {
+			samples[i][0] = d.hp[0].process(samples[i][0])
+			samples[i][1] = d.hp[1].process(samples[i][1])
+		}
+	}
+	if dsp.pitch > 0 && dsp.pitch != 1 {
+		d.pitch.process(samples[:n], float64(ClampF(dsp.pitch, 0.25, 4)))
+	}
+	if dsp.echoDelay > 0 {
+		d.echo(samples[:n])
+	}
+	send := float64(dsp.reverb)
+	if send < 0 {
+		send = sys.reverb.defaultSend
+	}
+	if send > 0 && d.bus != nil {
+		sys.reverb.send(samples[:n], math.Min(send, 1)*d.bus.gain)
+	}
+	return n, true
+}
+
+// Returns the RMS and peak levels of samples, over both channels.
+func audioLevels(samples [][2]float64) (rms, peak float32) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	var sum, max float64
+	for _, s := range samples {
+		for c := 0; c < 2; c++ {
+			sum += s[c] * s[c]
+			max = math.Max(max, math.Abs(s[c]))
+		}
+	}
+	return float32(math.Sqrt(sum / float64(2*len(samples)))), float32(max)
+}
+
+func (d *dspStreamer) Err() error {
+	return d.s.Err()
+}
+
+// pitchShifter shifts the pitch of samples without changing their speed,
+// with two taps reading a delay line at a different speed than it is
+// written, crossfaded so that each jumps back while silent.
+type pitchShifter struct {
+	buf [][2]float64
+	pos int
+	tap float64
+}
+
+func (p *pitchShifter) process(samples [][2]float64, ratio float64) {
+	const w = float64(pitchWindow)
+	if p.buf == nil {
+		p.buf = make([][2]float64, pitchWindow)
+	}
+	for i := range samples {
+		p.buf[p.pos] = samples[i]
+		var out [2]float64
+		for _, tap := range [2]float64{p.tap, math.Mod(p.tap+w/2, w)} {
+			gain := 1 - math.Abs(2*tap/w-1)
+			pos := float64(p.pos) - tap
+			if pos < 0 {
+				pos += w
+			}
+			i0 := int(pos)
+			i1, frac := (i0+1)%pitchWindow, pos-float64(i0)
+			for c := 0; c < 2; c++ {
+				out[c] += gain * (p.buf[i0][c]*(1-frac) + p.buf[i1][c]*frac)
+			}
+		}
+		samples[i] = out
+		p.pos = (p.pos + 1) % pitchWindow
+		if p.tap = math.Mod(p.tap+1-ratio, w); p.tap < 0 {
+			p.tap += w
+		}
+	}
+}
+
+func (d *dspStreamer) echo(samples [][2]float64) {
+	size := int(ClampF(d.dsp.echoDelay, 1, 2000) * audioFrequency / 1000)
+	if len(d.echoBuf) != size {
+		d.echoBuf, d.echoPos = make([][2]float64, size), 0
+	}
+	feedback := float64(ClampF(d.dsp.echoFeedback, 0, 0.95))
+	mix := float64(ClampF(d.dsp.echoMix, 0, 1))
+	for i := range samples {
+		e := &d.echoBuf[d.echoPos]
+		for c := 0; c < 2; c++ {
+			delayed := e[c]
+			e[c] = samples[i][c] + delayed*feedback
+			samples[i][c] += delayed * mix
+		}
+		d.echoPos = (d.echoPos + 1) % size
+	}
+}
+
+// Returns how many samples the echo takes to fade below -60 dB, up to 4
+// seconds.
+func (d *dspStreamer) echoTail() int {
+	if d.dsp.echoDelay <= 0 || d.dsp.echoMix <= 0 {
+		return 0
+	}
+	delay := float64(ClampF(d.dsp.echoDelay, 1, 2000)) * audioFrequency / 1000
+	repeats := 1.0
+	if fb := float64(ClampF(d.dsp.echoFeedback, 0, 0.95)); fb > 0 {
+		repeats += math.Log(0.001) / math.Log(fb)
+	}
+	return int(math.Min(delay*repeats, 4*audioFrequency))
+}
+
+// A second order filter, as in the Audio EQ Cookbook, with a Q of 1/sqrt(2).
+type biquad struct {
+	coef           [5]float64 // b0, b1, b2, a1, a2, divided by a0
+	x1, x2, y1, y2 float64
+}
+
+func (b *biquad) set(cutoff float64, high bool) {
+	w0 := 2 * math.Pi * math.Max(10, math.Min(cutoff, audioFrequency*0.45)) / audioFrequency
+	cos, alpha := math.Cos(w0), math.Sin(w0)/math.Sqrt2
+	a0 := 1 + alpha
+	if high {
+		b.coef = [5]float64{(1 + cos) / 2, -(1 + cos), (1 + cos) / 2, -2 * cos, 1 - alpha}
+	} else {
+		b.coef = [5]float64{(1 - cos) / 2, 1 - cos, (1 - cos) / 2, -2 * cos, 1 - alpha}
+	}
+	for i := range b.coef {
+		b.coef[i] /= a0
+	}
+}
+func (b *biquad) setLowpass(cutoff float64) {
+	b.set(cutoff, false)
+}
+func (b *biquad) setHighpass(cutoff float64) {
+	b.set(cutoff, true)
+}
+func (b *biquad) process(x float64) float64 {
+	c := &b.coef
+	y := c[0]*x + c[1]*b.x1 + c[2]*b.x2 - c[3]*b.y1 - c[4]*b.y2
+	b.x2, b.x1, b.y2, b.y1 = b.x1, x, b.y1, y
+	return y
+}
+
+// ------------------------------------------------------------------
+// Reverb
+
+// Reverb is a Freeverb style reverb shared by all sound channels, which feed
+// it through their reverb send while they are mixed. It is mixed after the
+// sound effect buses, so it receives their sends for the same samples.
+type Reverb struct {
+	in          [][2]float64
+	combs       [2][4]reverbComb
+	allpasses   [2][2]reverbAllpass
+	feedback    float64
+	damping     float64
+	wet         float64
+	defaultSend float64
+}
+
+// Delay line lengths at 44100 Hz, and the right channel's offset.
+var (
+	reverbCombTuning    = [4]int{1116, 1188, 1277, 1356}
+	reverbAllpassTuning = [2]int{556, 441}
+	reverbStereoSpread  = 23
+)
+
+func newReverb() *Reverb {
+	r := &Reverb{}
+	scale := func(n int) int {
+		return n * audioFrequency / 44100
+	}
+	for c := 0; c < 2; c++ {
+		for i, n := range reverbCombTuning {
+			r.combs[c][i].buf = make([]float64, scale(n+c*reverbStereoSpread))
+		}
+		for i, n := range reverbAllpassTuning {
+			r.allpasses[c][i].buf = make([]float64, scale(n+c*reverbStereoSpread))
+		}
+	}
+	r.Set(StageReverb{RoomSize: 0.5, Damping: 0.5, Wet: 1})
+	return r
+}
+
+// StageReverb holds a stage's reverb settings, from its [Reverb] section.
+type StageReverb struct {
+	RoomSize float32
+	Damping  float32
+	Wet      float32
+	Send     float32 // default send of the sounds that don't set one
+}
+
+// Must be called with the speaker locked, or before it plays.
+func (r *Reverb) Set(sr StageReverb) {
+	r.feedback = 0.7 + 0.28*float64(ClampF(sr.RoomSize, 0, 1))
+	r.damping = 0.4 * float64(ClampF(sr.Damping, 0, 1))
+	r.wet = float64(ClampF(sr.Wet, 0, 1))
+	r.defaultSend = float64(ClampF(sr.Send, 0, 1))
+}
+
+// Adds samples to the reverb input.
+func (r *Reverb) send(samples [][2]float64, level float64) {
+	if len(r.in) < len(samples) {
+		r.in = append(r.in, make([][2]float64, len(samples)-len(r.in))...)
+	}
+	for i := range samples {
+		r.in[i][0] += samples[i][0] * level
+		r.in[i][1] += samples[i][1] * level
+	}
+}
+
+func (r *Reverb) Stream(samples [][2]float64) (n int, ok bool) {
+	if len(r.in) < len(samples) {
+		r.in = append(r.in, make([][2]float64, len(samples)-len(r.in))...)
+	}
+	for i := range samples {
+		// Freeverb's fixed input gain
+		in := (r.in[i][0] + r.in[i][1]) * 0.015
+		for c := 0; c < 2; c++ {
+			var out float64
+			for j := range r.combs[c] {
+				out += r.combs[c][j].process(in, r.feedback, r.damping)
+			}
+			for j := range r.allpasses[c] {
+				out = r.allpasses[c][j].process(out)
+			}
+			samples[i][c] = out * r.wet
+		}
+		r.in[i] = [2]float64{}
+	}
+	return len(samples), true
+}
+
+func (r *Reverb) Err() error {
+	return nil
+}
+
+type reverbComb struct {
+	buf    []float64
+	pos    int
+	filter float64
+}
+
+func (c *reverbComb) process(in, feedback, damping float64) float64 {
+	out := c.buf[c.pos]
+	c.filter = out*(1-damping) + c.filter*damping
+	c.buf[c.pos] = in + c.filter*feedback
+	c.pos = (c.pos + 1) % len(c.buf)
+	return out
+}
+
+type reverbAllpass struct {
+	buf []float64
+	pos int
+}
+
+func (a *reverbAllpass) process(in float64) float64 {
+	delayed := a.buf[a.pos]
+	a.buf[a.pos] = in + delayed*0.5
+	a.pos = (a.pos + 1) % len(a.buf)
+	return delayed - in
+}
+
+// ------------------------------------------------------------------
+// GameSpeedStreamer
+
+// Ways sounds follow the game speed, set by AudioTimeStretch in config.json.
+const (
+	ATS_Off int32 = iota
+	ATS_Resample
+	ATS_Stretch
+)
+
+// gameSpeedStreamer makes a mix follow the game speed, including slow
+// motion and the replay speed. Resampling changes the pitch along with the
+// speed; stretching shifts it back, so that only the speed changes.
+type gameSpeedStreamer struct {
+	s     *beep.Resampler
+	pitch pitchShifter
+}
+
+func newGameSpeedStreamer(s beep.Streamer) *gameSpeedStreamer {
+	return &gameSpeedStreamer{s: beep.ResampleRatio(audioResampleQuality, 1, s)}
+}
+
+func (g *gameSpeedStreamer) Stream(samples [][2]float64) (n int, ok bool) {
+	speed := 1.0
+	if sys.audioTimeStretch != ATS_Off {
+		speed = float64(ClampF(sys.audioSpeed, 0.25, 4))
+	}
+	g.s.SetRatio(speed)
+	n, ok = g.s.Stream(samples)
+	if sys.audioTimeStretch == ATS_Stretch && speed != 1 {
+		g.pitch.process(samples[:n], 1/speed)
+	}
+	return n, ok
+}
+
+func (g *gameSpeedStreamer) Err() error {
+	return g.s.Err()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpriteCache keeps the decoded pixels of SFF v2 sprites on disk, so that
+// LZ5, RLE and PNG data only has to be decompressed once. Every SFF file
+// gets one cache file, named after its path, size, modification time and a
+// hash of its headers, so an edited SFF never reads stale pixels. Cache
+// files are touched when used and the least recently used ones are removed
+// once the total size exceeds the limit. Palettes are not cached, since v2
+// stores them uncompressed, and neither are v1 files, whose PCX data decodes
+// about as fast as it is read.
+type SpriteCache struct {
+	dir   string
+	limit int64
+	mu    sync.Mutex
+}
+
+const spriteCacheMagic = "IKSC\x01\x00\x00\x00"
+
+// Returns nil, which disables the cache, if limit is not positive.
+func newSpriteCache(dir string, limit int64) *SpriteCache {
+	if limit <= 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		sys.errLog.Printf("Sprite cache disabled: %v\n", err)
+		return nil
+	}
+	return &SpriteCache{dir: dir, limit: limit}
+}
+
+type spriteCacheHeader struct {
+	Ofs         int64
+	W, H, Depth int32
+	Size        int32
+}
+
+type spriteCacheRecord struct {
+	pos             int64
+	w, h, depth, sz int32
+}
+
+type SpriteCacheEntry struct {
+	sc    *SpriteCache
+	path  string
+	old   *os.File
+	index map[int64]spriteCacheRecord
+	mu    sync.Mutex
+	tmp   *os.File
+	added int
+	err   error
+}
+
+// Returns the cache entry of an opened SFF v2 file, or nil if the cache is
+// disabled or the file can't be identified.
+func (sc *SpriteCache) open(filename string, f *os.File, h *SffHeader) *SpriteCacheEntry {
+	if sc == nil || h.Ver0 == 1 {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		abs = filename
+	}
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%v\x00%v\x00%v\x00", abs, fi.Size(), fi.ModTime().UnixNano())
+	// The file's headers, sprite nodes and palette nodes
+	for _, r := range [][2]int64{{0, 512},
+		{int64(h.FirstSpriteHeaderOffset), int64(h.NumberOfSprites) * 28},
+		{int64(h.FirstPaletteHeaderOffset), int64(h.NumberOfPalettes) * 16}} {
+		if _, err := io.Copy(hash, io.NewSectionReader(f, r[0], r[1])); err != nil {
+			return nil
+		}
+	}
+	e := &SpriteCacheEntry{sc: sc, index: make(map[int64]spriteCacheRecord),
+		path: filepath.Join(sc.dir, hex.EncodeToString(hash.Sum(nil))+".cache")}
+	if old, err := os.Open(e.path); err == nil {
+		if e.readIndex(old) == nil {
+			e.old = old
+			now := time.Now()
+			os.Chtimes(e.path, now, now)
+		} else {
+			old.Close()
+			e.index = make(map[int64]spriteCacheRecord)
+		}
+	}
+	return e
+}
+
+// Cache files are the magic string, the number of records and the records,
+// each being the sprite's data offset in the SFF, its size and color depth,
+// the length of its pixels and the pixels.
+func (e *SpriteCacheEntry) readIndex(f *os.File) error {
+	magic := make([]byte, len(spriteCacheMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != spriteCacheMagic {
+		return Error("invalid sprite cache file")
+	}
+	var count uint32
+	if err := binary.Read(f, binary.LittleEndian, &count); err != nil {
+		return err
+	}
+	pos := int64(len(spriteCacheMagic) + 4)
+	for i := uint32(0); i < count; i++ {
+		var hdr spriteCacheHeader
+		if err := binary.Read(f, binary.LittleEndian, &hdr); err != nil {
+			return err
+		}
+		pos += 24
+		e.index[hdr.Ofs] = spriteCacheRecord{pos, hdr.W, hdr.H, hdr.Depth, hdr.Size}
+		pos += int64(hdr.Size)
+		if _, err := f.Seek(pos, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the cached pixels of the sprite data at the given offset. Safe to
+// call from several goroutines.
+func (e *SpriteCacheEntry) get(ofs int64) (px []byte, w, h, depth int32, ok bool) {
+	if e == nil || e.old == nil {
+		return
+	}
+	r, found := e.index[ofs]
+	if !found {
+		return
+	}
+	px = make([]byte, r.sz)
+	if _, err := e.old.ReadAt(px, r.pos); err != nil {
+		return nil, 0, 0, 0, false
+	}
+	return px, r.w, r.h, r.depth, true
+}
+
+// Stores decoded pixels, which are written to the cache file on close.
+func (e *SpriteCacheEntry) put(ofs int64, px []byte, w, h, depth int32) {
+	if e == nil || len(px) == 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return
+	}
+	if e.tmp == nil {
+		if e.tmp, e.err = os.CreateTemp(e.sc.dir, "*.tmp"); e.err != nil {
+			return
+		}
+		// The number of records is written on close
+		_, e.err = e.tmp.Write([]byte(spriteCacheMagic + "\x00\x00\x00\x00"))
+	}
+	if e.err == nil {
+		e.err = binary.Write(e.tmp, binary.LittleEndian,
+			spriteCacheHeader{ofs, w, h, depth, int32(len(px))})
+	}
+	if e.err == nil {
+		_, e.err = e.tmp.Write(px)
+	}
+	e.added++
+}
+
+// Merges the newly decoded sprites with the previously cached ones and
+// replaces the cache file, then removes old cache files if needed.
+func (e *SpriteCacheEntry) close() {
+	if e == nil {
+		return
+	}
+	if e.tmp != nil {
+		count := e.added
+		if e.err == nil && e.old != nil {
+			for ofs, r := range e.index {
+				e.err = binary.Write(e.tmp, binary.LittleEndian,
+					spriteCacheHeader{ofs, r.w, r.h, r.depth, r.sz})
+				if e.err == nil {
+					_, e.err = io.Copy(e.tmp, io.NewSectionReader(e.old, r.pos, int64(r.sz)))
+				}
+				if e.err != nil {
+					break
+				}
+				count++
+			}
+		}
+		if e.err == nil {
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], uint32(count))
+			_, e.err = e.tmp.WriteAt(b[:], int64(len(spriteCacheMagic)))
+		}
+		if err := e.tmp.Close(); e.err == nil {
+			e.err = err
+		}
+	}
+	if e.old != nil {
+		e.old.Close()
+	}
+	if e.tmp != nil {
+		if e.err == nil {
+			e.err = os.Rename(e.tmp.Name(), e.path)
+		}
+		if e.err != nil {
+			sys.errLog.Printf("Failed to write sprite cache %v: %v\n", e.path, e.err)
+			os.Remove(e.tmp.Name())
+		}
+		e.sc.trim()
+	}
+}
+
+// Removes the least recently used cache files until they fit the limit.
+func (sc *SpriteCache) trim() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	dir, err := os.ReadDir(sc.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, de := range dir {
+		if !strings.HasSuffix(de.Name(), ".cache") {
+			continue
+		}
+		if fi, err := de.Info(); err == nil {
+			files = append(files, fi)
+			total += fi.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		if total <= sc.limit {
+			break
+		}
+		if os.Remove(filepath.Join(sc.dir, fi.Name())) == nil {
+			total -= fi.Size()
+		}
+	}
+}
@@ -283,8 +283,8 @@ func readBackGround(is IniSection, link *backGround,
 		if bg.actionno < 0 && len(bg.anim.frames) > 0 {
 			if spr := sff.GetSprite(
 				bg.anim.frames[0].Group, bg.anim.frames[0].Number); spr != nil {
-				bg.anim.tile.sx += int32(spr.Size[0])
-				bg.anim.tile.sy += int32(spr.Size[1])
+				bg.anim.tile.sx += int32(float32(spr.Size[0]) * spr.texelScale())
+				bg.anim.tile.sy += int32(float32(spr.Size[1]) * spr.texelScale())
 			}
 		} else {
 			if bg.anim.tile.sx == 0 {
@@ -356,9 +356,10 @@ func (bg *backGround) reset() {
 func (bg backGround) draw(pos [2]float32, scl, bgscl, lclscl float32,
 	stgscl [2]float32, shakeY float32, isStage bool) {
 	if bg.typ == 2 && (bg.width[0] != 0 || bg.width[1] != 0) && bg.anim.spr != nil {
-		bg.xscale[0] = float32(bg.width[0]) / float32(bg.anim.spr.Size[0])
-		bg.xscale[1] = float32(bg.width[1]) / float32(bg.anim.spr.Size[0])
-		bg.xofs = -float32(bg.width[0])/2 + float32(bg.anim.spr.Offset[0])*bg.xscale[0]
+		ts := bg.anim.spr.texelScale()
+		bg.xscale[0] = float32(bg.width[0]) / (float32(bg.anim.spr.Size[0]) * ts)
+		bg.xscale[1] = float32(bg.width[1]) / (float32(bg.anim.spr.Size[0]) * ts)
+		bg.xofs = -float32(bg.width[0])/2 + float32(bg.anim.spr.Offset[0])*ts*bg.xscale[0]
 	}
 	xras := (bg.rasterx[1] - bg.rasterx[0]) / bg.rasterx[0]
 	xbs, dx := bg.xscale[1], MaxF(0, bg.delta[0]*bgscl)
@@ -435,7 +436,7 @@ func (bg backGround) draw(pos [2]float32, scl, bgscl, lclscl float32,
 	rect[3] = int32(math.Floor(float64(startrect1 + (float32(rect[3]) * sys.heightScale * wscl[1]) - float32(rect[1]))))
 	if rect[0] < sys.scrrect[2] && rect[1] < sys.scrrect[3] && rect[0]+rect[2] > 0 && rect[1]+rect[3] > 0 {
 		bg.anim.Draw(&rect, x, y, sclx, scly, bg.xscale[0]*bgscl*(bg.scalestart[0]+xs)*xs3, xbs*bgscl*(bg.scalestart[0]+xs)*xs3, ys*ys3,
-			xras*x/(AbsF(ys*ys3)*lscl[1]*float32(bg.anim.spr.Size[1])*bg.scalestart[1])*sclx_recip*bg.scalestart[1],
+			xras*x/(AbsF(ys*ys3)*lscl[1]*float32(bg.anim.spr.Size[1])*bg.anim.spr.texelScale()*bg.scalestart[1])*sclx_recip*bg.scalestart[1],
 			Rotation{}, float32(sys.gameWidth)/2, bg.palfx, true, 1, false, 1, 0, 0)
 	}
 }
@@ -704,9 +705,11 @@ type Stage struct {
 	bgmvolume       int32
 	bgmloopstart    int32
 	bgmloopend      int32
+	bgmsoundfont    string
 	bgmratiolife    int32
 	bgmtriggerlife  int32
 	bgmtriggeralt   int32
+	reverb          StageReverb
 	mainstage       bool
 	stageCamera     stageCamera
 	stageTime       int32
@@ -896,10 +899,18 @@ func loadStage(def string, main bool) (*Stage, error) {
 		sec[0].ReadI32("bgmvolume", &s.bgmvolume)
 		sec[0].ReadI32("bgmloopstart", &s.bgmloopstart)
 		sec[0].ReadI32("bgmloopend", &s.bgmloopend)
+		s.bgmsoundfont = sec[0]["bgmsoundfont"]
 		sec[0].ReadI32("bgmratio.life", &s.bgmratiolife)
 		sec[0].ReadI32("bgmtrigger.life", &s.bgmtriggerlife)
 		sec[0].ReadI32("bgmtrigger.alt", &s.bgmtriggeralt)
 	}
+	s.reverb = StageReverb{RoomSize: 0.5, Damping: 0.5, Wet: 1}
+	if sec := defmap["reverb"]; len(sec) > 0 {
+		sec[0].ReadF32("roomsize", &s.reverb.RoomSize)
+		sec[0].ReadF32("damping", &s.reverb.Damping)
+		sec[0].ReadF32("wet", &s.reverb.Wet)
+		sec[0].ReadF32("send", &s.reverb.Send)
+	}
 	if sec := defmap["bgdef"]; len(sec) > 0 {
 		if sec[0].LoadFile("spr", []string{def, "", sys.motifDir, "data/"}, func(filename string) error {
 			sff, err := loadSff(filename, false)
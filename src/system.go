@@ -47,6 +47,11 @@ var sys = System{
 	team1VS2Life:      1,
 	turnsRecoveryRate: 1.0 / 300,
 	soundMixer:        &beep.Mixer{},
+	audioBuses:        newAudioBuses(),
+	reverb:            newReverb(),
+	audioSpeed:        1,
+	soundFont:         audioSoundFont,
+	audioOut:          &AudioOutput{},
 	bgm:               *newBgm(),
 	soundChannels:     newSoundChannels(16),
 	allPalFX:          *newPalFX(),
@@ -76,20 +81,19 @@ var sys = System{
 	wavChannels:           256,
 	comboExtraFrameWindow: 1,
 	fontShaderVer:         120,
-	//FLAC_FrameWait:          -1,
-	luaSpriteScale:       1,
-	luaPortraitScale:     1,
-	lifebarScale:         1,
-	lifebarPortraitScale: 1,
-	vRetrace:             1,
-	consoleRows:          15,
-	clipboardRows:        2,
-	pngFilter:            false,
-	clsnDarken:           true,
-	maxBgmVolume:         100,
-	stereoEffects:        true,
-	panningRange:         30,
-	windowCentered:       true,
+	luaSpriteScale:        1,
+	luaPortraitScale:      1,
+	lifebarScale:          1,
+	lifebarPortraitScale:  1,
+	vRetrace:              1,
+	consoleRows:           15,
+	clipboardRows:         2,
+	pngFilter:             false,
+	clsnDarken:            true,
+	maxBgmVolume:          100,
+	stereoEffects:         true,
+	panningRange:          30,
+	windowCentered:        true,
 }
 
 type TeamMode int32
@@ -120,6 +124,9 @@ type System struct {
 	debugDraw               bool
 	debugRef                [2]int
 	soundMixer              *beep.Mixer
+	audioBuses              *AudioBuses
+	reverb                  *Reverb
+	audioOut                *AudioOutput
 	bgm                     Bgm
 	soundChannels           *SoundChannels
 	allPalFX, bgPalFX       PalFX
@@ -130,6 +137,7 @@ type System struct {
 	keyState                map[Key]bool
 	netInput                *NetInput
 	fileInput               *FileInput
+	replayRender            *ReplayRenderer
 	aiInput                 [MaxSimul*2 + MaxAttachedChar]AiInput
 	keyConfig               []KeyConfig
 	joystickConfig          []KeyConfig
@@ -158,12 +166,18 @@ type System struct {
 	numSimul, numTurns      [2]int32
 	esc                     bool
 	loadMutex               sync.Mutex
+	loadProgress            LoadProgress
 	ignoreMostErrors        bool
 	stringPool              [MaxSimul*2 + MaxAttachedChar]StringPool
 	bcStack, bcVarStack     BytecodeStack
 	bcVar                   []BytecodeValue
 	workingChar             *Char
 	workingState            *StateBytecode
+	profiler                Profiler
+	renderStats             RenderStats
+	charTest                *CharTest
+	hotReload               HotReload
+	palEditor               PaletteEditor
 	specialFlag             GlobalSpecialFlag
 	afterImageMax           int32
 	comboExtraFrameWindow   int32
@@ -273,10 +287,14 @@ type System struct {
 	masterVolume            int
 	wavVolume               int
 	bgmVolume               int
+	bgmCrossfade            int
 	audioDucking            bool
+	audioTimeStretch        int32
+	audioSpeed              float32
+	soundFont               string
 	windowTitle             string
 	screenshotFolder        string
-	//FLAC_FrameWait          int
+	screenshotGameRes       bool
 
 	// Common Files
 	commonAir    []string
@@ -325,12 +343,16 @@ type System struct {
 	borderless bool
 	vRetrace   int
 	pngFilter  bool // Controls the GL_TEXTURE_MAG_FILTER on 32bit sprites
+	// Packs sprites into texture atlases and batches their draws
+	spriteAtlas bool
+	// Decoded sprites kept on disk between launches, nil if disabled
+	spriteCache *SpriteCache
+	clipRec     ClipRecorder
 
 	gameMode          string
 	frameCounter      int32
 	preFightTime      int32
 	motifDir          string
-	captureNum        int
 	roundType         [2]RoundType
 	timerStart        int32
 	timerRounds       []int32
@@ -420,7 +442,16 @@ func (s *System) init(w, h int32) *lua.LState {
 	gfx.BeginFrame(false)
 	// And the audio.
 	speaker.Init(audioFrequency, audioOutLen)
-	speaker.Play(NewNormalizer(s.soundMixer))
+	for i := range s.audioBuses {
+		if AudioBusType(i) != AB_Bgm {
+			s.soundMixer.Add(&s.audioBuses[i])
+		}
+	}
+	// The reverb must be mixed after the buses that feed it
+	s.soundMixer.Add(s.reverb)
+	s.audioOut.Add(NewNormalizer(newGameSpeedStreamer(s.soundMixer)))
+	s.audioOut.Add(newGameSpeedStreamer(&s.audioBuses[AB_Bgm]))
+	speaker.Play(s.audioOut)
 	l := lua.NewState()
 	l.Options.IncludeGoStackTrace = true
 	l.OpenLibs()
@@ -506,16 +537,39 @@ func (s *System) runMainThreadTask() {
 	}
 }
 
+// Like runMainThreadTask, but leaves the remaining tasks for the next frames
+// once the budget is spent.
+func (s *System) runMainThreadTaskBudget(budget time.Duration) {
+	start := time.Now()
+	for time.Since(start) < budget {
+		select {
+		case f := <-s.mainThreadTask:
+			f()
+		default:
+			return
+		}
+	}
+}
+
 func (s *System) await(fps int) bool {
 	if !s.frameSkip {
+		s.clipRec.capture()
 		// Render the finished frame
+		s.renderStats.startSwap()
 		gfx.EndFrame()
 		s.window.SwapBuffers()
+		s.renderStats.endSwap()
 		// Begin the next frame after events have been processed. Do not clear
 		// the screen if network input is present.
 		defer gfx.BeginFrame(sys.netInput == nil)
 	}
-	s.runMainThreadTask()
+	s.runMainThreadTaskBudget(MainThreadTaskBudget)
+	if s.replayRender != nil {
+		// Rendered replays run as fast as their frames are written
+		s.frameSkip = false
+		s.eventUpdate()
+		return !s.gameEnd
+	}
 	now := time.Now()
 	diff := s.redrawWait.nextTime.Sub(now)
 	wait := time.Second / time.Duration(fps)
@@ -535,6 +589,10 @@ func (s *System) await(fps int) bool {
 		}
 		s.frameSkip = true
 	}
+	// Replays render every frame of a marked clip, even if slowly
+	if s.fileInput != nil && s.clipRec.marking {
+		s.frameSkip = false
+	}
 	s.eventUpdate()
 	return !s.gameEnd
 }
@@ -544,7 +602,16 @@ func (s *System) update() bool {
 	if s.gameTime == 0 {
 		s.preFightTime = s.frameCounter
 	}
+	if s.charTest != nil {
+		// Character tests run as fast as possible and never render
+		s.frameSkip = true
+		s.runMainThreadTask()
+		return s.eventUpdate()
+	}
 	if s.fileInput != nil {
+		if s.replayRender != nil {
+			s.replayRender.capture()
+		}
 		if s.anyHardButton() {
 			s.await(FPS * 4)
 		} else {
@@ -569,13 +636,7 @@ func (s *System) tickSound() {
 	}
 
 	s.bgm.SetPaused(s.nomusic || s.paused)
-
-	//if s.FLAC_FrameWait >= 0 {
-	//	if s.FLAC_FrameWait == 0 {
-	//		s.bgm.PlayMemAudio(s.bgm.loop, s.bgm.bgmVolume)
-	//	}
-	//	s.FLAC_FrameWait--
-	//}
+	s.bgm.update()
 }
 func (s *System) resetRemapInput() {
 	for i := range s.inputRemap {
@@ -1449,6 +1510,7 @@ func (s *System) action() {
 			s.slowtime--
 		}
 		s.turbo = spd
+		s.audioSpeed = spd
 	}
 	s.tickSound()
 	return
@@ -1644,8 +1706,9 @@ func (s *System) drawDebug() {
 			s.debugRef[1] = 0
 		}
 		s.debugWC = s.chars[s.debugRef[0]][s.debugRef[1]]
+		nvarText := s.debugWC.namedVarText()
 		y = float32(s.gameHeight) - float32(s.debugFont.fnt.Size[1])*sys.debugFont.yscl/s.heightScale*
-			(float32(len(s.listLFunc))+float32(s.clipboardRows)) - 1*s.heightScale
+			(float32(len(s.listLFunc))+float32(len(nvarText))+float32(s.clipboardRows)) - 1*s.heightScale
 		for i, f := range s.listLFunc {
 			if f != nil {
 				if i == 1 {
@@ -1671,6 +1734,11 @@ func (s *System) drawDebug() {
 				s.luaLState.SetTop(top)
 			}
 		}
+		//Named variables
+		s.debugFont.SetColor(199, 219, 199)
+		for _, s := range nvarText {
+			put(&x, &y, s)
+		}
 		//Clipboard
 		s.debugFont.SetColor(255, 255, 255)
 		for _, s := range s.debugWC.clipboardText {
@@ -1686,6 +1754,7 @@ func (s *System) drawDebug() {
 				s.debugFont.palfx, s.debugFont.frgba)
 		}
 	}
+	s.palEditor.draw()
 }
 
 // Starts and runs gameplay
@@ -1694,10 +1763,12 @@ func (s *System) drawDebug() {
 func (s *System) fight() (reload bool) {
 	// Reset variables
 	s.gameTime, s.paused, s.accel = 0, false, 1
+	s.palEditor.enabled = false
 	s.aiInput = [len(s.aiInput)]AiInput{}
 	// Defer resetting variables on return
 	defer func() {
 		s.oldNextAddTime = 1
+		s.audioSpeed = 1
 		s.nomusic = false
 		s.allPalFX.clear()
 		s.allPalFX.enable = false
@@ -1707,12 +1778,23 @@ func (s *System) fight() (reload bool) {
 			}
 		}
 		s.wincnt.update()
+		if s.matchOver() || s.endMatch || s.gameEnd {
+			s.profiler.end()
+			s.renderStats.end()
+		}
 	}()
+	if s.profiler.output != "" && !s.profiler.enabled {
+		s.profiler.begin()
+	}
+	if s.renderStats.output != "" && !s.renderStats.enabled {
+		s.renderStats.begin()
+	}
 	var oldStageVars Stage
 	oldStageVars.copyStageVars(s.stage)
 	var life, pow, gpow, spow, rlife [len(s.chars)]int32
 	var ivar [len(s.chars)][]int32
 	var fvar [len(s.chars)][]float32
+	var nvar [len(s.chars)][]BytecodeValue
 	var dialogue [len(s.chars)][]string
 	var mapArray [len(s.chars)]map[string]float32
 	var remapSpr [len(s.chars)]RemapPreset
@@ -1731,6 +1813,7 @@ func (s *System) fight() (reload bool) {
 			fvar[pn] = make([]float32, len(s.chars[pn][0].fvar))
 		}
 		copy(fvar[pn], s.chars[pn][0].fvar[:])
+		nvar[pn] = append(nvar[pn][:0], s.chars[pn][0].nvar...)
 		copy(dialogue[pn], s.chars[pn][0].dialogue[:])
 		mapArray[pn] = make(map[string]float32)
 		for k, v := range s.chars[pn][0].mapArray {
@@ -1909,9 +1992,13 @@ func (s *System) fight() (reload bool) {
 		}
 	}
 
+	speaker.Lock()
+	s.reverb.Set(s.stage.reverb)
+	speaker.Unlock()
+
 	//default bgm playback, used only in Quick VS or if externalized Lua implementaion is disabled
 	if s.round == 1 && (s.gameMode == "" || len(sys.commonLua) == 0) {
-		s.bgm.Open(s.stage.bgmusic, 1, int(s.stage.bgmvolume), int(s.stage.bgmloopstart), int(s.stage.bgmloopend), 0)
+		s.bgm.Open(s.stage.bgmusic, 1, int(s.stage.bgmvolume), int(s.stage.bgmloopstart), int(s.stage.bgmloopend), 0, s.bgmCrossfade, s.stage.bgmsoundfont)
 	}
 
 	oldWins, oldDraws := s.wins, s.draws
@@ -1929,6 +2016,7 @@ func (s *System) fight() (reload bool) {
 				p[0].redLife = rlife[i]
 				copy(p[0].ivar[:], ivar[i])
 				copy(p[0].fvar[:], fvar[i])
+				p[0].nvar = append(p[0].nvar[:0], nvar[i]...)
 				copy(p[0].dialogue[:], dialogue[i])
 				p[0].mapArray = make(map[string]float32)
 				for k, v := range mapArray[i] {
@@ -2056,6 +2144,12 @@ func (s *System) fight() (reload bool) {
 
 		// Update game state
 		s.action()
+		if s.profiler.enabled {
+			s.profiler.frames++
+		}
+		if s.charTest != nil {
+			s.charTest.step()
+		}
 
 		// F4 pressed to restart round
 		if s.roundResetFlg && !s.postMatchFlg {
@@ -2068,6 +2162,7 @@ func (s *System) fight() (reload bool) {
 		}
 
 		debugInput()
+		s.hotReload.update()
 		if !s.addFrameTime(s.turbo) {
 			if !s.eventUpdate() {
 				return false
@@ -2105,7 +2200,9 @@ func (s *System) fight() (reload bool) {
 				s.zoomPos = [2]float32{0, 0}
 				s.drawScale = s.cam.Scale
 			}
+			s.renderStats.startDraw()
 			s.draw(dx, dy, dscl)
+			s.renderStats.endDraw()
 		}
 		// Render top elements such as fade effects
 		if !s.frameSkip {
@@ -2304,6 +2401,7 @@ type OverrideCharData struct {
 	lifeRatio   float32
 	attackRatio float32
 	existed     bool
+	userPal     string
 }
 
 func newOverrideCharData() *OverrideCharData {
@@ -2979,6 +3077,7 @@ func (l *Loader) runTread() bool {
 		return false
 	}
 	l.state = LS_Loading
+	sys.loadProgress.reset()
 	go l.load()
 	return true
 }
@@ -34,11 +34,16 @@ func (s *System) newWindow(w, h int) (*Window, error) {
 
 	// "-windowed" overrides the configuration setting but does not change it
 	_, forceWindowed := sys.cmdFlags["-windowed"]
-	fullscreen := s.fullscreen && !forceWindowed
+	// Character tests run headlessly, so the window is never shown
+	_, headless := sys.cmdFlags["-test"]
+	fullscreen := s.fullscreen && !forceWindowed && !headless
 
 	glfw.WindowHint(glfw.Resizable, glfw.False)
 	glfw.WindowHint(glfw.ContextVersionMajor, 2)
 	glfw.WindowHint(glfw.ContextVersionMinor, 1)
+	if headless {
+		glfw.WindowHint(glfw.Visible, glfw.False)
+	}
 
 	// Create main window.
 	// NOTE: Borderless fullscreen is in reality just a window without borders.
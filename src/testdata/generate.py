@@ -0,0 +1,782 @@
+#!/usr/bin/env python3
+# Generates the test fixtures of flac_test.go, looptest_test.go and
+# opus_test.go, with nothing but the standard library:
+#
+#   cd src/testdata && python3 generate.py
+#
+# The FLAC files come from an encoder written from the format specification,
+# independently of flac.go, that uses every channel assignment, subframe type,
+# residual coding method and frame header code. The checksums it prints are
+# those of the samples flacDecode must output, and go in flac_test.go.
+#
+# loop/loop.ogg and loop/loop.mp3 are made from third party files, see
+# README.md. Their loop points are written here, as Vorbis comments for the
+# Ogg file, and in looptest_test.go for the MP3 file.
+#
+# The Opus files hold CELT frames that only code their silence flag, in every
+# frame size and packet code. Their lengths, printed after the checksums, go
+# in opus_test.go.
+
+import hashlib
+import math
+import os
+import struct
+import sys
+
+
+def lcg(seed):
+    state = seed
+    while True:
+        state = (state * 1103515245 + 12345) & 0x7FFFFFFF
+        yield (state >> 8) / float(1 << 23) * 2 - 1
+
+
+def signal(n, rate, bps, channels, seed, noise_level=0.005):
+    # Tones with a changing amplitude and some noise, the right channel close
+    # to the left one so that stereo decorrelation pays off
+    noise = lcg(seed)
+    nl = noise_level
+    peak = (1 << (bps - 1)) - 1
+    out = []
+    for i in range(n):
+        t = i / rate
+        env = 0.35 + 0.3 * math.sin(2 * math.pi * 1.3 * t)
+        l = env * (math.sin(2 * math.pi * 220 * t) + 0.5 * math.sin(2 * math.pi * 331 * t))
+        l += nl * next(noise)
+        r = 0.8 * l + 0.1 * math.sin(2 * math.pi * 587 * t) + nl / 2 * next(noise)
+        frame = [l, r][:channels]
+        out.append([max(-peak - 1, min(peak, int(round(v * peak * 0.6)))) for v in frame])
+    return out
+
+
+# ------------------------------------------------------------------
+# FLAC
+
+class BitWriter:
+    def __init__(self):
+        self.data = bytearray()
+        self.acc = 0
+        self.n = 0
+
+    def bits(self, v, n):
+        if n == 0:
+            return
+        self.acc = self.acc << n | (v & ((1 << n) - 1))
+        self.n += n
+        while self.n >= 8:
+            self.n -= 8
+            self.data.append(self.acc >> self.n & 0xFF)
+        self.acc &= (1 << self.n) - 1
+
+    def signed(self, v, n):
+        assert -(1 << (n - 1)) <= v < (1 << (n - 1)) if n > 0 else v == 0, (v, n)
+        self.bits(v, n)
+
+    def unary(self, q):
+        # q zero bits, then a one
+        while q >= 32:
+            self.bits(0, 32)
+            q -= 32
+        self.bits(1, q + 1)
+
+    def align(self):
+        if self.n:
+            self.bits(0, 8 - self.n)
+
+    def bytes(self):
+        assert self.n == 0
+        return bytes(self.data)
+
+
+def crc8(data):
+    crc = 0
+    for b in data:
+        crc ^= b
+        for _ in range(8):
+            crc = (crc << 1 ^ 0x07 if crc & 0x80 else crc << 1) & 0xFF
+    return crc
+
+
+def crc16(data):
+    crc = 0
+    for b in data:
+        crc ^= b << 8
+        for _ in range(8):
+            crc = (crc << 1 ^ 0x8005 if crc & 0x8000 else crc << 1) & 0xFFFF
+    return crc
+
+
+def utf8(v):
+    if v < 0x80:
+        return bytes([v])
+    n = 2
+    while v >= 1 << (5 * n + 1):
+        n += 1
+    out = []
+    for _ in range(n - 1):
+        out.append(0x80 | v & 0x3F)
+        v >>= 6
+    out.append((0xFF00 >> n) & 0xFF | v)
+    return bytes(reversed(out))
+
+
+def width(values):
+    # Bits needed to store every value as a signed integer
+    w = 0
+    for v in values:
+        while not -(1 << (w - 1)) <= v < (1 << (w - 1)) if w > 0 else v != 0:
+            w += 1
+    return w
+
+
+def fixed_residual(s, order):
+    coefs = [[], [1], [2, -1], [3, -3, 1], [4, -6, 4, -1]][order]
+    return [s[i] - sum(c * s[i - 1 - j] for j, c in enumerate(coefs))
+            for i in range(order, len(s))]
+
+
+def lpc_coefs(s, order, precision):
+    # Levinson-Durbin on the autocorrelation, then quantization
+    n = len(s)
+    ac = [sum(s[i] * s[i - k] for i in range(k, n)) for k in range(order + 1)]
+    ac[0] = ac[0] * (1 + 1e-9) + 1
+    a = [0.0] * order
+    err = ac[0]
+    for i in range(order):
+        k = (ac[i + 1] - sum(a[j] * ac[i - j] for j in range(i))) / err
+        a = [a[j] - k * a[i - 1 - j] for j in range(i)] + [k] + a[i + 1:]
+        err *= 1 - k * k
+    cmax = max(abs(c) for c in a) or 1
+    shift = precision - 1 - max(0, math.ceil(math.log2(cmax + 1e-12)))
+    shift = max(0, min(15, shift))
+    lim = 1 << (precision - 1)
+    return [max(-lim, min(lim - 1, int(round(c * (1 << shift))))) for c in a], shift
+
+
+def lpc_residual(s, coefs, shift):
+    order = len(coefs)
+    return [s[i] - (sum(c * s[i - 1 - j] for j, c in enumerate(coefs)) >> shift)
+            for i in range(order, len(s))]
+
+
+def write_residual(bw, res, blocksize, order, method, porder, escapes):
+    param_bits, escape = (4, 15) if method == 0 else (5, 31)
+    bw.bits(method, 2)
+    bw.bits(porder, 4)
+    parts = 1 << porder
+    i = 0
+    for p in range(parts):
+        n = (blocksize >> porder) - (order if p == 0 else 0)
+        part = res[i:i + n]
+        i += n
+        us = [(v << 1) ^ (v >> 63) if v >= 0 else ((-v) << 1) - 1 for v in part]
+        best, best_k = None, 0
+        for k in range(escape):
+            cost = sum((u >> k) + 1 + k for u in us)
+            if best is None or cost < best:
+                best, best_k = cost, k
+        raw = width(part)
+        if p in escapes or best is None or best > raw * n + 5:
+            bw.bits(escape, param_bits)
+            bw.bits(raw, 5)
+            for v in part:
+                bw.signed(v, raw)
+            continue
+        bw.bits(best_k, param_bits)
+        for u in us:
+            bw.unary(u >> best_k)
+            bw.bits(u, best_k)
+    assert i == len(res)
+
+
+def write_subframe(bw, s, bps, kind, wasted, method, porder, escapes):
+    bw.bits(0, 1)
+    if kind == 'constant':
+        assert all(v == s[0] for v in s)
+        bw.bits(0, 6)
+        bw.bits(0, 1)
+        bw.signed(s[0], bps)
+        return
+    if wasted:
+        assert all(v % (1 << wasted) == 0 for v in s)
+        s = [v >> wasted for v in s]
+        bps -= wasted
+    if kind == 'verbatim':
+        typ, order = 1, 0
+    elif kind.startswith('fixed'):
+        order = int(kind[5:])
+        typ = 8 + order
+    else:
+        order = int(kind[3:])
+        typ = 32 + order - 1
+    bw.bits(typ, 6)
+    if wasted:
+        bw.bits(1, 1)
+        bw.unary(wasted - 1)
+    else:
+        bw.bits(0, 1)
+    if kind == 'verbatim':
+        for v in s:
+            bw.signed(v, bps)
+        return
+    for v in s[:order]:
+        bw.signed(v, bps)
+    if kind.startswith('fixed'):
+        res = fixed_residual(s, order)
+    else:
+        precision = 15 - order % 10
+        coefs, shift = lpc_coefs(s, order, precision)
+        res = lpc_residual(s, coefs, shift)
+        bw.bits(precision - 1, 4)
+        bw.signed(shift, 5)
+        for c in coefs:
+            bw.signed(c, precision)
+    while porder > 0 and (len(s) % (1 << porder) or (len(s) >> porder) <= order):
+        porder -= 1
+    write_residual(bw, res, len(s), order, method, porder, escapes)
+
+
+BS_CODES = {192: 1, 576: 2, 1152: 3, 2304: 4, 4608: 5, 256: 8, 512: 9, 1024: 10,
+            2048: 11, 4096: 12, 8192: 13, 16384: 14, 32768: 15}
+SR_CODES = {88200: 1, 176400: 2, 192000: 3, 8000: 4, 16000: 5, 22050: 6, 24000: 7,
+            32000: 8, 44100: 9, 48000: 10, 96000: 11}
+SS_CODES = {8: 1, 12: 2, 16: 4, 20: 5, 24: 6, 32: 7}
+
+
+def write_frame(out, start, frame, plan, rate, bps, channels):
+    size = len(frame)
+    hdr = BitWriter()
+    hdr.bits(0x3FFE, 14)
+    hdr.bits(0, 1)
+    hdr.bits(1, 1)  # variable block size, coded with the sample number
+    # Block size, sample rate and sample size codes, from the stream info or
+    # the frame header
+    bs_extra = None
+    if size in BS_CODES and not plan.get('bs_end'):
+        hdr.bits(BS_CODES[size], 4)
+    elif size <= 256:
+        hdr.bits(6, 4)
+        bs_extra = (size - 1, 8)
+    else:
+        hdr.bits(7, 4)
+        bs_extra = (size - 1, 16)
+    sr = plan.get('sr', 'info')
+    sr_extra = None
+    if sr == 'info':
+        hdr.bits(0, 4)
+    elif sr == 'code':
+        hdr.bits(SR_CODES[rate], 4)
+    elif sr == 'khz':
+        hdr.bits(12, 4)
+        sr_extra = (rate // 1000, 8)
+    elif sr == 'hz':
+        hdr.bits(13, 4)
+        sr_extra = (rate, 16)
+    else:
+        hdr.bits(14, 4)
+        sr_extra = (rate // 10, 16)
+    assign = plan['assign']
+    hdr.bits({'independent': channels - 1, 'left_side': 8, 'side_right': 9,
+              'mid_side': 10}[assign], 4)
+    hdr.bits(SS_CODES[bps] if plan.get('ss') else 0, 3)
+    hdr.bits(0, 1)
+    for b in utf8(start):
+        hdr.bits(b, 8)
+    if bs_extra:
+        hdr.bits(*bs_extra)
+    if sr_extra:
+        hdr.bits(*sr_extra)
+    head = hdr.bytes()
+    body = BitWriter()
+    for b in head:
+        body.bits(b, 8)
+    body.bits(crc8(head), 8)
+
+    cols = [[f[c] for f in frame] for c in range(channels)]
+    subs = [(s, bps) for s in cols]
+    if assign != 'independent':
+        l, r = cols
+        side = [a - b for a, b in zip(l, r)]
+        if assign == 'left_side':
+            subs = [(l, bps), (side, bps + 1)]
+        elif assign == 'side_right':
+            subs = [(side, bps + 1), (r, bps)]
+        else:
+            subs = [([(a + b) >> 1 for a, b in zip(l, r)], bps), (side, bps + 1)]
+    for ch, (s, sbps) in enumerate(subs):
+        kind = plan['kinds'][ch % len(plan['kinds'])]
+        write_subframe(body, s, sbps, kind, plan.get('wasted', 0) if kind != 'constant' else 0,
+                       plan.get('method', 0), plan.get('porder', 8), plan.get('escapes', ()))
+    body.align()
+    data = body.bytes()
+    out += data + struct.pack('>H', crc16(data))
+
+
+def write_flac(filename, samples, rate, bps, plans, comments=()):
+    channels = len(samples[0])
+    frames = bytearray()
+    start = 0
+    sizes = []
+    for plan in plans:
+        size = plan['size']
+        frame = samples[start:start + size]
+        write_frame(frames, start, frame, plan, rate, bps, channels)
+        sizes.append(size)
+        start += size
+    assert start == len(samples), (start, len(samples))
+    nbytes = (bps + 7) // 8
+    md5 = hashlib.md5(b''.join(v.to_bytes(nbytes, 'little', signed=True)
+                               for f in samples for v in f)).digest()
+    info = BitWriter()
+    info.bits(16, 16)
+    info.bits(max(sizes), 16)
+    info.bits(0, 24)
+    info.bits(0, 24)
+    info.bits(rate, 20)
+    info.bits(channels - 1, 3)
+    info.bits(bps - 1, 5)
+    info.bits(len(samples), 36)
+    blocks = [(0, info.bytes() + md5)]
+    if comments:
+        vendor = b'ikemen testdata'
+        vc = struct.pack('<I', len(vendor)) + vendor + struct.pack('<I', len(comments))
+        for c in comments:
+            vc += struct.pack('<I', len(c)) + c.encode()
+        blocks.append((4, vc))
+    out = bytearray(b'fLaC')
+    for i, (typ, data) in enumerate(blocks):
+        last = 0x80 if i == len(blocks) - 1 else 0
+        out += bytes([last | typ]) + len(data).to_bytes(3, 'big') + data
+    out += frames
+    with open(filename, 'wb') as f:
+        f.write(out)
+    return decoded_md5(samples, bps)
+
+
+def decoded_md5(samples, bps):
+    # The samples as flacDecode streams them: the first and last channels,
+    # scaled to 16 bits
+    data = bytearray()
+    for f in samples:
+        for v in (f[0], f[-1]):
+            v = v >> (bps - 16) if bps > 16 else v << (16 - bps)
+            data += struct.pack('<h', v)
+    return hashlib.md5(data).hexdigest()
+
+
+def plan_frames(total, sizes, assigns, kinds, extra):
+    plans = []
+    i = 0
+    left = total
+    while left > 0:
+        size = min(sizes[i % len(sizes)], left)
+        plan = {'size': size, 'assign': assigns[i % len(assigns)],
+                'kinds': kinds[i % len(kinds)], 'method': i % 2,
+                'sr': ['info', 'code', 'hz', 'tens', 'khz'][i % 5], 'ss': i % 3 == 1,
+                'escapes': (1,) if i % 4 == 2 else (), 'porder': [8, 0, 3, 1][i % 4]}
+        plan.update(extra.get(i, {}))
+        plans.append(plan)
+        left -= size
+        i += 1
+    return plans
+
+
+def make_flacs():
+    results = {}
+
+    # 16-bit stereo: every channel assignment, subframe type and block size
+    # code, Rice and Rice2 residuals with escaped partitions
+    rate, bps = 44100, 16
+    sizes = [4096, 192, 576, 1152, 2304, 256, 512, 1024, 2048, 100, 1000, 37, 4608]
+    total = sum(sizes) + 300
+    s = signal(total, rate, bps, 2, 1)
+    # Silence and a DC offset for constant subframes, and samples with their
+    # 2 low bits clear for wasted bits
+    starts = [sum(sizes[:k]) for k in range(len(sizes) + 1)]
+    for i in range(starts[5], starts[6]):
+        s[i] = [0, 0]
+    for i in range(starts[9], starts[10]):
+        s[i] = [1234, -77]
+    for i in range(starts[7], starts[8]):
+        s[i] = [v >> 2 << 2 for v in s[i]]
+    assigns = ['independent', 'left_side', 'side_right', 'mid_side']
+    kinds = [['fixed2', 'fixed1'], ['lpc8', 'lpc12'], ['fixed0', 'fixed3'], ['fixed4', 'lpc1'],
+             ['lpc32', 'lpc2'], ['constant'], ['verbatim', 'lpc4'], ['fixed2', 'lpc6'],
+             ['lpc16', 'fixed2'], ['constant'], ['lpc10', 'lpc3'], ['verbatim'], ['lpc5', 'fixed4']]
+    extra = {7: {'wasted': 2, 'assign': 'left_side'}, 1: {'bs_end': True}, 3: {'escapes': (0, 1, 2, 3)},
+             10: {'escapes': (0,), 'porder': 0}}
+    # Constant frames need the same assignment as their content allows
+    extra[5] = {'assign': 'independent'}
+    extra[9] = {'assign': 'independent'}
+    plans = plan_frames(total, sizes, assigns, kinds, extra)
+    for p in plans:
+        if p['sr'] == 'khz':
+            p['sr'] = 'tens'
+    results['stereo16.flac'] = (write_flac('flac/stereo16.flac', s, rate, bps, plans), total)
+
+    # 24-bit mono: high LPC orders, Rice2 parameters over 14, wasted bits
+    rate, bps = 48000, 24
+    sizes = [4096, 1152, 333, 2048]
+    total = sum(sizes) * 2
+    s = signal(total, rate, bps, 1, 2)
+    for i in range(sizes[0], sizes[0] + sizes[1]):
+        s[i] = [s[i][0] >> 4 << 4]
+    kinds = [['lpc32'], ['lpc20'], ['fixed3'], ['lpc12'], ['lpc24'], ['fixed1'], ['verbatim'], ['lpc7']]
+    plans = plan_frames(total, sizes, ['independent'], kinds, {1: {'wasted': 4}, 4: {'escapes': (0, 2)}})
+    for p in plans:
+        p['method'] = 1
+    results['mono24.flac'] = (write_flac('flac/mono24.flac', s, rate, bps, plans), total)
+
+    # 12-bit stereo at a rate without a code of its own
+    rate, bps = 11025, 12
+    sizes = [1024, 576, 4096, 200]
+    total = sum(sizes) * 2 - 50
+    s = signal(total, rate, bps, 2, 3)
+    kinds = [['lpc4', 'fixed2'], ['fixed1', 'lpc2'], ['lpc8', 'lpc8'], ['verbatim', 'fixed0']]
+    plans = plan_frames(total, sizes, ['mid_side', 'side_right', 'left_side', 'independent'],
+                        kinds, {})
+    for p in plans:
+        if p['sr'] in ('code', 'khz', 'tens'):
+            p['sr'] = 'hz'
+    results['stereo12.flac'] = (write_flac('flac/stereo12.flac', s, rate, bps, plans), total)
+    return results
+
+
+# ------------------------------------------------------------------
+# Loop fixtures
+
+LOOP_RATE = 22050
+LOOP_LEN = 20000
+LOOP_START, LOOP_END = 5000, 15000
+
+
+def make_wav():
+    s = signal(LOOP_LEN, LOOP_RATE, 16, 1, 4)
+    data = b''.join(struct.pack('<h', *f) for f in s)
+    fmt = struct.pack('<HHIIHH', 1, 1, LOOP_RATE, LOOP_RATE * 2, 2, 16)
+    # smpl chunk with one forward loop, whose end is inclusive
+    smpl = struct.pack('<9I', 0, 0, 1000000000 // LOOP_RATE, 60, 0, 0, 0, 1, 0)
+    smpl += struct.pack('<6I', 0, 0, LOOP_START, LOOP_END - 1, 0, 0)
+    body = b'WAVE' + b'fmt ' + struct.pack('<I', len(fmt)) + fmt
+    body += b'data' + struct.pack('<I', len(data)) + data
+    body += b'smpl' + struct.pack('<I', len(smpl)) + smpl
+    with open('loop/loop.wav', 'wb') as f:
+        f.write(b'RIFF' + struct.pack('<I', len(body)) + body)
+
+
+def make_flac_loop():
+    s = signal(LOOP_LEN, LOOP_RATE, 16, 1, 5)
+    sizes = [4096, 1152]
+    plans = plan_frames(LOOP_LEN, sizes, ['independent'], [['lpc8'], ['fixed2']], {})
+    for p in plans:
+        p['sr'] = 'code'
+    write_flac('loop/loop.flac', s, LOOP_RATE, 16, plans,
+               ['LOOPSTART=%d' % LOOP_START, 'LOOPLENGTH=%d' % (LOOP_END - LOOP_START)])
+
+
+OGG_CRC = []
+
+
+def ogg_crc(data):
+    if not OGG_CRC:
+        for i in range(256):
+            r = i << 24
+            for _ in range(8):
+                r = (r << 1 ^ 0x04C11DB7 if r & 0x80000000 else r << 1) & 0xFFFFFFFF
+            OGG_CRC.append(r)
+    crc = 0
+    for b in data:
+        crc = (crc << 8 & 0xFFFFFFFF) ^ OGG_CRC[(crc >> 24) ^ b]
+    return crc
+
+
+def ogg_pages(data):
+    pos = 0
+    while pos < len(data):
+        assert data[pos:pos + 4] == b'OggS'
+        nseg = data[pos + 26]
+        lacing = data[pos + 27:pos + 27 + nseg]
+        size = sum(lacing)
+        yield {'flags': data[pos + 5], 'granule': data[pos + 6:pos + 14],
+               'serial': data[pos + 14:pos + 18], 'lacing': bytes(lacing),
+               'body': data[pos + 27 + nseg:pos + 27 + nseg + size]}
+        pos += 27 + nseg + size
+
+
+def ogg_page(flags, granule, serial, seq, lacing, body):
+    hdr = b'OggS' + bytes([0, flags]) + granule + serial + struct.pack('<I', seq)
+    page = bytearray(hdr + b'\0\0\0\0' + bytes([len(lacing)]) + lacing + body)
+    page[22:26] = struct.pack('<I', ogg_crc(page))
+    return bytes(page)
+
+
+def make_ogg(src):
+    # Adds LOOPSTART and LOOPLENGTH to the comment header of an Ogg Vorbis
+    # file, then pages the headers again and renumbers the audio pages
+    pages = list(ogg_pages(open(src, 'rb').read()))
+    packets, cur, i = [], b'', 0
+    while len(packets) < 3:
+        p = pages[i]
+        off = 0
+        for l in p['lacing']:
+            cur += p['body'][off:off + l]
+            off += l
+            if l < 255:
+                packets.append(cur)
+                cur = b''
+        i += 1
+    assert cur == b'' and packets[1][:7] == b'\x03vorbis'
+    c = packets[1][7:]
+    n = struct.unpack('<I', c[:4])[0]
+    vendor, rest = c[:4 + n], c[4 + n:]
+    count = struct.unpack('<I', rest[:4])[0]
+    comments = rest[4:-1]
+    for t in ('LOOPSTART=%d' % LOOP_START, 'LOOPLENGTH=%d' % (LOOP_END - LOOP_START)):
+        comments += struct.pack('<I', len(t)) + t.encode()
+        count += 1
+    packets[1] = b'\x03vorbis' + vendor + struct.pack('<I', count) + comments + b'\x01'
+    serial = pages[0]['serial']
+    out = [ogg_page(2, bytes(8), serial, 0, lacing_of(packets[0]), packets[0])]
+    seq, continued = 1, False
+    body = packets[1] + packets[2]
+    lacing = lacing_of(packets[1]) + lacing_of(packets[2])
+    while lacing:
+        n = min(255, len(lacing))
+        size = sum(lacing[:n])
+        out.append(ogg_page(1 if continued else 0, bytes(8), serial, seq, lacing[:n], body[:size]))
+        continued = lacing[n - 1] == 255
+        body, lacing, seq = body[size:], lacing[n:], seq + 1
+    for p in pages[i:]:
+        out.append(ogg_page(p['flags'], p['granule'], serial, seq, p['lacing'], p['body']))
+        seq += 1
+    with open('loop/loop.ogg', 'wb') as f:
+        f.write(b''.join(out))
+
+
+def lacing_of(packet):
+    n = len(packet)
+    return bytes([255] * (n // 255) + [n % 255])
+
+
+# ------------------------------------------------------------------
+# Opus
+
+class RangeEncoder:
+    # The range encoder of RFC 6716 4.1, just enough of it to code bits
+    def __init__(self):
+        self.rng, self.val, self.rem, self.ext = 1 << 31, 0, -1, 0
+        self.out = bytearray()
+
+    def carry_out(self, c):
+        if c == 0xFF:
+            self.ext += 1
+            return
+        carry = c >> 8
+        if self.rem >= 0:
+            self.out.append(self.rem + carry & 0xFF)
+        self.out += bytes([0xFF + carry & 0xFF] * self.ext)
+        self.ext, self.rem = 0, c & 0xFF
+
+    def normalize(self):
+        while self.rng <= 1 << 23:
+            self.carry_out(self.val >> 23)
+            self.val = self.val << 8 & 0x7FFFFFFF
+            self.rng <<= 8
+
+    def bit_logp(self, bit, logp):
+        s = self.rng >> logp
+        if bit:
+            self.val += self.rng - s
+            self.rng = s
+        else:
+            self.rng -= s
+        self.normalize()
+
+    def done(self):
+        l = 32 - self.rng.bit_length()
+        msk = 0x7FFFFFFF >> l
+        end = self.val + msk & ~msk
+        if end | msk >= self.val + self.rng:
+            l += 1
+            msk >>= 1
+            end = self.val + msk & ~msk
+        while l > 0:
+            self.carry_out(end >> 23)
+            end = end << 8 & 0x7FFFFFFF
+            l -= 8
+        if self.rem >= 0 or self.ext > 0:
+            self.carry_out(0)
+        return bytes(self.out)
+
+
+def celt_silence():
+    # A CELT frame that only codes its silence flag (RFC 6716 4.3), which
+    # decodes to exact silence whatever its length and channels
+    enc = RangeEncoder()
+    enc.bit_logp(1, 15)
+    return enc.done()
+
+
+# CELT-only fullband TOC configs, of 2.5 to 20 ms frames
+OPUS_FRAME = {28: 120, 29: 240, 30: 480, 31: 960}
+
+
+def opus_packet(config, frames, code, stereo):
+    # Code 0 is one frame, 1 two of the same size, 2 two of different sizes
+    # and 3 (CBR here) any number of them. Zero bytes after a frame's range
+    # coded data don't change it.
+    frame = celt_silence()
+    toc = bytes([config << 3 | stereo << 2 | code])
+    if code == 2:
+        return toc + bytes([len(frame)]) + frame + frame + b'\0'
+    if code == 3:
+        toc += bytes([frames])
+    return toc + frame * frames
+
+
+def write_opus(filename, channels, pre_skip, packets, trim, comments=()):
+    # Audio pages of up to 10 packets, the last one trimmed by its granule
+    # position. Returns the number of samples left once pre-skip and the end
+    # are trimmed.
+    serial = struct.pack('<I', 0x4F707573)
+    head = b'OpusHead' + struct.pack('<BBHIhB', 1, channels, pre_skip, 22050, 0, 0)
+    vendor = b'generate.py'
+    tags = b'OpusTags' + struct.pack('<I', len(vendor)) + vendor + struct.pack('<I', len(comments))
+    for c in comments:
+        tags += struct.pack('<I', len(c)) + c.encode()
+    out = [ogg_page(2, bytes(8), serial, 0, lacing_of(head), head),
+           ogg_page(0, bytes(8), serial, 1, lacing_of(tags), tags)]
+    granule, seq = 0, 2
+    for i in range(0, len(packets), 10):
+        page = [opus_packet(cfg, n, code, channels == 2) for cfg, n, code in packets[i:i + 10]]
+        granule += sum(OPUS_FRAME[cfg] * n for cfg, n, _ in packets[i:i + 10])
+        last = i + 10 >= len(packets)
+        if last:
+            granule -= trim
+        out.append(ogg_page(4 if last else 0, struct.pack('<q', granule), serial, seq,
+                            b''.join(lacing_of(p) for p in page), b''.join(page)))
+        seq += 1
+    with open(filename, 'wb') as f:
+        f.write(b''.join(out))
+    return granule - pre_skip
+
+
+def make_opus():
+    # Every frame size and packet code, with the usual 80 ms pre-skip and an
+    # uncommon one, and end trimming within a frame and across frames
+    kinds = [(31, 1, 0), (30, 2, 1), (28, 6, 3), (29, 1, 0), (31, 3, 3), (28, 2, 2),
+             (30, 1, 0), (29, 4, 3)]
+    mono = [kinds[i * 5 % len(kinds)] for i in range(37)]
+    stereo = [kinds[i * 3 % len(kinds)] for i in range(26)]
+    return {
+        'mono.opus': write_opus('opus/mono.opus', 1, 312, mono, 100),
+        'stereo.opus': write_opus('opus/stereo.opus', 2, 3840, stereo, 1000,
+                                  ['LOOPSTART=4800', 'LOOPLENGTH=9600']),
+    }
+
+
+def make_mp3(src, frames):
+    # The first frames of an MPEG file, whole frames only
+    data = open(src, 'rb').read()
+    pos = 0
+    if data[:3] == b'ID3':
+        pos = 10 + (data[6] << 21 | data[7] << 14 | data[8] << 7 | data[9])
+    out = bytearray()
+    for _ in range(frames):
+        h = struct.unpack('>I', data[pos:pos + 4])[0]
+        assert h >> 21 == 0x7FF, hex(h)
+        version = h >> 19 & 3
+        bitrate = [[0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160],
+                   [0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320]][
+            version == 3][h >> 12 & 15] * 1000
+        rate = [[11025, 12000, 8000], [0, 0, 0], [22050, 24000, 16000],
+                [44100, 48000, 32000]][version][h >> 10 & 3]
+        size = (144 if version == 3 else 72) * bitrate // rate + (h >> 9 & 1)
+        out += data[pos:pos + size]
+        pos += size
+    with open('loop/loop.mp3', 'wb') as f:
+        f.write(out)
+
+
+def make_midi():
+    # Format 1, a tempo track and a note track, 480 ticks per quarter note at
+    # 120 bpm, so a tick is 1/960 of a second. The program, volume and effect
+    # sends are set before CC111 marks the loop start at one second, then
+    # eight notes play, followed by a rest up to the end at four seconds.
+    # Reverb and chorus are off, as their tail would ring across the loop.
+    def var(v):
+        out = [v & 0x7F]
+        v >>= 7
+        while v:
+            out.append(0x80 | v & 0x7F)
+            v >>= 7
+        return bytes(reversed(out))
+
+    tempo = b'\x00\xFF\x51\x03\x07\xA1\x20' + var(3840) + b'\xFF\x2F\x00'
+    notes = bytearray(b'\x00\xC0\x00\x00\xB0\x07\x64\x00\x5B\x00\x00\x5D\x00')
+    notes += var(960) + b'\xB0\x6F\x00'
+    for key in [60, 64, 67, 72, 67, 64, 60, 55]:
+        # Running status for the note off, sent as a note on of velocity 0
+        notes += b'\x00\x90' + bytes([key, 100]) + var(240) + bytes([key, 0])
+    notes += var(3840 - 960 - 8 * 240) + b'\xFF\x2F\x00'
+    data = b'MThd' + struct.pack('>IHHH', 6, 1, 2, 480)
+    for trk in (tempo, bytes(notes)):
+        data += b'MTrk' + struct.pack('>I', len(trk)) + trk
+    with open('loop/loop.mid', 'wb') as f:
+        f.write(data)
+
+
+def make_sf2():
+    # A soundfont of one preset playing a looped sine wave on every key
+    rate, n = 22050, 2205
+    smpl = b''.join(struct.pack('<h', int(round(12000 * math.sin(2 * math.pi * 10 * i / n))))
+                    for i in range(n)) + bytes(46 * 2)
+
+    def chunk(cid, data):
+        pad = b'\0' if len(data) % 2 else b''
+        return cid + struct.pack('<I', len(data)) + data + pad
+
+    def lst(ltype, data):
+        return chunk(b'LIST', ltype + data)
+
+    def name(s):
+        return s.encode().ljust(20, b'\0')
+
+    info = lst(b'INFO', chunk(b'ifil', struct.pack('<HH', 2, 1)) +
+               chunk(b'isng', b'EMU8000\0') + chunk(b'INAM', b'ikemen test\0'))
+    sdta = lst(b'sdta', chunk(b'smpl', smpl))
+    # Generators: 54 sampleModes, 53 sampleID, 41 instrument
+    phdr = name('Sine') + struct.pack('<HHHIII', 0, 0, 0, 0, 0, 0)
+    phdr += name('EOP') + struct.pack('<HHHIII', 0, 0, 1, 0, 0, 0)
+    pbag = struct.pack('<HH', 0, 0) + struct.pack('<HH', 1, 0)
+    pmod = bytes(10)
+    pgen = struct.pack('<HH', 41, 0) + bytes(4)
+    inst = name('Sine') + struct.pack('<H', 0) + name('EOI') + struct.pack('<H', 1)
+    ibag = struct.pack('<HH', 0, 0) + struct.pack('<HH', 2, 0)
+    imod = bytes(10)
+    igen = struct.pack('<HH', 54, 1) + struct.pack('<HH', 53, 0) + bytes(4)
+    shdr = name('Sine') + struct.pack('<IIIIIBbHH', 0, n, 0, n, rate, 43, 0, 0, 1)
+    shdr += name('EOS') + bytes(26)
+    pdta = lst(b'pdta', chunk(b'phdr', phdr) + chunk(b'pbag', pbag) + chunk(b'pmod', pmod) +
+               chunk(b'pgen', pgen) + chunk(b'inst', inst) + chunk(b'ibag', ibag) +
+               chunk(b'imod', imod) + chunk(b'igen', igen) + chunk(b'shdr', shdr))
+    body = b'sfbk' + info + sdta + pdta
+    with open('loop/test.sf2', 'wb') as f:
+        f.write(b'RIFF' + struct.pack('<I', len(body)) + body)
+
+
+if __name__ == '__main__':
+    os.makedirs('flac', exist_ok=True)
+    os.makedirs('loop', exist_ok=True)
+    for name, (md5, n) in make_flacs().items():
+        print('{"%s", %d, "%s"},' % (name, n, md5))
+    make_wav()
+    make_flac_loop()
+    make_midi()
+    make_sf2()
+    os.makedirs('opus', exist_ok=True)
+    for name, n in make_opus().items():
+        print('{"%s", %d},' % (name, n))
+    if len(sys.argv) > 2:
+        make_ogg(sys.argv[1])
+        make_mp3(sys.argv[2], 60)